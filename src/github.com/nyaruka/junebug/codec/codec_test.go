@@ -0,0 +1,181 @@
+package codec_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/junebug/codec"
+)
+
+func TestGSM7(t *testing.T) {
+	text := "Hello @ £5 {ok} € ñ\n"
+	if !codec.IsGSM7(text) {
+		t.Errorf("Expected %q to be GSM7", text)
+	}
+	if codec.IsGSM7("Hello ☺") || codec.IsGSM7("Muraho ç") {
+		t.Error("Expected non GSM7 text to be detected")
+	}
+
+	encoded := codec.EncodeGSM7(text)
+	if len(encoded) != len([]rune(text))+3 {
+		t.Errorf("Expected escapes for extended chars, got %d septets", len(encoded))
+	}
+	if encoded[6] != 0x00 {
+		t.Errorf("Expected @ to encode as 0x00, got 0x%02x", encoded[6])
+	}
+	if decoded := codec.DecodeGSM7(encoded); decoded != text {
+		t.Errorf("Expected %q, got %q", text, decoded)
+	}
+
+	if decoded := codec.DecodeGSM7(codec.EncodeGSM7("I ☺ you")); decoded != "I ? you" {
+		t.Errorf("Expected unknown chars to be replaced, got %q", decoded)
+	}
+}
+
+func TestUCS2(t *testing.T) {
+	text := "Muraho ☺ 😀"
+	encoded := codec.EncodeUCS2(text)
+	if len(encoded) != 22 {
+		t.Errorf("Expected 22 bytes, got %d", len(encoded))
+	}
+	if decoded := codec.DecodeUCS2(encoded); decoded != text {
+		t.Errorf("Expected %q, got %q", text, decoded)
+	}
+}
+
+func TestCountSegments(t *testing.T) {
+	tests := []struct {
+		text     string
+		segments int
+	}{
+		{"", 1},
+		{"Hello World", 1},
+		{strings.Repeat("a", 160), 1},
+		{strings.Repeat("a", 161), 2},
+		{strings.Repeat("a", 306), 2},
+		{strings.Repeat("a", 307), 3},
+		{strings.Repeat("{", 80), 1},
+		{strings.Repeat("{", 81), 2},
+		{strings.Repeat("☺", 70), 1},
+		{strings.Repeat("☺", 71), 2},
+		{strings.Repeat("☺", 134), 2},
+		{strings.Repeat("☺", 135), 3},
+		{strings.Repeat("a", 159) + "☺", 3},
+	}
+
+	for _, test := range tests {
+		if segments := codec.CountSegments(test.text); segments != test.segments {
+			t.Errorf("Expected %d segments for %d chars, got %d", test.segments, len([]rune(test.text)), segments)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	segments, err := codec.Split("Hello World", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 || segments[0].Header != nil || string(segments[0].Bytes()) != "Hello World" {
+		t.Errorf("Expected single segment without header, got %+v", segments)
+	}
+
+	// escapes are never split from the char they escape
+	text := strings.Repeat("a", 152) + "€" + strings.Repeat("b", 10)
+	segments, err = codec.Split(text, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || len(segments[0].Payload) != 152 || len(segments[1].Payload) != 12 {
+		t.Fatalf("Unexpected segments: %+v", segments)
+	}
+	if segments[1].Encoding != codec.ENCODING_GSM7 || string(segments[1].Header) != string([]byte{5, 0, 3, 7, 2, 2}) {
+		t.Errorf("Unexpected second segment: %+v", segments[1])
+	}
+
+	// nor are surrogate pairs
+	text = strings.Repeat("☺", 66) + "😀☺☺☺"
+	segments, err = codec.Split(text, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || len(segments[0].Payload) != 132 || codec.DecodeUCS2(segments[1].Payload) != "😀☺☺☺" {
+		t.Errorf("Unexpected segments: %+v", segments)
+	}
+
+	_, err = codec.Split(strings.Repeat("a", 153*256), 1)
+	if err == nil {
+		t.Error("Expected error splitting text needing more than 255 segments")
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	text := strings.Repeat("Hello ☺ ", 40)
+	segments, err := codec.Split(text, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 5 {
+		t.Fatalf("Expected 5 segments, got %d", len(segments))
+	}
+
+	reassembler := codec.NewReassembler(time.Minute)
+
+	// deliver them out of order, with a duplicate
+	var joined []byte
+	complete := false
+	for i, seq := range []int{2, 1, 1, 4, 5, 3} {
+		concat, payload, err := codec.ParseUDH(segments[seq-1].Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if concat.Ref != 42 || concat.Total != 5 || int(concat.Seq) != seq {
+			t.Errorf("Unexpected concat: %+v", concat)
+		}
+
+		joined, complete = reassembler.Add("+250788383383", concat, payload)
+		if complete != (i == 5) {
+			t.Errorf("Expected complete only after last segment, got %t after %d", complete, i+1)
+		}
+	}
+
+	if codec.DecodeUCS2(joined) != text {
+		t.Errorf("Expected %q, got %q", text, codec.DecodeUCS2(joined))
+	}
+	if reassembler.Pending() != 0 {
+		t.Errorf("Expected nothing pending, got %d", reassembler.Pending())
+	}
+
+	// incomplete msgs are dropped after our timeout
+	reassembler = codec.NewReassembler(10 * time.Millisecond)
+	reassembler.Add("+250788383383", &codec.Concat{Ref: 1, Total: 2, Seq: 1}, []byte("a"))
+	if reassembler.Pending() != 1 {
+		t.Errorf("Expected 1 pending, got %d", reassembler.Pending())
+	}
+	time.Sleep(20 * time.Millisecond)
+	if reassembler.Pending() != 0 {
+		t.Errorf("Expected pending msg to be dropped, got %d", reassembler.Pending())
+	}
+}
+
+func TestParseUDH(t *testing.T) {
+	concat, payload, err := codec.ParseUDH([]byte{6, 8, 4, 0x12, 0x34, 3, 2, 'h', 'i'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if concat.Ref != 0x1234 || concat.Total != 3 || concat.Seq != 2 || string(payload) != "hi" {
+		t.Errorf("Unexpected concat: %+v payload: %q", concat, payload)
+	}
+
+	concat, payload, err = codec.ParseUDH([]byte{3, 0x24, 1, 1, 'h', 'i'})
+	if err != nil || concat != nil || string(payload) != "hi" {
+		t.Errorf("Expected other elements to be skipped, got %+v %q %v", concat, payload, err)
+	}
+
+	for _, data := range [][]byte{{}, {9, 0, 3}, {5, 0, 3, 1, 2}, {5, 0, 3, 1, 2, 3}, {5, 0, 3, 1, 0, 0}} {
+		_, _, err = codec.ParseUDH(data)
+		if err == nil {
+			t.Errorf("Expected error parsing %v", data)
+		}
+	}
+}
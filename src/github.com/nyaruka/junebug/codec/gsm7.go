@@ -0,0 +1,87 @@
+package codec
+
+import (
+	"bytes"
+)
+
+// The GSM 03.38 default alphabet, indexed by septet. The escape septet switches the next
+// septet to our extension table.
+var gsm7Basic = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// The GSM 03.38 extension table, each of these takes two septets, the escape and this
+var gsm7Extended = map[byte]rune{
+	0x0A: '\f', 0x14: '^', 0x28: '{', 0x29: '}', 0x2F: '\\',
+	0x3C: '[', 0x3D: '~', 0x3E: ']', 0x40: '|', 0x65: '€'}
+
+const GSM7_ESCAPE = 0x1B
+
+// what we replace chars that aren't in the alphabet with
+const GSM7_REPLACEMENT = '?'
+
+// the septets for every char we can encode
+var gsm7Septets = make(map[rune][]byte)
+
+func init() {
+	for septet, r := range gsm7Basic {
+		if septet != GSM7_ESCAPE {
+			gsm7Septets[r] = []byte{byte(septet)}
+		}
+	}
+	for septet, r := range gsm7Extended {
+		gsm7Septets[r] = []byte{GSM7_ESCAPE, septet}
+	}
+}
+
+// Whether the passed in text can be encoded entirely in the GSM 7 bit alphabet
+func IsGSM7(text string) bool {
+	for _, r := range text {
+		if _, found := gsm7Septets[r]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Encodes the passed in text as GSM 7 bit septets, one septet per byte as SMPP expects. Chars
+// that aren't in the alphabet are replaced with '?'
+func EncodeGSM7(text string) []byte {
+	buf := &bytes.Buffer{}
+	for _, r := range text {
+		buf.Write(encodeGSM7Rune(r))
+	}
+	return buf.Bytes()
+}
+
+func encodeGSM7Rune(r rune) []byte {
+	septets, found := gsm7Septets[r]
+	if !found {
+		return gsm7Septets[GSM7_REPLACEMENT]
+	}
+	return septets
+}
+
+// Decodes the passed in GSM 7 bit septets, one septet per byte
+func DecodeGSM7(septets []byte) string {
+	runes := make([]rune, 0, len(septets))
+	for i := 0; i < len(septets); i++ {
+		septet := septets[i] & 0x7F
+
+		if septet == GSM7_ESCAPE && i+1 < len(septets) {
+			i++
+			next := septets[i] & 0x7F
+
+			// unknown extensions fall back to the basic char, as the spec asks
+			if r, found := gsm7Extended[next]; found {
+				runes = append(runes, r)
+			} else {
+				runes = append(runes, gsm7Basic[next])
+			}
+		} else if septet == GSM7_ESCAPE {
+			runes = append(runes, ' ')
+		} else {
+			runes = append(runes, gsm7Basic[septet])
+		}
+	}
+	return string(runes)
+}
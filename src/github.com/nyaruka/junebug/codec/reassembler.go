@@ -0,0 +1,77 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Reassembler collects the segments of concatenated msgs until all of them have arrived. Msgs
+// which aren't complete within our timeout are dropped, as their missing parts aren't coming.
+//
+// It is safe to use from multiple goroutines.
+type Reassembler struct {
+	mutex   sync.Mutex
+	timeout time.Duration
+	pending map[string]*pendingMsg
+}
+
+// the segments we've received so far of a single concatenated msg
+type pendingMsg struct {
+	payloads [][]byte
+	received int
+	started  time.Time
+}
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{timeout: timeout, pending: make(map[string]*pendingMsg)}
+}
+
+// Adds the payload of a segment sent by the passed in source. Once all the segments of its
+// msg have arrived, returns their payloads joined in order and true.
+func (r *Reassembler) Add(source string, concat *Concat, payload []byte) ([]byte, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.expire(now)
+
+	key := fmt.Sprintf("%s:%d:%d", source, concat.Ref, concat.Total)
+	msg, found := r.pending[key]
+	if !found {
+		msg = &pendingMsg{payloads: make([][]byte, concat.Total), started: now}
+		r.pending[key] = msg
+	}
+
+	// SMSCs can deliver the same segment more than once, only count it the first time
+	if msg.payloads[concat.Seq-1] == nil {
+		msg.received++
+	}
+	msg.payloads[concat.Seq-1] = append([]byte{}, payload...)
+
+	if msg.received < len(msg.payloads) {
+		return nil, false
+	}
+
+	delete(r.pending, key)
+	return bytes.Join(msg.payloads, nil), true
+}
+
+// Returns how many msgs we are waiting on more segments for
+func (r *Reassembler) Pending() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.expire(time.Now())
+	return len(r.pending)
+}
+
+// drops any msgs that have been pending longer than our timeout, must be called with our lock held
+func (r *Reassembler) expire(now time.Time) {
+	for key, msg := range r.pending {
+		if now.Sub(msg.started) > r.timeout {
+			delete(r.pending, key)
+		}
+	}
+}
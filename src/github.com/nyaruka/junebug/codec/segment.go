@@ -0,0 +1,111 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Encoding is how the text of a msg is encoded for SMS transports
+type Encoding string
+
+const ENCODING_GSM7 = Encoding("gsm7")
+const ENCODING_UCS2 = Encoding("ucs2")
+
+// How many bytes of encoded text fit in a single segment, and in each segment of a concatenated
+// msg once our UDH takes its share. For GSM7 that's 160 and 153 chars, for UCS2 70 and 67.
+const GSM7_SINGLE_SEGMENT = 160
+const GSM7_MULTI_SEGMENT = 153
+const UCS2_SINGLE_SEGMENT = 140
+const UCS2_MULTI_SEGMENT = 134
+
+// our UDH only has a byte for the segment count
+const MAX_SEGMENTS = 255
+
+// A single segment of a msg, encoded and ready to be sent
+type Segment struct {
+	Encoding Encoding
+	Header   []byte
+	Payload  []byte
+}
+
+// Returns the UDH followed by the payload of this segment
+func (s *Segment) Bytes() []byte {
+	return append(append(make([]byte, 0, len(s.Header)+len(s.Payload)), s.Header...), s.Payload...)
+}
+
+// Returns GSM7 if the passed in text can be sent in the GSM 7 bit alphabet, UCS2 otherwise
+func DetectEncoding(text string) Encoding {
+	if IsGSM7(text) {
+		return ENCODING_GSM7
+	}
+	return ENCODING_UCS2
+}
+
+// Returns how many SMS segments the passed in text will be sent as
+func CountSegments(text string) int {
+	return len(chunk(text, DetectEncoding(text)))
+}
+
+// Splits the passed in text into the segments it should be sent as. Msgs that need more than one
+// segment get a concatenation UDH using the passed in reference, which should differ between
+// msgs sent to the same address around the same time.
+func Split(text string, ref byte) ([]*Segment, error) {
+	encoding := DetectEncoding(text)
+	chunks := chunk(text, encoding)
+
+	if len(chunks) > MAX_SEGMENTS {
+		return nil, errors.New(fmt.Sprintf("Text needs %d segments, more than the maximum of %d", len(chunks), MAX_SEGMENTS))
+	}
+
+	segments := make([]*Segment, len(chunks))
+	for i, payload := range chunks {
+		segments[i] = &Segment{Encoding: encoding, Payload: payload}
+		if len(chunks) > 1 {
+			segments[i].Header = ConcatHeader(ref, byte(len(chunks)), byte(i+1))
+		}
+	}
+	return segments, nil
+}
+
+// Encodes the passed in text, splitting it into chunks that fit in our segments. We never
+// split a GSM7 escape or a UTF-16 surrogate pair across chunks.
+func chunk(text string, encoding Encoding) [][]byte {
+	single, multi := GSM7_SINGLE_SEGMENT, GSM7_MULTI_SEGMENT
+	if encoding == ENCODING_UCS2 {
+		single, multi = UCS2_SINGLE_SEGMENT, UCS2_MULTI_SEGMENT
+	}
+
+	// encode each char on its own, so we know where we can split
+	chars := make([][]byte, 0, len(text))
+	total := 0
+	for _, r := range text {
+		var encoded []byte
+		if encoding == ENCODING_GSM7 {
+			encoded = encodeGSM7Rune(r)
+		} else {
+			encoded = EncodeUCS2(string(r))
+		}
+		chars = append(chars, encoded)
+		total += len(encoded)
+	}
+
+	// everything fits in a single segment, even nothing at all
+	if total <= single {
+		payload := make([]byte, 0, total)
+		for _, encoded := range chars {
+			payload = append(payload, encoded...)
+		}
+		return [][]byte{payload}
+	}
+
+	chunks := make([][]byte, 0, total/multi+1)
+	current := make([]byte, 0, multi)
+	for _, encoded := range chars {
+		if len(current)+len(encoded) > multi {
+			chunks = append(chunks, current)
+			current = make([]byte, 0, multi)
+		}
+		current = append(current, encoded...)
+	}
+	return append(chunks, current)
+}
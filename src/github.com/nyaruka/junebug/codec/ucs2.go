@@ -0,0 +1,26 @@
+package codec
+
+import (
+	"encoding/binary"
+	"unicode/utf16"
+)
+
+// Encodes the passed in text as big endian UTF-16, which is what handsets expect when told
+// a msg is UCS-2. Chars outside the basic plane take two code units.
+func EncodeUCS2(text string) []byte {
+	units := utf16.Encode([]rune(text))
+	buf := make([]byte, len(units)*2)
+	for i, unit := range units {
+		binary.BigEndian.PutUint16(buf[i*2:], unit)
+	}
+	return buf
+}
+
+// Decodes the passed in big endian UTF-16, any trailing odd byte is ignored
+func DecodeUCS2(data []byte) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return string(utf16.Decode(units))
+}
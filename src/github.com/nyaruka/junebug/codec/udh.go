@@ -0,0 +1,64 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The information elements we care about in a user data header
+const IEI_CONCAT_8BIT = 0x00
+const IEI_CONCAT_16BIT = 0x08
+
+// Concat is the concatenation information element of a UDH, it tells us which part of
+// which concatenated msg a segment is
+type Concat struct {
+	Ref   uint16
+	Total byte
+	Seq   byte
+}
+
+// Builds the UDH for the seq'th of total segments of a concatenated msg, seq starts at 1
+func ConcatHeader(ref byte, total byte, seq byte) []byte {
+	return []byte{0x05, IEI_CONCAT_8BIT, 0x03, ref, total, seq}
+}
+
+// Parses the UDH at the start of the passed in user data, returning its concatenation element,
+// or nil if it has none, and the payload which follows the header
+func ParseUDH(data []byte) (*Concat, []byte, error) {
+	if len(data) == 0 || int(data[0])+1 > len(data) {
+		return nil, nil, errors.New("UDH longer than user data")
+	}
+
+	header := data[1 : data[0]+1]
+	payload := data[data[0]+1:]
+	var concat *Concat
+
+	for len(header) > 0 {
+		if len(header) < 2 || int(header[1])+2 > len(header) {
+			return nil, nil, errors.New("Truncated UDH information element")
+		}
+
+		iei, ie := header[0], header[2:header[1]+2]
+		header = header[header[1]+2:]
+
+		switch iei {
+		case IEI_CONCAT_8BIT:
+			if len(ie) != 3 {
+				return nil, nil, errors.New(fmt.Sprintf("Invalid concatenation element length: %d", len(ie)))
+			}
+			concat = &Concat{Ref: uint16(ie[0]), Total: ie[1], Seq: ie[2]}
+
+		case IEI_CONCAT_16BIT:
+			if len(ie) != 4 {
+				return nil, nil, errors.New(fmt.Sprintf("Invalid concatenation element length: %d", len(ie)))
+			}
+			concat = &Concat{Ref: uint16(ie[0])<<8 | uint16(ie[1]), Total: ie[2], Seq: ie[3]}
+		}
+	}
+
+	if concat != nil && (concat.Total == 0 || concat.Seq == 0 || concat.Seq > concat.Total) {
+		return nil, nil, errors.New(fmt.Sprintf("Invalid concatenation, part %d of %d", concat.Seq, concat.Total))
+	}
+
+	return concat, payload, nil
+}
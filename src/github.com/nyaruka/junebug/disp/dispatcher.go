@@ -3,6 +3,7 @@ package disp
 import (
 	"github.com/nyaruka/junebug/store"
 	"sync"
+	"time"
 )
 
 // The dispatcher essentially acts a router between available senders for a connection
@@ -18,11 +19,27 @@ import (
 type MsgSender interface {
 	Send(uint64)
 	Start()
+
+	// Returns the id of this sender, unique within its connection
+	Id() int
+
+	// Stops just this sender, it must not block
+	Stop()
 }
 
 type MsgReceiver interface {
 	Receive(uint64)
 	Start()
+
+	// Stops just this receiver, it must not block
+	Stop()
+}
+
+// A listener takes in incoming msgs for a whole connection, for transports whose incoming
+// msgs don't arrive through their senders. There is only ever one per connection, it runs
+// until the dispatcher is stopped.
+type MsgListener interface {
+	Start()
 }
 
 type Dispatcher struct {
@@ -32,12 +49,55 @@ type Dispatcher struct {
 	Receivers chan MsgReceiver
 	Done chan int
 
+	// when ordering by address, msgs that were in flight or waiting to be retried when we started,
+	// and those of them that were finished without coming back through Outgoing
+	Busy     chan uint64
+	Finished chan uint64
+
 	available_outgoing store.PriorityQueue
 	available_senders  []MsgSender
 
 	available_incoming  store.PriorityQueue
 	available_receivers []MsgReceiver
 
+	// when throttled, how often our bucket is refilled, how many tokens it holds and has left
+	interval time.Duration
+	burst    int
+	tokens   int
+
+	// guards our stats and whether we are paused, which are read from other goroutines
+	statsMutex sync.Mutex
+	sent       rateMeter
+	throttled  int
+	paused     bool
+	heldUntil  time.Time
+
+	// nudges our loop when we are resumed or held
+	wake chan bool
+
+	// fires when our hold ends, nil while we aren't waiting on one
+	holdTimer <-chan time.Time
+
+	// how our pools of workers are doing, guarded by our stats mutex
+	senderPool   poolStats
+	receiverPool poolStats
+
+	// when ordering by address, our queue of outgoing msgs and what each sender is sending
+	ordered *orderedQueue
+	sending map[int]uint64
+
+	// when ordering by address, how we look up msgs outside our loop, and our lookups of incoming
+	// msgs and of those our senders are done with
+	lookup    MsgLookup
+	addressed chan orderedMsg
+	resolved  chan orderedMsg
+
+	// requests to retire workers, and how many we still have to retire as they finish
+	retireSenders     chan bool
+	retireReceivers   chan bool
+	retiringSenders   int
+	retiringReceivers int
+
 	WaitGroup   *sync.WaitGroup
 }
 
@@ -48,6 +108,12 @@ func CreateDispatcher(nsenders uint, nreceivers uint) *Dispatcher {
 		Incoming:  make(chan uint64, nsenders),
 		Receivers: make(chan MsgReceiver, nreceivers),
 		Done:      make(chan int),
+		Busy:      make(chan uint64),
+		Finished:  make(chan uint64),
+		wake:      make(chan bool, 1),
+
+		retireSenders:   make(chan bool, nsenders),
+		retireReceivers: make(chan bool, nreceivers),
 
 		available_senders:   make([]MsgSender, 0, nsenders),
 		available_receivers: make([]MsgReceiver, 0, nreceivers),
@@ -65,32 +131,173 @@ func (d *Dispatcher) Stop() {
 	d.WaitGroup.Wait()
 }
 
+// Like Stop, but gives up waiting on our goroutines after the passed in timeout, returning
+// false if they didn't all complete in time
+func (d *Dispatcher) StopWithin(timeout time.Duration) bool {
+	close(d.Done)
+
+	stopped := make(chan bool)
+	go func() {
+		d.WaitGroup.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stops us handing outgoing msgs to senders until we are resumed, msgs sent to us while paused
+// are queued. This can be called before we are started.
+func (d *Dispatcher) Pause() {
+	d.setPaused(true)
+}
+
+// Resumes handing outgoing msgs to senders
+func (d *Dispatcher) Resume() {
+	d.setPaused(false)
+}
+
+func (d *Dispatcher) IsPaused() bool {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	return d.paused
+}
+
+func (d *Dispatcher) setPaused(paused bool) {
+	d.statsMutex.Lock()
+	d.paused = paused
+	d.statsMutex.Unlock()
+
+	d.nudge()
+}
+
+// Stops us handing outgoing msgs to senders until the passed in time, such as when our transport
+// has rate limited us. Holding again only ever extends our hold, it is never persisted.
+func (d *Dispatcher) HoldUntil(until time.Time) {
+	d.statsMutex.Lock()
+	if until.After(d.heldUntil) {
+		d.heldUntil = until
+	}
+	d.statsMutex.Unlock()
+
+	d.nudge()
+}
+
+// Returns when our current hold ends, zero if we've never been held
+func (d *Dispatcher) HeldUntil() time.Time {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	return d.heldUntil
+}
+
+// Returns whether we can hand msgs to senders at the passed in time, that is we aren't paused or held
+func (d *Dispatcher) canSend(now time.Time) bool {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	return !d.paused && !now.Before(d.heldUntil)
+}
+
+// wakes our loop so it sends anything that queued up, unless it is already due to wake
+func (d *Dispatcher) nudge() {
+	select {
+	case d.wake <- true:
+	default:
+	}
+}
+
 // Starts our goroutine that will accept jobs and available senders
 // and match them as they come in
 func (d *Dispatcher) Start() {
+	d.WaitGroup.Add(1)
 	go func() {
-		d.WaitGroup.Add(1)
 		defer d.WaitGroup.Done()
 
+		// when ordering, our resolver takes in outgoing msgs and passes them on once looked up
+		outgoing, busy := d.Outgoing, d.Busy
+		if d.ordered != nil {
+			outgoing, busy = nil, nil
+			d.startResolver()
+		}
+
+		// when throttled, our bucket is refilled each time this fires
+		var refill <-chan time.Time
+		if ticker := d.startRefill(); ticker != nil {
+			defer ticker.Stop()
+			refill = ticker.C
+		}
+
 		for {
 			select {
-			case outgoing := <-d.Outgoing:
-			    d.available_outgoing.Insert(outgoing)
+			case id := <-outgoing:
+				d.available_outgoing.Insert(id)
+			case msg := <-d.addressed:
+				if msg.held {
+					d.ordered.Hold(msg.id, msg.address, msg.state)
+				} else {
+					d.ordered.Insert(msg.id, msg.address)
+				}
+			case msg := <-d.resolved:
+				d.ordered.Finished(msg.id, msg.state)
+			case <-busy:
+				// we only hold addresses when ordering
+			case finished := <-d.Finished:
+				if d.ordered != nil {
+					d.ordered.Done(finished)
+				}
 			case sender := <-d.Senders:
-				d.available_senders = append(d.available_senders, sender)
+				d.senderReady(sender)
+				if d.retiringSenders > 0 {
+					d.retiringSenders--
+					sender.Stop()
+				} else {
+					d.available_senders = append(d.available_senders, sender)
+				}
 			case incoming := <-d.Incoming:
 			    d.available_incoming.Insert(incoming)
 			case receiver := <-d.Receivers:
-				d.available_receivers = append(d.available_receivers, receiver)
+				if d.retiringReceivers > 0 {
+					d.retiringReceivers--
+					receiver.Stop()
+				} else {
+					d.available_receivers = append(d.available_receivers, receiver)
+				}
+			case <-d.retireSenders:
+				if idle := len(d.available_senders); idle > 0 {
+					d.available_senders[idle-1].Stop()
+					d.available_senders = d.available_senders[:idle-1]
+				} else {
+					d.retiringSenders++
+				}
+			case <-d.retireReceivers:
+				if idle := len(d.available_receivers); idle > 0 {
+					d.available_receivers[idle-1].Stop()
+					d.available_receivers = d.available_receivers[:idle-1]
+				} else {
+					d.retiringReceivers++
+				}
+			case <-d.wake:
+			case <-d.holdTimer:
+				d.holdTimer = nil
+			case <-refill:
+				d.refill()
 			case <-d.Done:
 			    return
 			}
 
-			// while we have possible pairings of outgoing messages
-			for len(d.available_senders) > 0 && d.available_outgoing.Len() > 0 {
-				msg := d.available_outgoing.Pop()
+			// while we have possible pairings of outgoing messages, and our throttle allows it
+			sent := 0
+			for d.canSend(time.Now()) && len(d.available_senders) > 0 && d.hasOutgoing() && d.takeToken() {
+				msg := d.popOutgoing()
 				sender := d.available_senders[0]
+				if d.sending != nil {
+					d.sending[sender.Id()] = msg
+				}
 				sender.Send(msg)
+				sent++
 
 				// pop off the elements we just sent
 				d.available_senders = d.available_senders[1:]
@@ -105,6 +312,50 @@ func (d *Dispatcher) Start() {
 				// pop off the elements we just sent
 				d.available_receivers = d.available_receivers[1:]
 			}
+
+			d.updateStats(sent)
+
+			// if we're held, make sure we wake once our hold ends
+			if held := d.HeldUntil(); d.holdTimer == nil && time.Now().Before(held) {
+				d.holdTimer = time.After(time.Until(held))
+			}
 		}
 	}()
 }
+
+// Returns whether we have an outgoing msg that can be sent
+func (d *Dispatcher) hasOutgoing() bool {
+	if d.ordered != nil {
+		return d.ordered.Ready()
+	}
+	return d.available_outgoing.Len() > 0
+}
+
+// Returns the next outgoing msg to send, callers must check we have one first
+func (d *Dispatcher) popOutgoing() uint64 {
+	if d.ordered != nil {
+		return d.ordered.Pop()
+	}
+	return d.available_outgoing.Pop()
+}
+
+// Returns how many outgoing msgs we have queued
+func (d *Dispatcher) outgoingLen() int {
+	if d.ordered != nil {
+		return d.ordered.Len()
+	}
+	return d.available_outgoing.Len()
+}
+
+// Called as a sender becomes ready, which means it is done with any msg we gave it
+func (d *Dispatcher) senderReady(sender MsgSender) {
+	if d.sending == nil {
+		return
+	}
+
+	id, exists := d.sending[sender.Id()]
+	if exists {
+		delete(d.sending, sender.Id())
+		d.resolveFinished(id)
+	}
+}
@@ -0,0 +1,435 @@
+package disp_test
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/junebug/disp"
+	"github.com/nyaruka/junebug/store"
+)
+
+// a sender that marks itself ready again as soon as it is given a msg, unless it is manual, in
+// which case it waits for us to finish each msg
+type testSender struct {
+	id         int
+	dispatcher *disp.Dispatcher
+	sent       chan uint64
+	stopped    chan bool
+	manual     bool
+	current    uint64
+}
+
+func (s *testSender) Send(id uint64) {
+	s.current = id
+	s.sent <- id
+	if !s.manual {
+		go s.finish()
+	}
+}
+
+func (s *testSender) Start() {
+	s.dispatcher.Senders <- s
+}
+
+func (s *testSender) Id() int {
+	return s.id
+}
+
+func (s *testSender) Stop() {
+	if s.stopped != nil {
+		s.stopped <- true
+	}
+}
+
+func (s *testSender) finish() {
+	s.dispatcher.Senders <- s
+}
+
+func TestThrottle(t *testing.T) {
+	dispatcher := disp.CreateDispatcher(2, 1)
+	dispatcher.Throttle(store.ThrottleConfig{Rate: 20, Burst: 1})
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	sender := &testSender{dispatcher: dispatcher, sent: make(chan uint64, 10)}
+	sender.Start()
+
+	start := time.Now()
+	for id := uint64(1); id <= 6; id++ {
+		dispatcher.Outgoing <- id
+	}
+
+	// give our dispatcher a moment to see that our msgs are waiting on its throttle
+	time.Sleep(20 * time.Millisecond)
+	if dispatcher.Throttled() == 0 {
+		t.Error("Expected msgs to be waiting on our throttle")
+	}
+
+	for i := 0; i < 6; i++ {
+		<-sender.sent
+	}
+
+	// one token every 50ms, so six msgs take at least 300ms
+	elapsed := time.Since(start)
+	if elapsed < 250*time.Millisecond {
+		t.Errorf("Expected throttled sends to take at least 250ms, took %s", elapsed)
+	}
+	if dispatcher.SendRate() != 0.6 {
+		t.Errorf("Expected send rate of 0.6, got %f", dispatcher.SendRate())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if dispatcher.Throttled() != 0 {
+		t.Errorf("Expected nothing throttled, got %d", dispatcher.Throttled())
+	}
+}
+
+func TestThrottleStopped(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// stopping a throttled dispatcher leaves nothing behind refilling its bucket
+	for i := 0; i < 20; i++ {
+		dispatcher := disp.CreateDispatcher(1, 1)
+		dispatcher.Throttle(store.ThrottleConfig{Rate: 100, Burst: 1})
+		dispatcher.Start()
+		dispatcher.Stop()
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected no goroutines left after stopping, went from %d to %d", before, after)
+	}
+}
+
+func TestUnthrottled(t *testing.T) {
+	dispatcher := disp.CreateDispatcher(1, 1)
+	dispatcher.Throttle(store.ThrottleConfig{})
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	sender := &testSender{dispatcher: dispatcher, sent: make(chan uint64, 100)}
+	sender.Start()
+
+	start := time.Now()
+	for id := uint64(1); id <= 100; id++ {
+		dispatcher.Outgoing <- id
+	}
+	for i := 0; i < 100; i++ {
+		<-sender.sent
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected unthrottled sends to be quick, took %s", time.Since(start))
+	}
+}
+
+func TestPause(t *testing.T) {
+	dispatcher := disp.CreateDispatcher(1, 1)
+	dispatcher.Pause()
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	sender := &testSender{dispatcher: dispatcher, sent: make(chan uint64, 10)}
+	sender.Start()
+
+	for id := uint64(1); id <= 3; id++ {
+		dispatcher.Outgoing <- id
+	}
+
+	// nothing should be sent while we are paused
+	select {
+	case id := <-sender.sent:
+		t.Errorf("Expected no msgs sent while paused, got %d", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// once resumed, everything that queued up gets sent
+	dispatcher.Resume()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-sender.sent:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected queued msgs to be sent after resuming, only got %d", i)
+		}
+	}
+}
+
+func TestRetireSender(t *testing.T) {
+	dispatcher := disp.CreateDispatcher(2, 1)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	stopped := make(chan bool, 2)
+	first := &testSender{dispatcher: dispatcher, sent: make(chan uint64, 10), stopped: stopped}
+	second := &testSender{id: 1, dispatcher: dispatcher, sent: make(chan uint64, 10), stopped: stopped}
+	first.Start()
+	second.Start()
+
+	dispatcher.RetireSender()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected idle sender to be stopped")
+	}
+
+	// our remaining sender does all the sending
+	for id := uint64(1); id <= 3; id++ {
+		dispatcher.Outgoing <- id
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-first.sent:
+		case <-second.sent:
+		case <-time.After(time.Second):
+			t.Fatal("Expected msgs to be sent by our remaining sender")
+		}
+	}
+	if len(first.sent) > 0 && len(second.sent) > 0 {
+		t.Error("Expected only one sender to be sending")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	sample := dispatcher.SampleSenders()
+	if sample.Idle != 1 || sample.Queued != 0 {
+		t.Errorf("Expected one idle sender and nothing queued, got %+v", sample)
+	}
+}
+
+func TestScaleTarget(t *testing.T) {
+	bounds := store.ScaleBounds{Min: 2, Max: 10}
+
+	tcs := []struct {
+		sample   disp.PoolSample
+		workers  int
+		expected int
+	}{
+		// a backlog that would take longer than an interval to clear adds a worker
+		{disp.PoolSample{Queued: 100, Handled: 20, Latency: time.Second}, 4, 5},
+		// one we'll clear within an interval doesn't
+		{disp.PoolSample{Queued: 10, Handled: 20, Latency: time.Second}, 4, 4},
+		// nor does one where we have idle workers, they are waiting on something else
+		{disp.PoolSample{Queued: 100, Idle: 2, Handled: 20, Latency: time.Second}, 4, 4},
+		// errors halve our workers
+		{disp.PoolSample{Queued: 100, Handled: 20, Errored: 5, Latency: time.Second}, 8, 4},
+		// idle workers with nothing to do are removed one at a time
+		{disp.PoolSample{Idle: 3, Handled: 1}, 4, 3},
+		// all within our bounds
+		{disp.PoolSample{Queued: 100, Handled: 20, Latency: time.Second}, 10, 10},
+		{disp.PoolSample{Handled: 20, Errored: 20}, 3, 2},
+		{disp.PoolSample{Idle: 2}, 2, 2},
+	}
+
+	for _, tc := range tcs {
+		target := tc.sample.Target(tc.workers, bounds)
+		if target != tc.expected {
+			t.Errorf("Expected %d workers for %+v with %d workers, got %d", tc.expected, tc.sample, tc.workers, target)
+		}
+	}
+}
+
+func TestOrderByAddress(t *testing.T) {
+	addresses := map[uint64]string{1: "+1", 2: "+1", 3: "+2", 4: "+1", 5: "+2"}
+	states := map[uint64]int{}
+	var mutex sync.Mutex
+
+	dispatcher := disp.CreateDispatcher(3, 1)
+	dispatcher.OrderByAddress(func(id uint64) (string, int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return addresses[id], states[id], nil
+	})
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	sent := make(chan uint64, 10)
+	senders := make([]*testSender, 3)
+	for i := range senders {
+		senders[i] = &testSender{id: i, dispatcher: dispatcher, sent: sent, manual: true}
+		senders[i].Start()
+	}
+
+	for id := uint64(1); id <= 5; id++ {
+		dispatcher.Outgoing <- id
+	}
+
+	// we have three free senders, but only two addresses, so only the first msg to each is sent
+	assertSent(t, sent, 1, 3)
+	assertNothingSent(t, sent)
+
+	// finishing our first msg to +1 frees it up for the next, which errors and waits on a retry
+	finish(senders, 1)
+	assertSent(t, sent, 2)
+
+	mutex.Lock()
+	states[2] = disp.MSG_RETRYING
+	mutex.Unlock()
+	finish(senders, 2)
+	assertNothingSent(t, sent)
+
+	// +2 carries on regardless
+	finish(senders, 3)
+	assertSent(t, sent, 5)
+
+	// once our retry comes back it goes out before the msg behind it
+	mutex.Lock()
+	states[2] = disp.MSG_PENDING
+	mutex.Unlock()
+	dispatcher.Outgoing <- 2
+	assertSent(t, sent, 2)
+
+	finish(senders, 2)
+	assertSent(t, sent, 4)
+}
+
+func TestOrderByAddressBusy(t *testing.T) {
+	addresses := map[uint64]string{1: "+1", 2: "+2", 3: "+1", 4: "+2", 5: "+3", 6: "+3", 7: "+3"}
+	states := map[uint64]int{1: disp.MSG_RETRYING, 6: disp.MSG_FINISHED}
+	var mutex sync.Mutex
+
+	dispatcher := disp.CreateDispatcher(3, 1)
+	dispatcher.OrderByAddress(func(id uint64) (string, int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return addresses[id], states[id], nil
+	})
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	sent := make(chan uint64, 10)
+	senders := make([]*testSender, 3)
+	for i := range senders {
+		senders[i] = &testSender{id: i, dispatcher: dispatcher, sent: sent, manual: true}
+		senders[i].Start()
+	}
+
+	// we restarted with 1 waiting to be retried and 2 still in flight from before, 6 was in flight
+	// too but was finished before we got to it, so doesn't hold up 7
+	dispatcher.Busy <- 1
+	dispatcher.Busy <- 2
+	dispatcher.Busy <- 6
+	for _, id := range []uint64{3, 4, 5, 7} {
+		dispatcher.Outgoing <- id
+	}
+
+	// only the address nobody was busy with is sent to
+	assertSent(t, sent, 5)
+	finish(senders, 5)
+	assertSent(t, sent, 7)
+	assertNothingSent(t, sent)
+
+	// our retry comes back and goes out before the msg behind it
+	mutex.Lock()
+	states[1] = disp.MSG_PENDING
+	mutex.Unlock()
+	dispatcher.Outgoing <- 1
+	assertSent(t, sent, 1)
+	finish(senders, 1)
+	assertSent(t, sent, 3)
+
+	// our msg in flight was failed without coming back, which frees its address
+	mutex.Lock()
+	states[2] = disp.MSG_FINISHED
+	mutex.Unlock()
+	dispatcher.Finished <- 2
+	assertSent(t, sent, 4)
+}
+
+func TestOrderByAddressSlowLookup(t *testing.T) {
+	addresses := map[uint64]string{1: "+1", 2: "+2", 3: "+2", 4: "+3"}
+	slow := make(chan bool)
+
+	dispatcher := disp.CreateDispatcher(2, 1)
+	dispatcher.OrderByAddress(func(id uint64) (string, int, error) {
+		if id == 4 {
+			<-slow
+		}
+		return addresses[id], disp.MSG_PENDING, nil
+	})
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	sent := make(chan uint64, 10)
+	senders := make([]*testSender, 2)
+	for i := range senders {
+		senders[i] = &testSender{id: i, dispatcher: dispatcher, sent: sent, manual: true}
+		senders[i].Start()
+	}
+
+	for id := uint64(1); id <= 3; id++ {
+		dispatcher.Outgoing <- id
+	}
+	assertSent(t, sent, 1, 2)
+
+	// while we wait on looking up a new msg, those we already have keep being sent
+	go func() { dispatcher.Outgoing <- 4 }()
+	finish(senders, 2)
+	assertSent(t, sent, 3)
+
+	finish(senders, 1)
+	close(slow)
+	assertSent(t, sent, 4)
+}
+
+// finishes the msg with the passed in id on whichever sender has it
+func finish(senders []*testSender, id uint64) {
+	for _, sender := range senders {
+		if sender.current == id {
+			sender.current = 0
+			sender.finish()
+			return
+		}
+	}
+}
+
+func assertSent(t *testing.T, sent chan uint64, expected ...uint64) {
+	got := make(map[uint64]bool)
+	for range expected {
+		select {
+		case id := <-sent:
+			got[id] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %v to be sent, only got %v", expected, got)
+		}
+	}
+	for _, id := range expected {
+		if !got[id] {
+			t.Fatalf("Expected %v to be sent, got %v", expected, got)
+		}
+	}
+}
+
+func assertNothingSent(t *testing.T, sent chan uint64) {
+	select {
+	case id := <-sent:
+		t.Fatalf("Expected nothing to be sent, got %d", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHoldUntil(t *testing.T) {
+	dispatcher := disp.CreateDispatcher(1, 1)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	sender := &testSender{dispatcher: dispatcher, sent: make(chan uint64, 10)}
+	sender.Start()
+
+	held := time.Now().Add(100 * time.Millisecond)
+	dispatcher.HoldUntil(held)
+
+	// holding again for less doesn't shorten our hold
+	dispatcher.HoldUntil(time.Now())
+	if !dispatcher.HeldUntil().Equal(held) {
+		t.Errorf("Expected to be held until %s, got %s", held, dispatcher.HeldUntil())
+	}
+
+	dispatcher.Outgoing <- 1
+	assertNothingSent(t, sender.sent)
+
+	// once our hold ends we send without needing to be woken
+	assertSent(t, sender.sent, 1)
+	if time.Now().Before(held) {
+		t.Error("Expected nothing to be sent until our hold ended")
+	}
+}
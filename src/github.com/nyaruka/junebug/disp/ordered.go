@@ -0,0 +1,276 @@
+package disp
+
+import (
+	"fmt"
+	"github.com/nyaruka/junebug/store"
+)
+
+// Where a msg we are ordering is at, as far as its address is concerned
+const (
+	// queued or in flight
+	MSG_PENDING = iota
+
+	// errored and waiting to be retried
+	MSG_RETRYING
+
+	// sent, failed or otherwise done with
+	MSG_FINISHED
+)
+
+// Looks up the address of the msg with the passed in id, and where it is at
+type MsgLookup func(id uint64) (address string, state int, err error)
+
+// Makes this dispatcher send at most one msg to each address at a time, in id order, must be
+// called before the dispatcher is started. Msgs to different addresses are still sent in parallel.
+func (d *Dispatcher) OrderByAddress(lookup MsgLookup) {
+	d.ordered = &orderedQueue{
+		addresses: make(map[uint64]string),
+		waiting:   make(map[string]*store.PriorityQueue),
+		heads:     make(map[string]uint64),
+		busy:      make(map[string]uint64),
+		finishing: make(map[uint64]bool),
+	}
+	d.lookup = lookup
+	d.sending = make(map[int]uint64)
+	d.addressed = make(chan orderedMsg)
+	d.resolved = make(chan orderedMsg)
+}
+
+// a msg on its way in to our ordered queue, along with what we looked up about it
+type orderedMsg struct {
+	id      uint64
+	address string
+	state   int
+
+	// whether it was in flight or waiting to be retried when we started, rather than queued
+	held bool
+}
+
+// Starts the goroutine that looks up the msgs coming in to our ordered queue, passing them on to
+// our loop with their address in the order they arrived, so our loop never waits on our store
+func (d *Dispatcher) startResolver() {
+	d.WaitGroup.Add(1)
+	go func() {
+		defer d.WaitGroup.Done()
+
+		for {
+			var msg orderedMsg
+			select {
+			case msg.id = <-d.Outgoing:
+			case msg.id = <-d.Busy:
+				msg.held = true
+			case <-d.Done:
+				return
+			}
+
+			// msgs we can't look up aren't ordered at all
+			var err error
+			msg.address, msg.state, err = d.lookup(msg.id)
+			if err != nil {
+				msg.address = fmt.Sprintf("unknown:%d", msg.id)
+				msg.state = MSG_FINISHED
+			}
+
+			select {
+			case d.addressed <- msg:
+			case <-d.Done:
+				return
+			}
+		}
+	}()
+}
+
+// Looks up whether the passed in msg a sender is done with is waiting to be retried, passing the
+// answer back to our loop. Its address stays busy until then.
+func (d *Dispatcher) resolveFinished(id uint64) {
+	d.ordered.Finishing(id)
+
+	d.WaitGroup.Add(1)
+	go func() {
+		defer d.WaitGroup.Done()
+
+		_, state, err := d.lookup(id)
+		if err != nil {
+			state = MSG_FINISHED
+		}
+
+		select {
+		case d.resolved <- orderedMsg{id: id, state: state}:
+		case <-d.Done:
+		}
+	}()
+}
+
+// orderedQueue queues outgoing msgs by address. Each address has at most one msg ready to send,
+// its lowest id, and none while it has a msg in flight, or one that errored and is waiting to be
+// retried. Our ready queue holds the msgs that can be sent, so they still go out in id order.
+type orderedQueue struct {
+	// the address of every msg we have queued, in flight or waiting to be retried
+	addresses map[uint64]string
+
+	// the msgs queued behind the head of each address
+	waiting map[string]*store.PriorityQueue
+
+	// the msg ready to send to each address that has one
+	heads map[string]uint64
+
+	// the msg in flight to each address, or waiting to be retried
+	busy map[string]uint64
+
+	// the msgs our senders are done with, that we are looking up whether they are being retried
+	finishing map[uint64]bool
+
+	// the heads of our addresses, along with stale entries for heads that were since replaced
+	ready store.PriorityQueue
+
+	queued int
+}
+
+// Queues the passed in msg to the passed in address
+func (q *orderedQueue) Insert(id uint64, address string) {
+	existing, known := q.addresses[id]
+	if known {
+		address = existing
+	} else {
+		q.addresses[id] = address
+	}
+
+	busy, isBusy := q.busy[address]
+
+	// a msg coming back from being retried takes back its place at the front of its address, even
+	// if we haven't heard it was being retried yet
+	if isBusy && busy == id {
+		delete(q.busy, address)
+		delete(q.finishing, id)
+		q.setHead(address, id)
+		q.queued++
+		return
+	}
+
+	// otherwise we don't queue msgs we already know about
+	if known {
+		return
+	}
+	q.queued++
+
+	head, hasHead := q.heads[address]
+	if isBusy || (hasHead && head < id) {
+		q.wait(address, id)
+	} else {
+		if hasHead {
+			q.wait(address, head)
+		}
+		q.setHead(address, id)
+	}
+}
+
+// Marks the passed in address busy with the passed in msg, for msgs that were already in flight or
+// waiting to be retried when we started. Newer msgs to its address wait until it comes back
+// through Insert or is Done. Only the lowest id we are given for an address holds it, the others
+// are queued behind it like any new msg if they come back. Msgs finished by the time we get
+// them, which won't be Done again, are ignored.
+func (q *orderedQueue) Hold(id uint64, address string, state int) {
+	if _, known := q.addresses[id]; known || state == MSG_FINISHED {
+		return
+	}
+
+	busy, isBusy := q.busy[address]
+	if isBusy && busy < id {
+		return
+	}
+	if isBusy {
+		delete(q.addresses, busy)
+	}
+
+	q.addresses[id] = address
+	q.busy[address] = id
+
+	// a newer msg that was ready to send to this address now waits behind us
+	if head, hasHead := q.heads[address]; hasHead {
+		delete(q.heads, address)
+		q.wait(address, head)
+	}
+}
+
+// Returns whether we have a msg ready to send
+func (q *orderedQueue) Ready() bool {
+	for q.ready.Len() > 0 {
+		id := q.ready.Peek()
+		if head, exists := q.heads[q.addresses[id]]; exists && head == id {
+			return true
+		}
+
+		// this head was replaced by a lower id, that has its own entry
+		q.ready.Pop()
+	}
+	return false
+}
+
+// Returns the next msg to send, callers must check we are Ready first
+func (q *orderedQueue) Pop() uint64 {
+	id := q.ready.Pop()
+	address := q.addresses[id]
+
+	delete(q.heads, address)
+	q.busy[address] = id
+	q.queued--
+	return id
+}
+
+// Marks the passed in msg as one a sender is done with, while we look up whether it is being retried
+func (q *orderedQueue) Finishing(id uint64) {
+	q.finishing[id] = true
+}
+
+// Frees up the address of the passed in msg a sender was done with, unless it errored and is
+// waiting to be retried, in which case its address waits for it. Msgs that came back through
+// Insert or were Done while we were looking them up are already taken care of.
+func (q *orderedQueue) Finished(id uint64, state int) {
+	if !q.finishing[id] {
+		return
+	}
+	delete(q.finishing, id)
+
+	if state != MSG_RETRYING {
+		q.Done(id)
+	}
+}
+
+// Frees up the address of the passed in msg, which we are done with
+func (q *orderedQueue) Done(id uint64) {
+	address, exists := q.addresses[id]
+	if !exists {
+		return
+	}
+
+	delete(q.finishing, id)
+	delete(q.addresses, id)
+	delete(q.busy, address)
+
+	waiting, exists := q.waiting[address]
+	if exists {
+		q.setHead(address, waiting.Pop())
+		if waiting.Len() == 0 {
+			delete(q.waiting, address)
+		}
+	}
+}
+
+// Returns how many msgs are queued, including those waiting on their address
+func (q *orderedQueue) Len() int {
+	return q.queued
+}
+
+func (q *orderedQueue) setHead(address string, id uint64) {
+	q.heads[address] = id
+	q.ready.Insert(id)
+}
+
+func (q *orderedQueue) wait(address string, id uint64) {
+	waiting, exists := q.waiting[address]
+	if !exists {
+		waiting = &store.PriorityQueue{}
+		q.waiting[address] = waiting
+	}
+	waiting.Insert(id)
+}
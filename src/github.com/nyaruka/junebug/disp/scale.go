@@ -0,0 +1,123 @@
+package disp
+
+import (
+	"github.com/nyaruka/junebug/store"
+	"time"
+)
+
+// how often autoscaled connections reconsider how many workers they have
+const SCALE_INTERVAL = 5 * time.Second
+
+// once this share of the msgs a pool handled in an interval errored, it backs off
+const SCALE_ERROR_RATE = 0.2
+
+// What one of our pools of workers did over an interval, and the backlog it faces now
+type PoolSample struct {
+	Queued  int
+	Idle    int
+	Handled int
+	Errored int
+	Latency time.Duration
+}
+
+// Returns how many workers a pool that has the passed in number should have, given this sample.
+//
+// This is AIMD: when the transport starts returning errors we back off by halving our workers,
+// otherwise we add a worker at a time while our backlog would take longer than an interval to
+// clear, and remove one at a time while workers sit idle with nothing queued.
+func (p PoolSample) Target(workers int, bounds store.ScaleBounds) int {
+	target := workers
+
+	if p.Handled > 0 && float64(p.Errored)/float64(p.Handled) >= SCALE_ERROR_RATE {
+		target = workers / 2
+	} else if p.Queued > 0 && p.Idle == 0 && p.Handled > 0 && workers > 0 {
+		if time.Duration(p.Queued)*p.Latency/time.Duration(workers) > SCALE_INTERVAL {
+			target = workers + 1
+		}
+	} else if p.Queued == 0 && p.Idle > 0 {
+		target = workers - 1
+	}
+
+	if target < int(bounds.Min) {
+		target = int(bounds.Min)
+	}
+	if target > int(bounds.Max) {
+		target = int(bounds.Max)
+	}
+	return target
+}
+
+// Records that a sender finished with a msg it started on at the passed in time, and whether
+// that errored. Autoscaled connections scale their senders with this.
+func (d *Dispatcher) RecordSend(started time.Time, err error) {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	d.senderPool.record(time.Since(started), err)
+}
+
+// Records that a receiver finished with a msg it started on at the passed in time, and whether
+// that errored. Autoscaled connections scale their receivers with this.
+func (d *Dispatcher) RecordReceive(started time.Time, err error) {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	d.receiverPool.record(time.Since(started), err)
+}
+
+// Returns what our senders have done since we were last sampled, along with our backlog
+func (d *Dispatcher) SampleSenders() PoolSample {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	return d.senderPool.sample()
+}
+
+// Returns what our receivers have done since we were last sampled, along with our backlog
+func (d *Dispatcher) SampleReceivers() PoolSample {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	return d.receiverPool.sample()
+}
+
+// Stops one of our senders, the next idle one or, if they are all busy, the next to finish
+func (d *Dispatcher) RetireSender() {
+	select {
+	case d.retireSenders <- true:
+	case <-d.Done:
+	}
+}
+
+// Stops one of our receivers, the next idle one or, if they are all busy, the next to finish
+func (d *Dispatcher) RetireReceiver() {
+	select {
+	case d.retireReceivers <- true:
+	case <-d.Done:
+	}
+}
+
+// poolStats accumulates what a pool of workers did between samples
+type poolStats struct {
+	queued  int
+	idle    int
+	handled int
+	errored int
+	elapsed time.Duration
+}
+
+func (p *poolStats) record(elapsed time.Duration, err error) {
+	p.handled++
+	p.elapsed += elapsed
+	if err != nil {
+		p.errored++
+	}
+}
+
+func (p *poolStats) sample() PoolSample {
+	sample := PoolSample{Queued: p.queued, Idle: p.idle, Handled: p.handled, Errored: p.errored}
+	if p.handled > 0 {
+		sample.Latency = p.elapsed / time.Duration(p.handled)
+	}
+
+	p.handled = 0
+	p.errored = 0
+	p.elapsed = 0
+	return sample
+}
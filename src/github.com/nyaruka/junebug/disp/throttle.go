@@ -0,0 +1,111 @@
+package disp
+
+import (
+	"github.com/nyaruka/junebug/store"
+	"time"
+)
+
+// how many seconds we average our send rate over
+const RATE_WINDOW = 10
+
+// Limits how fast this dispatcher hands msgs to senders to the passed in config, must be
+// called before the dispatcher is started.
+func (d *Dispatcher) Throttle(config store.ThrottleConfig) {
+	if !config.IsThrottled() {
+		return
+	}
+	d.interval = config.Interval()
+	d.burst = int(config.Burst)
+}
+
+// Starts the ticker that refills our bucket, our loop owns it and stops it when it exits. Our
+// bucket starts full, as if we'd been quiet, returns nil when we aren't throttled.
+func (d *Dispatcher) startRefill() *time.Ticker {
+	if d.burst == 0 {
+		return nil
+	}
+	d.tokens = d.burst
+	return time.NewTicker(d.interval)
+}
+
+// adds a token to our bucket, up to our burst
+func (d *Dispatcher) refill() {
+	if d.tokens < d.burst {
+		d.tokens++
+	}
+}
+
+// Whether we may hand another msg to a sender right now, taking a token from our bucket if we
+// are throttled. Our loop wakes up and tries again each time our bucket is refilled.
+func (d *Dispatcher) takeToken() bool {
+	if d.burst == 0 {
+		return true
+	}
+
+	if d.tokens > 0 {
+		d.tokens--
+		return true
+	}
+	return false
+}
+
+// Returns how many msgs per second we've handed to senders, averaged over our rate window
+func (d *Dispatcher) SendRate() float64 {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	return d.sent.rate(time.Now())
+}
+
+// Returns how many msgs are waiting on our throttle, rather than on a free sender
+func (d *Dispatcher) Throttled() int {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+	return d.throttled
+}
+
+// records what we've sent, what is waiting and which workers are idle after each pass of our loop
+func (d *Dispatcher) updateStats(sent int) {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+
+	if sent > 0 {
+		d.sent.add(time.Now(), sent)
+	}
+
+	// msgs that are waiting while we have a free sender are only waiting on our throttle
+	d.throttled = 0
+	if d.burst > 0 && len(d.available_senders) > 0 && d.hasOutgoing() {
+		d.throttled = d.outgoingLen()
+	}
+
+	d.senderPool.queued = d.outgoingLen()
+	d.senderPool.idle = len(d.available_senders)
+	d.receiverPool.queued = d.available_incoming.Len()
+	d.receiverPool.idle = len(d.available_receivers)
+}
+
+// rateMeter counts events in each of the last RATE_WINDOW seconds
+type rateMeter struct {
+	seconds [RATE_WINDOW]int64
+	counts  [RATE_WINDOW]int
+}
+
+func (m *rateMeter) add(now time.Time, count int) {
+	second := now.Unix()
+	slot := second % RATE_WINDOW
+	if m.seconds[slot] != second {
+		m.seconds[slot] = second
+		m.counts[slot] = 0
+	}
+	m.counts[slot] += count
+}
+
+func (m *rateMeter) rate(now time.Time) float64 {
+	total := 0
+	for slot, second := range m.seconds {
+		if now.Unix()-second < RATE_WINDOW {
+			total += m.counts[slot]
+		}
+	}
+	return float64(total) / RATE_WINDOW
+}
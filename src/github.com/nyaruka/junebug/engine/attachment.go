@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nyaruka/junebug/store"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// the client we fetch attachments from URLs with
+var attachmentClient = &http.Client{Timeout: 30 * time.Second}
+
+// Loads the content of the passed in attachment, either from its blob or by fetching its URL.
+// Senders that upload media to their transport use this, whichever way the attachment was given.
+func loadAttachment(conn *store.Connection, attachment store.Attachment) (*store.Blob, error) {
+	if attachment.Blob != "" {
+		return conn.LoadBlob(attachment.Blob)
+	}
+
+	resp, err := attachmentClient.Get(attachment.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := readBlob(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	// the content type our client gave us wins over whatever the URL was served as
+	blob.ContentType = attachment.ContentType
+	return blob, nil
+}
+
+// Reads the body of the passed in response as a blob, erroring if the response wasn't a success
+// or is larger than we can store
+func readBlob(resp *http.Response) (*store.Blob, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New(fmt.Sprintf("Fetching %s returned status %d", resp.Request.URL, resp.StatusCode))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, store.MAX_BLOB_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > store.MAX_BLOB_SIZE {
+		return nil, errors.New(fmt.Sprintf("%s is larger than the maximum of %d bytes", resp.Request.URL, store.MAX_BLOB_SIZE))
+	}
+
+	return &store.Blob{ContentType: resp.Header.Get("Content-Type"), Data: data}, nil
+}
@@ -13,22 +13,36 @@ import (
 	"errors"
 )
 
-// EchoSender is a dummy sender that takes 5 seconds to send anything, then returns an
-// echo of the sent message back through our connection.
+// EchoSender is a dummy sender that pauses before sending anything, 5 seconds unless configured
+// otherwise, then returns an echo of the sent message back through our connection.
 //
 // It is an implementation of MsgSender
 //
 
 const PAUSE = "pause"
 
+// how many seconds we pause for when our config doesn't say
+const DEFAULT_PAUSE = 5
+
+func init() {
+	RegisterSender("echo", "Echoes every msg sent back as an incoming msg", DELIVERY_AT_LEAST_ONCE, []ConfigField{
+		{PAUSE, FIELD_INTEGER, false, "How many seconds to pause before sending back an echo, defaults to 5, can be zero"},
+	}, func(id int, s store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (disp.MsgSender, error) {
+		return CreateEchoSender(id, s, conn, dispatcher)
+	})
+}
+
 type EchoSender struct {
 	id               int
+	store            store.Store
 	connection       store.Connection
 	readySenders     chan disp.MsgSender
 	pendingMsg       chan uint64
 	incoming         chan uint64 // for receiving out our echos
 	done             chan int
+	stop             chan int
 	wg               *sync.WaitGroup
+	recordSend       func(time.Time, error)
 	pause            uint
 }
 
@@ -36,10 +50,19 @@ func (s EchoSender) Send(id uint64) {
 	s.pendingMsg <- id
 }
 
+func (s EchoSender) Id() int {
+	return s.id
+}
+
+// Stops just this sender, once it has finished with any msg it is sending
+func (s EchoSender) Stop() {
+	close(s.stop)
+}
+
 // Starts our sender, this starts a goroutine that blocks on receiving a message to send
 func (s EchoSender) Start() {
+	s.wg.Add(1)
 	go func() {
-		s.wg.Add(1)
 		defer s.wg.Done()
 		var id uint64
 
@@ -52,34 +75,51 @@ func (s EchoSender) Start() {
 			case id = <-s.pendingMsg:
 			case <- s.done:
 			  return
+			case <-s.stop:
+				return
 			}
 
-			var msgLog = ""
-
 			// load our msg
-			msg, err := store.MsgFromId(s.connection.Uuid, id)
+			msg, err := store.MsgFromId(s.store, s.connection.Uuid, id)
 			if err != nil {
-				msgLog = fmt.Sprintf("[%s][%d] Error sending msg (%d): %s", s.connection.Uuid, s.id, id, err.Error())
-			} else {
-				// sleep a bit to slow things down
-				time.Sleep(time.Second * 5)
-				msgLog = fmt.Sprintf("XXXX YYYY ZZZZ AAAA This is a log.\n" +
-				                     "XXXX YYYY ZZZZ BBBB It is fake.")
+				log.Printf("[%s][%d] Error loading msg (%d): %s", s.connection.Uuid, s.id, id, err.Error())
+				continue
+			}
+
+			// drop it if it expired while waiting to be sent
+			if expireIfDue(&s.connection, msg) {
+				msg.Release()
+				continue
 			}
 
-			// mark the message as sent
-			err = msg.MarkSent(msgLog)
+			err = markWired(&s.connection, s.id, msg)
+			if err != nil {
+				log.Printf("[%s][%d] Error marking msg wired (%d)", s.connection.Uuid, s.id, id)
+			}
+
+			// sleep a bit to slow things down
+			started := time.Now()
+			time.Sleep(time.Second * time.Duration(s.pause))
+			msgLog := fmt.Sprintf("XXXX YYYY ZZZZ AAAA This is a log.\n" +
+			                      "XXXX YYYY ZZZZ BBBB It is fake.")
+
+			// mark the message as sent, we echo it back right away so it is delivered too
+			err = msg.MarkSent(fmt.Sprintf("echo-%d", msg.Id), msgLog)
+			if err == nil {
+				err = msg.MarkDelivered("")
+			}
+			s.recordSend(started, nil)
+			endLease(&s.connection, msg)
 			if err != nil {
 				log.Printf("[%s][%d] Error marking msg sent (%d)", s.connection.Uuid, s.id, id)
 			} else {
 				log.Printf("[%s][%d] Sent msg (%d)", s.connection.Uuid, s.id, id)
 			}
 
-			// release our message back to the pool
-			msg.Release()
-
 			// create a new incoming msg
-			incoming := store.MsgFromText(s.connection.Uuid, msg.Address, "echo: "+msg.Text)
+			incoming := store.MsgFromText(s.store, s.connection.Uuid, msg.Address, "echo: "+msg.Text)
+			incoming.Attachments = msg.Attachments
+			incoming.Metadata = msg.Metadata
 			err = incoming.WriteToInbox()
 			if err != nil {
 				log.Printf("[%s][%d] Error adding incoming msg (%d)", s.connection.Uuid, s.id, id)
@@ -88,25 +128,32 @@ func (s EchoSender) Start() {
 			// schedule it to go out
 			s.incoming <- incoming.Id
 
-			// release our msg back to the pool
+			// release our msgs back to the pool
+			msg.Release()
 			incoming.Release()
 		}
 	}()
 }
 
-func CreateEchoSender(id int, conn *store.Connection, dispatcher *disp.Dispatcher) (e *EchoSender, err error) {
+func CreateEchoSender(id int, st store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (e *EchoSender, err error) {
 	echo := EchoSender{
-		id: id,
+		id:               id,
+		store:            st,
 		connection:       *conn,
 		readySenders:     dispatcher.Senders,
 		incoming:         dispatcher.Incoming,
 		pendingMsg:       make(chan uint64),
 		done:             dispatcher.Done,
-		wg:               dispatcher.WaitGroup }
-
-	pause, _ := strconv.ParseInt(conn.Senders.Config[PAUSE], 10, 8)
-	if pause < 0 {
-		return e, errors.New(fmt.Sprintf("Pause must be 0 or a positive integer, was: %d", pause))
+		stop:             make(chan int),
+		wg:               dispatcher.WaitGroup,
+		recordSend:       dispatcher.RecordSend }
+
+	pause := int64(DEFAULT_PAUSE)
+	if conn.Senders.Config[PAUSE] != "" {
+		pause, err = strconv.ParseInt(conn.Senders.Config[PAUSE], 10, 64)
+		if err != nil || pause < 0 {
+			return e, errors.New(fmt.Sprintf("Config field `pause` must be 0 or a positive integer, was: %s", conn.Senders.Config[PAUSE]))
+		}
 	}
 	echo.pause = uint(pause)
 	return &echo, err
@@ -0,0 +1,32 @@
+package engine_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/junebug/disp"
+	"github.com/nyaruka/junebug/engine"
+	"github.com/nyaruka/junebug/store"
+)
+
+func TestEchoSenderPause(t *testing.T) {
+	s := store.NewMemoryStore()
+	conn := createEchoConnection(t, s)
+	dispatcher := disp.CreateDispatcher(1, 1)
+
+	// pauses can be long, as long as they are whole seconds that aren't negative
+	for _, pause := range []string{"", "0", "5", "300"} {
+		conn.Senders.Config["pause"] = pause
+		_, err := engine.CreateEchoSender(0, s, conn, dispatcher)
+		if err != nil {
+			t.Errorf("Expected pause of `%s` to be valid, got: %s", pause, err)
+		}
+	}
+
+	for _, pause := range []string{"-1", "abc", "1.5"} {
+		conn.Senders.Config["pause"] = pause
+		_, err := engine.CreateEchoSender(0, s, conn, dispatcher)
+		if err == nil {
+			t.Errorf("Expected error for pause of `%s`", pause)
+		}
+	}
+}
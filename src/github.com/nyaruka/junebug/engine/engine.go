@@ -1,9 +1,13 @@
 package engine
 
 import (
+	"errors"
+	"fmt"
 	"github.com/nyaruka/junebug/disp"
 	"github.com/nyaruka/junebug/store"
 	"log"
+	"sync"
+	"time"
 )
 
 type ConnectionEngine struct {
@@ -11,80 +15,230 @@ type ConnectionEngine struct {
 	Senders        []disp.MsgSender
 	Receivers      []disp.MsgReceiver
 	Dispatcher     *disp.Dispatcher
+	Retrier        *Retrier
+
+	// only set for connections whose sender type takes in incoming msgs with a listener
+	Listener       disp.MsgListener
+
+	// only set for connections that autoscale their workers
+	Scaler         *Scaler
+
+	store          store.Store
+
+	// held while sending msgs with idempotency keys, so two can't be sent with the same one
+	sendMutex      sync.Mutex
 }
 
 // Creates a new Connection object given the configuration and dispatcher, this is a factory
-// method of sorts.
-func NewConnectionEngine(conn *store.Connection) (ce *ConnectionEngine, err error) {
-	// create a dispatcher for this connection
-	dispatcher := disp.CreateDispatcher(conn.Senders.Count, conn.Receivers.Count)
+// method of sorts. The sender and receiver types are looked up in our registry and the
+// connection's config validated against them.
+func NewConnectionEngine(s store.Store, conn *store.Connection) (ce *ConnectionEngine, err error) {
+	err = ValidateConnection(conn)
+	if err != nil {
+		return ce, err
+	}
 
-	// Create all our senders
-	// TODO: refactor this so it isn't so repetitive
-	senders := make([]disp.MsgSender, 0, conn.Senders.Count)
-	switch conn.Senders.Type {
-	case "echo":
-		for i := 0; uint(i) < conn.Senders.Count; i++ {
-			sender, err := CreateEchoSender(i, conn, dispatcher)
+	senderType, _ := getSenderType(conn.Senders.Type)
+	receiverType, _ := getReceiverType(conn.Receivers.Type)
+
+	// create a dispatcher for this connection, with room for as many workers as we might scale to
+	dispatcher := disp.CreateDispatcher(maxUint(conn.Senders.Count, conn.Autoscale.Senders.Max),
+		maxUint(conn.Receivers.Count, conn.Autoscale.Receivers.Max))
+	dispatcher.Throttle(conn.Throttle)
+	if conn.Paused {
+		dispatcher.Pause()
+	}
+	if conn.Ordered {
+		dispatcher.OrderByAddress(func(id uint64) (string, int, error) {
+			msg, err := store.MsgFromId(s, conn.Uuid, id)
 			if err != nil {
-				return ce, err
+				return "", disp.MSG_FINISHED, err
 			}
-			senders = append(senders, sender)
-		}
-	case "twitter":
-		for i := 0; uint(i) < conn.Senders.Count; i++ {
-			sender, err := CreateTwitterConnection(i, conn, dispatcher)
-			if err != nil {
-				return ce, err
+			defer msg.Release()
+
+			switch msg.Status {
+			case store.STATUS_QUEUED, store.STATUS_WIRED:
+				return msg.Address, disp.MSG_PENDING, nil
+			case store.STATUS_ERRORED:
+				return msg.Address, disp.MSG_RETRYING, nil
+			default:
+				return msg.Address, disp.MSG_FINISHED, nil
 			}
-			senders = append(senders, sender)
+		})
+	}
+
+	// Create all our senders
+	senders := make([]disp.MsgSender, 0, conn.Senders.Count)
+	for i := 0; uint(i) < conn.Senders.Count; i++ {
+		sender, err := senderType.factory(i, s, conn, dispatcher)
+		if err != nil {
+			return ce, err
 		}
-	default:
-		log.Fatal("Unsupported sender type: " + conn.Senders.Type)
+		senders = append(senders, sender)
 	}
 
 	// Then all our receivers
 	receivers := make([]disp.MsgReceiver, 0, conn.Receivers.Count)
-	switch conn.Receivers.Type {
-	case "http":
-		for i := 0; uint(i) < conn.Receivers.Count; i++ {
-			receiver, err := CreateHttpReceiver(i, conn, dispatcher)
-			if err != nil {
-				return ce, err
-			}
-			receivers = append(receivers, receiver)
+	for i := 0; uint(i) < conn.Receivers.Count; i++ {
+		receiver, err := receiverType.factory(i, s, conn, dispatcher)
+		if err != nil {
+			return ce, err
 		}
-	default:
-		log.Fatal("Unsupported receiver type: " + conn.Receivers.Type)
+		receivers = append(receivers, receiver)
 	}
 
-	return &ConnectionEngine{
+	// And our listener if we have one
+	var listener disp.MsgListener
+	if senderType.listener != nil {
+		listener, err = senderType.listener(s, conn, dispatcher)
+		if err != nil {
+			return ce, err
+		}
+	}
+
+	engine := &ConnectionEngine{
+		store: s,
 		Connection: conn,
 		Senders: senders,
 		Receivers: receivers,
-		Dispatcher: dispatcher }, err
+		Listener: listener,
+		Dispatcher: dispatcher,
+		Retrier: CreateRetrier(s, conn, dispatcher) }
+
+	if conn.Autoscale.Senders.IsEnabled() || conn.Autoscale.Receivers.IsEnabled() {
+		engine.Scaler = CreateScaler(s, conn, dispatcher)
+	}
+
+	return engine, err
+}
+
+func maxUint(a uint, b uint) uint {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Returns the status of our connection, along with how fast we are sending, how many msgs are
+// waiting on our throttle and whether our transport has rate limited us
+func (c *ConnectionEngine) GetStatus() (*store.ConnectionStatus, error) {
+	status, err := c.Connection.GetStatus()
+	if err != nil {
+		return status, err
+	}
+
+	status.SendRate = c.Dispatcher.SendRate()
+	status.Throttled = c.Dispatcher.Throttled()
+
+	if held := c.Dispatcher.HeldUntil(); time.Now().Before(held) {
+		status.RateLimitedUntil = &held
+	}
+
+	status.Senders, status.Receivers = int(c.Connection.Senders.Count), int(c.Connection.Receivers.Count)
+	if c.Scaler != nil {
+		status.Senders, status.Receivers = c.Scaler.Workers()
+	}
+	return status, nil
 }
 
-func (c *ConnectionEngine) AddPendingMsgsFromDB() (outgoing int, incoming int, err error) {
+// Writes the passed in msg to our outbox and dispatches it, unless it is scheduled for later.
+//
+// If the msg has an idempotency key and we already sent a msg with that key within our
+// connection's idempotency window, nothing is written and that original msg is returned
+// instead, along with true. Callers should release both msgs.
+func (c *ConnectionEngine) Send(msg *store.Msg) (*store.Msg, bool, error) {
+	if msg.IdempotencyKey != "" {
+		c.sendMutex.Lock()
+		defer c.sendMutex.Unlock()
+
+		original, err := store.MsgFromIdempotencyKey(c.store, c.Connection.Uuid, msg.IdempotencyKey)
+		if err == nil {
+			if time.Since(original.Created) < c.Connection.GetIdempotencyWindow() {
+				log.Printf("[%s] Repeated idempotency key \"%s\", returning msg (%d)", c.Connection.Uuid,
+					msg.IdempotencyKey, original.Id)
+				return original, true, nil
+			}
+			original.Release()
+		}
+	}
+
+	err := msg.WriteToOutbox()
+	if err != nil {
+		return msg, false, err
+	}
+
+	// scheduled msgs are dispatched by our retrier once they are due
+	if msg.Status != store.STATUS_SCHEDULED {
+		c.queue(c.Dispatcher.Outgoing, msg.Id)
+	}
+
+	return msg, false, nil
+}
+
+// Dispatches any msgs waiting in our outbox and inbox. Scheduled msgs stay where they are, our
+// retrier releases them as they come due, including any that came due while we were stopped.
+func (c *ConnectionEngine) AddPendingMsgsFromDB() (outgoing int, incoming int, scheduled int, err error) {
+	// when ordering, msgs waiting to be retried or in flight from before we started keep their
+	// address busy, so our backlog can't overtake them. Those our own senders are still sending
+	// aren't waited on, as nothing would tell us when they finish.
+	if c.Connection.Ordered {
+		retry_ids, err := c.Connection.GetRetryMsgs()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, id := range *retry_ids {
+			c.queue(c.Dispatcher.Busy, id)
+		}
+
+		in_flight_ids, err := c.Connection.GetInFlightMsgs()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		for _, id := range *in_flight_ids {
+			if !isLeaseActive(c.Connection, id) {
+				c.queue(c.Dispatcher.Busy, id)
+			}
+		}
+	}
+
 	// dispatch any backlog of outgoing messages
 	outgoing_ids, err := c.Connection.GetOutboxMsgs()
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 	for _, id := range *outgoing_ids {
-		c.Dispatcher.Outgoing <- id
+		c.queue(c.Dispatcher.Outgoing, id)
 	}
 
 	// dispatch any backlog of messages
 	incoming_ids, err := c.Connection.GetInboxMsgs()
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 	for _, id := range *incoming_ids {
-		c.Dispatcher.Incoming <- id
+		c.queue(c.Dispatcher.Incoming, id)
+	}
+
+	scheduled_ids, err := c.Connection.GetScheduledMsgs()
+	if err != nil {
+		return 0, 0, 0, err
 	}
 
-	return len(*outgoing_ids), len(*incoming_ids), err
+	return len(*outgoing_ids), len(*incoming_ids), len(*scheduled_ids), err
+}
+
+// Passes the passed in incoming msg to our receivers
+func (c *ConnectionEngine) QueueIncoming(id uint64) {
+	c.queue(c.Dispatcher.Incoming, id)
+}
+
+// Passes the passed in id to our dispatcher, unless we've been stopped. Msgs not queued because
+// we were stopped are still in our outbox or inbox, so are queued when we next start.
+func (c *ConnectionEngine) queue(queue chan uint64, id uint64) {
+	select {
+	case queue <- id:
+	case <-c.Dispatcher.Done:
+	}
 }
 
 // Shuts down our connection
@@ -92,6 +246,16 @@ func (c *ConnectionEngine) Stop() {
 	c.Dispatcher.Stop()
 }
 
+// Shuts down our connection, waiting at most the passed in timeout for in-flight msgs to finish.
+// Any msgs still in flight after that stay in our in flight bucket until their lease expires, when
+// they are reconciled according to the delivery of our sender type.
+func (c *ConnectionEngine) StopWithin(timeout time.Duration) error {
+	if !c.Dispatcher.StopWithin(timeout) {
+		return errors.New(fmt.Sprintf("Timed out after %s waiting for in-flight msgs", timeout.Round(time.Second)))
+	}
+	return nil
+}
+
 // Starts our connection and all it's senders as listening
 func (c *ConnectionEngine) Start() {
 	// Start our dispatcher
@@ -106,4 +270,17 @@ func (c *ConnectionEngine) Start() {
 	for _, receiver := range c.Receivers {
 		receiver.Start()
 	}
+
+	// Then our listener, once our receivers are ready for what it takes in
+	if c.Listener != nil {
+		c.Listener.Start()
+	}
+
+	// Finally, start watching for msgs to retry
+	c.Retrier.Start()
+
+	// and scaling our workers with our load
+	if c.Scaler != nil {
+		c.Scaler.Start()
+	}
 }
@@ -12,31 +12,55 @@ import (
 	"fmt"
 	"sync"
 	"errors"
+	"strconv"
+	"time"
 )
 
 const RECEIVE_URL = "url"
+const RECEIVE_TIMEOUT = "timeout"
+
+// how many seconds we wait on our URL by default
+const DEFAULT_RECEIVE_TIMEOUT = 30
+
+func init() {
+	RegisterReceiver("http", "POSTs incoming msgs as JSON to a URL", []ConfigField{
+		{RECEIVE_URL, FIELD_STRING, true, "The URL to POST incoming msgs to"},
+		{RECEIVE_TIMEOUT, FIELD_INTEGER, false, "How many seconds to wait for a response, defaults to 30"},
+	}, func(id int, s store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (disp.MsgReceiver, error) {
+		return CreateHttpReceiver(id, s, conn, dispatcher)
+	})
+}
 
-// Http Receiver is a basic receiver that forwards the incoming message to an endpoint
+// Http Receiver is a basic receiver that forwards the incoming message to an endpoint, any
+// 2xx response is considered a success
 type HttpReceiver struct {
 	id               int
+	store            store.Store
 	connection       store.Connection
 	readyReceivers   chan disp.MsgReceiver
 	pendingMsg       chan uint64
 	done             chan int
+	stop             chan int
 	wg               *sync.WaitGroup
+	recordReceive    func(time.Time, error)
 	url              string
+	client           *http.Client
 }
 
 func (s HttpReceiver) Receive(id uint64) {
 	s.pendingMsg <- id
 }
 
+// Stops just this receiver, once it has finished with any msg it is posting
+func (r HttpReceiver) Stop() {
+	close(r.stop)
+}
+
 // Starts our receiver, this starts a goroutine that blocks on msgs to forward
 func (r HttpReceiver) Start() {
+	// tell our wait group we started
+	r.wg.Add(1)
 	go func() {
-		// tell our wait group we started
-		r.wg.Add(1)
-
 		// when we exit, tell our wait group we stopped
 		defer r.wg.Done()
 		var id uint64
@@ -49,49 +73,35 @@ func (r HttpReceiver) Start() {
 			select {
 			case id = <-r.pendingMsg:
 			case <-r.done: return
+			case <-r.stop: return
 			}
 
 			// load our msg
-			var msgLog = ""
-			msg, err := store.MsgFromId(r.connection.Uuid, id)
+			msg, err := store.MsgFromId(r.store, r.connection.Uuid, id)
 			if err != nil {
-				msgLog = fmt.Sprintf(
-					"[%s][%d] Error loading msg (%d) from store: %s", r.connection.Uuid, r.id, id, err.Error())
+				log.Printf("[%s][%d] Error loading msg (%d) from store: %s", r.connection.Uuid, r.id, id, err.Error())
+				continue
+			}
+
+			started := time.Now()
+			msgLog, retryable, err := r.post(msg)
+
+			// only errors worth retrying mean our URL is struggling, the rest are about the msg
+			if retryable {
+				r.recordReceive(started, err)
 			} else {
-				js, err := json.Marshal(msg)
-				if err != nil {
-					msgLog = fmt.Sprintf(
-						"[%s][%d] Error json encoding msg (%d): %s", r.connection.Uuid, r.id, id, err.Error())
-				} else {
-					// we post our Msg body to our receiver URL
-					req, err := http.NewRequest("POST", r.url, bytes.NewBuffer(js))
-					req.Header.Set("Content-Type", "application/json")
-
-					client := &http.Client{}
-					resp, err := client.Do(req)
-					if err != nil {
-						msgLog = fmt.Sprintf("[%s][%d] Error posting msg (%d): %s", r.connection.Uuid, r.id, id, err.Error())
-					} else {
-						buf := new(bytes.Buffer)
-						buf.ReadFrom(resp.Body)
-						body := buf.String()
-
-						if resp.Status != "200" && resp.Status != "201" {
-							msgLog = fmt.Sprintf("[%s][%d] Error posting msg (%d) received status %s: %s",
-								r.connection.Uuid, r.id, id, resp.Status, body)
-						} else {
-							msgLog = fmt.Sprintf("Status: %s\n\n%s", resp.Status, body)
-						}
-						resp.Body.Close()
-					}
-				}
+				r.recordReceive(started, nil)
 			}
 
-			// mark the message as sent
-			err = msg.MarkHandled(msgLog)
-			log.Printf("[%s][%d] Handled msg (%d)", r.connection.Uuid, r.id, id)
 			if err != nil {
-				log.Println("Error marking msg handled")
+				err = markReceiveErrored(&r.connection, msg, msgLog, retryable)
+			} else {
+				err = msg.MarkHandled(msgLog)
+				log.Printf("[%s][%d] Handled msg (%d)", r.connection.Uuid, r.id, id)
+			}
+
+			if err != nil {
+				log.Printf("[%s][%d] Error saving msg status (%d): %s", r.connection.Uuid, r.id, id, err.Error())
 			}
 
 			// release our msg back to our object pool
@@ -100,19 +110,67 @@ func (r HttpReceiver) Start() {
 	}()
 }
 
-func CreateHttpReceiver(id int, conn *store.Connection, dispatcher *disp.Dispatcher) (r *HttpReceiver, err error) {
+// Posts the passed in msg to our URL, returning the log for the attempt. If we weren't
+// successful we also return the error and whether it is worth trying again, we retry
+// connection errors, timeouts and server errors but not client errors.
+func (r HttpReceiver) post(msg *store.Msg) (msgLog string, retryable bool, err error) {
+	js, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Sprintf("[%s][%d] Error json encoding msg (%d): %s", r.connection.Uuid, r.id, msg.Id, err.Error()), false, err
+	}
+
+	// we post our Msg body to our receiver URL
+	req, err := http.NewRequest("POST", r.url, bytes.NewBuffer(js))
+	if err != nil {
+		return fmt.Sprintf("[%s][%d] Error building request for msg (%d): %s", r.connection.Uuid, r.id, msg.Id, err.Error()), false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("[%s][%d] Error posting msg (%d): %s", r.connection.Uuid, r.id, msg.Id, err.Error()), true, err
+	}
+	defer resp.Body.Close()
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(resp.Body)
+	body := buf.String()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout ||
+			resp.StatusCode == http.StatusTooManyRequests
+		return fmt.Sprintf("[%s][%d] Error posting msg (%d) received status %s: %s",
+			r.connection.Uuid, r.id, msg.Id, resp.Status, body), retryable, errors.New(resp.Status)
+	}
+
+	return fmt.Sprintf("Status: %s\n\n%s", resp.Status, body), false, nil
+}
+
+func CreateHttpReceiver(id int, st store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (r *HttpReceiver, err error) {
 	receiver := HttpReceiver{
-		id: id,
+		id:               id,
+		store:            st,
 		connection:       *conn,
 		readyReceivers:   dispatcher.Receivers,
 		pendingMsg:       make(chan uint64),
 		done:             dispatcher.Done,
-		wg:               dispatcher.WaitGroup }
+		stop:             make(chan int),
+		wg:               dispatcher.WaitGroup,
+		recordReceive:    dispatcher.RecordReceive }
 
 	receiver.url = conn.Receivers.Config[RECEIVE_URL]
 	if receiver.url == "" {
 		return r, errors.New("You must specify a `url` in your configuration")
 	}
 
+	timeout := int64(DEFAULT_RECEIVE_TIMEOUT)
+	if conn.Receivers.Config[RECEIVE_TIMEOUT] != "" {
+		timeout, err = strconv.ParseInt(conn.Receivers.Config[RECEIVE_TIMEOUT], 10, 32)
+		if err != nil || timeout <= 0 {
+			return r, errors.New("Config field `timeout` must be a positive integer")
+		}
+	}
+	receiver.client = &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
 	return &receiver, err
 }
@@ -0,0 +1,164 @@
+package engine_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/junebug/disp"
+	"github.com/nyaruka/junebug/engine"
+	"github.com/nyaruka/junebug/store"
+)
+
+// passes an incoming msg to an http receiver posting to the passed in handler, returning the
+// msg once the receiver is finished with it
+func receiveWith(t *testing.T, handler http.HandlerFunc, receivers string) *store.Msg {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	s := store.NewMemoryStore()
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "echo"},
+		"receivers": {"type": "http", "config": {"url": "`+server.URL+`"`+receivers+`}},
+		"retries": {"max_attempts": 2}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Save()
+
+	dispatcher := disp.CreateDispatcher(1, 1)
+	receiver, err := engine.CreateHttpReceiver(0, s, conn, dispatcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcher.Start()
+	receiver.Start()
+	defer dispatcher.Stop()
+
+	msg := store.MsgFromText(s, conn.Uuid, "+250788383383", "Hello")
+	err = msg.WriteToInbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := msg.Id
+	msg.Release()
+	dispatcher.Incoming <- id
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		msg, err = store.MsgFromId(s, conn.Uuid, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Status != store.STATUS_QUEUED {
+			return msg
+		}
+		msg.Release()
+	}
+	t.Fatal("Timed out waiting for msg to be received")
+	return nil
+}
+
+func respondWith(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}
+}
+
+func TestHttpReceiver(t *testing.T) {
+	// anything in the 2xx range is handled
+	for _, status := range []int{200, 201, 204, 299} {
+		msg := receiveWith(t, respondWith(status), "")
+		if msg.Status != store.STATUS_HANDLED {
+			t.Errorf("Expected msg to be handled for status %d, was %s", status, msg.Status)
+		}
+		msg.Release()
+	}
+
+	// server errors, timeouts and rate limits are retried
+	for _, status := range []int{500, 503, 408, 429} {
+		msg := receiveWith(t, respondWith(status), "")
+		if msg.Status != store.STATUS_ERRORED || msg.Attempts != 1 {
+			t.Errorf("Expected msg to be retried for status %d, was %s after %d attempts", status, msg.Status, msg.Attempts)
+		}
+		msg.Release()
+	}
+
+	// other client errors will never succeed so are dead lettered straight away
+	for _, status := range []int{400, 404, 410} {
+		msg := receiveWith(t, respondWith(status), "")
+		if msg.Status != store.STATUS_DEAD_LETTERED || msg.Attempts != 1 {
+			t.Errorf("Expected msg to be dead lettered for status %d, was %s after %d attempts", status, msg.Status, msg.Attempts)
+		}
+		msg.Release()
+	}
+
+	// msgs are posted to our URL as JSON
+	var contentType, body string
+	msg := receiveWith(t, func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		js, _ := ioutil.ReadAll(r.Body)
+		body = string(js)
+	}, "")
+	msg.Release()
+	if contentType != "application/json" || !strings.Contains(body, `"text":"Hello"`) {
+		t.Errorf("Expected msg to be posted as JSON, got %s: %s", contentType, body)
+	}
+
+	// URLs slower than our timeout are retried
+	msg = receiveWith(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+	}, `, "timeout": "1"`)
+	if msg.Status != store.STATUS_ERRORED {
+		t.Errorf("Expected msg to be retried after timing out, was %s", msg.Status)
+	}
+	msg.Release()
+}
+
+func TestHttpReceiverDeadLetters(t *testing.T) {
+	s := store.NewMemoryStore()
+	server := httptest.NewServer(respondWith(500))
+	defer server.Close()
+
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "echo"},
+		"receivers": {"type": "http", "config": {"url": "`+server.URL+`"}},
+		"retries": {"max_attempts": 2, "backoff": 1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Save()
+
+	running, err := engine.NewConnectionEngine(s, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running.Start()
+	defer running.Stop()
+
+	msg := store.MsgFromText(s, conn.Uuid, "+250788383383", "Hello")
+	err = msg.WriteToInbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := msg.Id
+	msg.Release()
+	running.Dispatcher.Incoming <- id
+
+	// our msg is retried once, then dead lettered once it runs out of attempts
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		status, _ := conn.GetStatus()
+		if status.DeadLetters == 1 {
+			break
+		}
+	}
+
+	msg, err = store.MsgFromId(s, conn.Uuid, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msg.Release()
+	if msg.Status != store.STATUS_DEAD_LETTERED || msg.Attempts != 2 {
+		t.Errorf("Expected msg to be dead lettered after 2 attempts, was %s after %d", msg.Status, msg.Attempts)
+	}
+}
@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/nyaruka/junebug/store"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long a sender holds a msg it has in flight. Msgs still in flight once their lease
+// expires, usually because we crashed while sending them, are reconciled by our retrier.
+// Sends can take longer than this, so msgs one of our senders is still sending are left alone.
+const IN_FLIGHT_LEASE = 60 * time.Second
+
+// What transports guarantee about msgs whose lease expired, when we can't know whether the
+// transport got them. At least once transports send them again, at most once transports fail them.
+const DELIVERY_AT_LEAST_ONCE = "at_least_once"
+const DELIVERY_AT_MOST_ONCE = "at_most_once"
+
+// identifies this process in the owners of msgs we put in flight
+var instanceId = fmt.Sprintf("%s:%d", hostname(), os.Getpid())
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
+// the msgs our senders are sending right now, by connection and msg id
+type activeLease struct {
+	connUuid string
+	id       uint64
+}
+
+var activeLeases = make(map[activeLease]bool)
+var activeLeasesMutex sync.Mutex
+
+// Marks the passed in msg as wired by the passed in sender, leasing it for IN_FLIGHT_LEASE. Senders
+// must call endLease once they are done with it.
+func markWired(conn *store.Connection, senderId int, msg *store.Msg) error {
+	activeLeasesMutex.Lock()
+	activeLeases[activeLease{conn.Uuid, msg.Id}] = true
+	activeLeasesMutex.Unlock()
+
+	owner := fmt.Sprintf("%s/%.8s/%d", instanceId, conn.Uuid, senderId)
+	return msg.MarkWired(owner, time.Now().Add(IN_FLIGHT_LEASE))
+}
+
+// Ends the lease on the passed in msg, once its sender has finished sending it
+func endLease(conn *store.Connection, msg *store.Msg) {
+	activeLeasesMutex.Lock()
+	delete(activeLeases, activeLease{conn.Uuid, msg.Id})
+	activeLeasesMutex.Unlock()
+}
+
+// whether one of our senders is still sending the msg with the passed in id
+func isLeaseActive(conn *store.Connection, id uint64) bool {
+	activeLeasesMutex.Lock()
+	defer activeLeasesMutex.Unlock()
+	return activeLeases[activeLease{conn.Uuid, id}]
+}
+
+// Reconciles the in flight msgs whose lease has expired. Msgs of at least once transports
+// are requeued if they have attempts left, otherwise they are failed. Msgs one of our senders
+// is still sending are skipped, reconciling those would send them twice. Returns false if we
+// were stopped while doing so.
+func (r Retrier) reconcileLeases() bool {
+	ids, err := r.connection.GetExpiredLeaseMsgs(time.Now())
+	if err != nil {
+		log.Printf("[%s] Error reading expired leases: %s", r.connection.Uuid, err.Error())
+		return true
+	}
+
+	for _, id := range *ids {
+		if isLeaseActive(&r.connection, id) {
+			continue
+		}
+
+		msg, err := store.MsgFromId(r.store, r.connection.Uuid, id)
+		if err != nil {
+			log.Printf("[%s] Error loading in flight msg (%d): %s", r.connection.Uuid, id, err.Error())
+			continue
+		}
+
+		msgLog := fmt.Sprintf("[%s] Lease held by %s expired at %s", r.connection.Uuid, msg.Owner,
+			msg.LeaseExpires.Format(time.RFC3339))
+		_, retry := r.connection.Retries.NextRetry(msg.Attempts)
+		requeued := false
+
+		if msg.IsExpired(time.Now()) {
+			err = msg.MarkExpired(msgLog)
+		} else if r.delivery == DELIVERY_AT_MOST_ONCE {
+			err = msg.MarkFailed(msgLog + ", not resending as it may have been sent")
+		} else if !retry {
+			err = msg.MarkFailed(msgLog + ", no attempts left")
+		} else {
+			err = msg.MarkLeaseRequeued(msgLog + ", requeued")
+			requeued = true
+		}
+
+		log.Printf("%s, now %s (%d)", msgLog, msg.Status, id)
+		msg.Release()
+		if err != nil {
+			log.Printf("[%s] Error reconciling in flight msg (%d): %s", r.connection.Uuid, id, err.Error())
+			continue
+		}
+
+		// requeued msgs go back to our dispatcher, the rest free up their address if it waits on them
+		queue := r.finished
+		if requeued {
+			queue = r.outgoing
+		}
+		select {
+		case queue <- id:
+		case <-r.done:
+			return false
+		}
+	}
+
+	return true
+}
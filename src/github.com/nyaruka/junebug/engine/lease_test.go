@@ -0,0 +1,86 @@
+package engine_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/junebug/engine"
+	"github.com/nyaruka/junebug/store"
+)
+
+// waits for the msg with the passed in id to reach the passed in status, returning it
+func waitForStatus(t *testing.T, s store.Store, conn *store.Connection, id uint64, status string, timeout time.Duration) *store.Msg {
+	var msg *store.Msg
+	var err error
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(10 * time.Millisecond) {
+		msg, err = store.MsgFromId(s, conn.Uuid, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Status == status {
+			return msg
+		}
+		msg.Release()
+	}
+	t.Fatalf("Timed out waiting for msg (%d) to be %s, was %s", id, status, msg.Status)
+	return nil
+}
+
+func TestExpiredLeases(t *testing.T) {
+	s := store.NewMemoryStore()
+	manager := engine.NewConnectionManager(s)
+	defer manager.StopAll(5 * time.Second)
+
+	// our sender takes longer to send than we let our lease run for
+	conn, _ := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "echo", "config": {"pause": "2"}},
+		"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`))
+	err := manager.Add(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running, _ := manager.Get(conn.Uuid)
+	msg, _ := store.MsgFromJson(s, strings.NewReader(`{"address": "+250788383383", "text": "Hello"}`))
+	msg.ConnUuid = conn.Uuid
+	_, _, err = running.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := msg.Id
+	msg.Release()
+
+	msg = waitForStatus(t, s, conn, id, store.STATUS_WIRED, time.Second)
+	err = s.SaveMsg(msg, time.Now().Add(-time.Second), store.IN_FLIGHT_BUCKET)
+	msg.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// our retrier leaves it alone as our sender is still sending it, so it is only sent once
+	msg = waitForStatus(t, s, conn, id, store.STATUS_DELIVERED, 5*time.Second)
+	if msg.Attempts != 1 {
+		t.Errorf("Expected msg still being sent not to be requeued, was sent %d times", msg.Attempts)
+	}
+	msg.Release()
+
+	// whereas msgs whose sender is gone, such as when we crashed sending them, are sent again
+	msg, _ = store.MsgFromJson(s, strings.NewReader(`{"address": "+250788383383", "text": "Hello"}`))
+	msg.ConnUuid = conn.Uuid
+	err = msg.WriteToOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = msg.MarkWired("otherhost:1/abc/0", time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id = msg.Id
+	msg.Release()
+
+	msg = waitForStatus(t, s, conn, id, store.STATUS_DELIVERED, 6*time.Second)
+	if msg.Attempts != 2 {
+		t.Errorf("Expected orphaned msg to be sent again, was sent %d times", msg.Attempts)
+	}
+	msg.Release()
+}
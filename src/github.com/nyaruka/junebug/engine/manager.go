@@ -0,0 +1,487 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nyaruka/junebug/store"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The lifecycle states of a connection's engine
+const STATE_STARTING = "starting"
+const STATE_RUNNING = "running"
+const STATE_PAUSED = "paused"
+const STATE_DRAINING = "draining"
+const STATE_STOPPED = "stopped"
+const STATE_FAILED = "failed"
+
+// how often we check whether a draining connection has emptied its queues
+const DRAIN_POLL_INTERVAL = 250 * time.Millisecond
+
+// ConnectionManager owns the engines of all our connections and tracks what state each is in.
+// All its methods are safe to call from multiple goroutines, lifecycle operations on a single
+// connection are serialized so it can't be started and stopped at the same time.
+type ConnectionManager struct {
+	store       store.Store
+	mutex       sync.RWMutex
+	connections map[string]*managedConnection
+}
+
+// a connection we manage, engine is only set while it is starting, running, paused or draining
+type managedConnection struct {
+	lifecycle sync.Mutex
+	engine    *ConnectionEngine
+	state     string
+	err       error
+}
+
+func NewConnectionManager(s store.Store) *ConnectionManager {
+	return &ConnectionManager{store: s, connections: make(map[string]*managedConnection)}
+}
+
+// Starts every connection in our store, connections whose config is no longer valid are left
+// failed rather than taking everything else down with them
+func (m *ConnectionManager) StartAll() error {
+	connections, err := store.LoadAllConnections(m.store)
+	if err != nil {
+		return err
+	}
+
+	for i := range *connections {
+		connection := &(*connections)[i]
+		mc := m.manage(connection.Uuid)
+
+		mc.lifecycle.Lock()
+		err = m.start(mc, connection)
+		mc.lifecycle.Unlock()
+
+		if err != nil {
+			log.Printf("[%.8s] Unable to start: %s\n", connection.Uuid, err.Error())
+		}
+	}
+	return nil
+}
+
+// Validates, saves and starts the passed in new connection
+func (m *ConnectionManager) Add(connection *store.Connection) error {
+	// creating our engine validates our config, we don't save anything invalid
+	engine, err := NewConnectionEngine(m.store, connection)
+	if err != nil {
+		return err
+	}
+
+	err = connection.Save()
+	if err != nil {
+		return err
+	}
+
+	mc := m.manage(connection.Uuid)
+	mc.lifecycle.Lock()
+	defer mc.lifecycle.Unlock()
+
+	engine.Start()
+	if connection.Paused {
+		m.setState(mc, STATE_PAUSED, engine, nil)
+	} else {
+		m.setState(mc, STATE_RUNNING, engine, nil)
+	}
+	return nil
+}
+
+// Returns the engine of the passed in connection, erroring if it isn't running or paused
+func (m *ConnectionManager) Get(uuid string) (*ConnectionEngine, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	mc, exists := m.connections[uuid]
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("No connection with uuid: %s", uuid))
+	}
+	if mc.state != STATE_RUNNING && mc.state != STATE_PAUSED {
+		return nil, errors.New(fmt.Sprintf("Connection %s is %s", uuid, mc.state))
+	}
+	return mc.engine, nil
+}
+
+// Returns the state of the passed in connection, along with the error that made it fail if it did
+func (m *ConnectionManager) State(uuid string) (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	mc, exists := m.connections[uuid]
+	if !exists {
+		return STATE_STOPPED, nil
+	}
+	return mc.state, mc.err
+}
+
+// Returns the uuids of all the connections we manage, sorted
+func (m *ConnectionManager) Uuids() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	uuids := make([]string, 0, len(m.connections))
+	for uuid := range m.connections {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+// Starts the passed in stopped or failed connection, reloading its config from our store
+func (m *ConnectionManager) Start(uuid string) error {
+	connection, err := store.ConnectionFromUuid(m.store, uuid)
+	if err != nil {
+		return err
+	}
+
+	mc := m.manage(uuid)
+	mc.lifecycle.Lock()
+	defer mc.lifecycle.Unlock()
+
+	if mc.engine != nil {
+		return errors.New(fmt.Sprintf("Connection %s is already %s", uuid, mc.state))
+	}
+	return m.start(mc, connection)
+}
+
+// Stops the passed in connection, waiting at most timeout for its in-flight msgs
+func (m *ConnectionManager) Stop(uuid string, timeout time.Duration) error {
+	mc, err := m.managed(uuid)
+	if err != nil {
+		return err
+	}
+
+	mc.lifecycle.Lock()
+	defer mc.lifecycle.Unlock()
+
+	return m.stop(mc, uuid, timeout)
+}
+
+// Stops then starts the passed in connection, picking up any changes to its config
+func (m *ConnectionManager) Restart(uuid string, timeout time.Duration) error {
+	connection, err := store.ConnectionFromUuid(m.store, uuid)
+	if err != nil {
+		return err
+	}
+
+	mc := m.manage(uuid)
+	mc.lifecycle.Lock()
+	defer mc.lifecycle.Unlock()
+
+	if mc.engine != nil {
+		err = m.stop(mc, uuid, timeout)
+		if err != nil {
+			log.Printf("[%.8s] %s, restarting anyway\n", uuid, err.Error())
+		}
+	}
+	return m.start(mc, connection)
+}
+
+// Validates and saves the passed in new config for a connection, then replaces its engine with
+// one built from it. The old engine is stopped before the new one starts, waiting at most timeout
+// for what it had in flight, so the two never stream, bind or retry at the same time. Msgs are
+// still accepted while we wait, anything the old engine had queued is queued on the new one.
+// Running connections can't change their sender type this way, they must be stopped first.
+func (m *ConnectionManager) Update(connection *store.Connection, timeout time.Duration) error {
+	// creating our engine validates our config, we don't save anything invalid
+	engine, err := NewConnectionEngine(m.store, connection)
+	if err != nil {
+		return err
+	}
+
+	mc, err := m.managed(connection.Uuid)
+	if err != nil {
+		return err
+	}
+
+	mc.lifecycle.Lock()
+	defer mc.lifecycle.Unlock()
+
+	// our old engine's msgs and leases are in the shape of its sender type, so can't be handed over
+	previous := mc.engine
+	if previous != nil && previous.Connection.Senders.Type != connection.Senders.Type {
+		return errors.New(fmt.Sprintf("Connection %s is %s, stop it before changing its sender type", connection.Uuid, mc.state))
+	}
+
+	err = connection.Save()
+	if err != nil {
+		return err
+	}
+
+	// connections that aren't running pick up their new config when they are next started
+	if previous == nil {
+		return nil
+	}
+
+	// our old engine stays ours while it stops, msgs sent to it wait in our outbox for our new one
+	err = previous.StopWithin(timeout)
+	if err != nil {
+		log.Printf("[%.8s] %s, updating anyway\n", connection.Uuid, err.Error())
+	}
+
+	// our new engine queues what it is given until it has picked up our old engine's queues
+	engine.Dispatcher.Pause()
+	engine.Start()
+	m.setState(mc, mc.state, engine, nil)
+
+	// msgs that were queued on our old engine are still in our outbox and inbox, our queues
+	// ignore any we already have
+	outgoing, incoming, _, err := engine.AddPendingMsgsFromDB()
+	if err != nil {
+		engine.Stop()
+		m.setState(mc, STATE_FAILED, nil, err)
+		return err
+	}
+
+	if !connection.Paused {
+		engine.Dispatcher.Resume()
+	}
+
+	log.Printf("[%.8s] Updated with %d queued outgoing, %d queued incoming\n", connection.Uuid, outgoing, incoming)
+	return nil
+}
+
+// Pauses the passed in connection, it keeps accepting msgs but won't send them until resumed.
+// Connections stay paused across restarts.
+func (m *ConnectionManager) Pause(uuid string) error {
+	return m.setPaused(uuid, true)
+}
+
+// Resumes sending on the passed in paused connection
+func (m *ConnectionManager) Resume(uuid string) error {
+	return m.setPaused(uuid, false)
+}
+
+func (m *ConnectionManager) setPaused(uuid string, paused bool) error {
+	mc, err := m.managed(uuid)
+	if err != nil {
+		return err
+	}
+
+	mc.lifecycle.Lock()
+	defer mc.lifecycle.Unlock()
+
+	if mc.state != STATE_RUNNING && mc.state != STATE_PAUSED {
+		return errors.New(fmt.Sprintf("Connection %s is %s", uuid, mc.state))
+	}
+
+	// save first, so we never send while our store thinks we are paused. We save a copy, as our
+	// engine's connection is read without our lock, our dispatcher is what knows we are paused.
+	engine := mc.engine
+	connection := *engine.Connection
+	connection.Paused = paused
+	err = connection.Save()
+	if err != nil {
+		return err
+	}
+
+	if paused {
+		engine.Dispatcher.Pause()
+		m.setState(mc, STATE_PAUSED, engine, nil)
+		log.Printf("[%.8s] Paused\n", uuid)
+	} else {
+		engine.Dispatcher.Resume()
+		m.setState(mc, STATE_RUNNING, engine, nil)
+		log.Printf("[%.8s] Resumed\n", uuid)
+	}
+	return nil
+}
+
+// Drains the passed in connection ahead of deleting it. New msgs are rejected while we wait at most
+// timeout for everything already queued to be sent or handled, then the connection is stopped.
+// Returns how many msgs were left over, including any scheduled msgs as those aren't due yet. These
+// can be exported before the connection is deleted.
+func (m *ConnectionManager) Drain(uuid string, timeout time.Duration) (int, error) {
+	connection, err := store.ConnectionFromUuid(m.store, uuid)
+	if err != nil {
+		return 0, err
+	}
+
+	mc := m.manage(uuid)
+	mc.lifecycle.Lock()
+	defer mc.lifecycle.Unlock()
+
+	// connections that aren't running have nothing to drain with
+	if mc.engine == nil {
+		return connection.GetPendingCount()
+	}
+
+	// nobody can get our engine to send with while we drain, but paused connections need to send again
+	engine := mc.engine
+	m.setState(mc, STATE_DRAINING, engine, nil)
+	engine.Dispatcher.Resume()
+	log.Printf("[%.8s] Draining\n", uuid)
+
+	// scheduled msgs aren't due, so we don't wait on them but they are still left over
+	deadline := time.Now().Add(timeout)
+	pending, err := connection.GetDrainableCount()
+	for err == nil && pending > 0 && time.Now().Before(deadline) {
+		time.Sleep(DRAIN_POLL_INTERVAL)
+		pending, err = connection.GetDrainableCount()
+	}
+	if err != nil {
+		return pending, err
+	}
+
+	// give anything still in flight what's left of our timeout to finish, idle senders still need
+	// a moment to notice they are being stopped
+	remaining := time.Until(deadline)
+	if remaining < DRAIN_POLL_INTERVAL {
+		remaining = DRAIN_POLL_INTERVAL
+	}
+	err = m.stop(mc, uuid, remaining)
+	if err != nil {
+		log.Printf("[%.8s] %s\n", uuid, err.Error())
+	}
+
+	pending, err = connection.GetPendingCount()
+	if err != nil {
+		return pending, err
+	}
+
+	log.Printf("[%.8s] Drained with %d msgs left over\n", uuid, pending)
+	return pending, nil
+}
+
+// Stops the passed in connection if it is running, then deletes it and all its msgs
+func (m *ConnectionManager) Delete(connection *store.Connection, timeout time.Duration) error {
+	mc := m.manage(connection.Uuid)
+	mc.lifecycle.Lock()
+	defer mc.lifecycle.Unlock()
+
+	if mc.engine != nil {
+		err := m.stop(mc, connection.Uuid, timeout)
+		if err != nil {
+			log.Printf("[%.8s] %s, deleting anyway\n", connection.Uuid, err.Error())
+		}
+	}
+
+	m.mutex.Lock()
+	delete(m.connections, connection.Uuid)
+	m.mutex.Unlock()
+
+	return connection.Delete()
+}
+
+// Stops all our connections at once, waiting at most timeout for their in-flight msgs. Returns the
+// uuids of the connections whose workers hadn't all finished by then.
+func (m *ConnectionManager) StopAll(timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+
+	unstopped := make([]string, 0)
+	unstoppedMutex := sync.Mutex{}
+
+	wg := sync.WaitGroup{}
+	for _, uuid := range m.Uuids() {
+		wg.Add(1)
+		go func(uuid string) {
+			defer wg.Done()
+
+			state, _ := m.State(uuid)
+			if state == STATE_STOPPED || state == STATE_FAILED {
+				return
+			}
+
+			err := m.Stop(uuid, time.Until(deadline))
+			if err != nil {
+				log.Printf("[%.8s] %s, they will be reconciled once their leases expire\n", uuid, err.Error())
+
+				unstoppedMutex.Lock()
+				unstopped = append(unstopped, uuid)
+				unstoppedMutex.Unlock()
+			}
+		}(uuid)
+	}
+	wg.Wait()
+
+	sort.Strings(unstopped)
+	return unstopped
+}
+
+// returns the connection with the passed in uuid, creating it as stopped if we don't have it
+func (m *ConnectionManager) manage(uuid string) *managedConnection {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mc, exists := m.connections[uuid]
+	if !exists {
+		mc = &managedConnection{state: STATE_STOPPED}
+		m.connections[uuid] = mc
+	}
+	return mc
+}
+
+// returns the connection with the passed in uuid, erroring if we don't have it
+func (m *ConnectionManager) managed(uuid string) (*managedConnection, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	mc, exists := m.connections[uuid]
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("No connection with uuid: %s", uuid))
+	}
+	return mc, nil
+}
+
+func (m *ConnectionManager) setState(mc *managedConnection, state string, engine *ConnectionEngine, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mc.state = state
+	mc.engine = engine
+	mc.err = err
+}
+
+// creates and starts the engine for the passed in connection, must be called holding its lifecycle lock
+func (m *ConnectionManager) start(mc *managedConnection, connection *store.Connection) error {
+	m.setState(mc, STATE_STARTING, nil, nil)
+
+	engine, err := NewConnectionEngine(m.store, connection)
+	if err != nil {
+		m.setState(mc, STATE_FAILED, nil, err)
+		return err
+	}
+
+	engine.Start()
+	m.setState(mc, STATE_STARTING, engine, nil)
+
+	outgoing, incoming, scheduled, err := engine.AddPendingMsgsFromDB()
+	if err != nil {
+		engine.Stop()
+		m.setState(mc, STATE_FAILED, nil, err)
+		return err
+	}
+
+	state := STATE_RUNNING
+	if connection.Paused {
+		state = STATE_PAUSED
+	}
+
+	m.setState(mc, state, engine, nil)
+	log.Printf("[%.8s] Started %s with %d queued outgoing, %d queued incoming, %d scheduled\n",
+		connection.Uuid, state, outgoing, incoming, scheduled)
+	return nil
+}
+
+// stops the engine of the passed in connection, must be called holding its lifecycle lock
+func (m *ConnectionManager) stop(mc *managedConnection, uuid string, timeout time.Duration) error {
+	engine := mc.engine
+	if engine == nil {
+		return errors.New(fmt.Sprintf("Connection %s is already %s", uuid, mc.state))
+	}
+
+	// nobody can get our engine once we are stopped, so nothing new is sent while we wait
+	m.setState(mc, STATE_STOPPED, nil, nil)
+
+	err := engine.StopWithin(timeout)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[%.8s] Stopped\n", uuid)
+	return nil
+}
@@ -0,0 +1,418 @@
+package engine_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/junebug/engine"
+	"github.com/nyaruka/junebug/store"
+)
+
+func createEchoConnection(t *testing.T, s store.Store) *store.Connection {
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "echo", "config": {"pause": "0"}},
+		"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func assertState(t *testing.T, manager *engine.ConnectionManager, uuid string, expected string) {
+	state, _ := manager.State(uuid)
+	if state != expected {
+		t.Errorf("Expected connection to be %s, was %s", expected, state)
+	}
+
+	_, err := manager.Get(uuid)
+	if running := expected == engine.STATE_RUNNING || expected == engine.STATE_PAUSED; running != (err == nil) {
+		t.Errorf("Expected engine to be available only while running or paused, got: %v", err)
+	}
+}
+
+func TestConnectionManager(t *testing.T) {
+	s := store.NewMemoryStore()
+	manager := engine.NewConnectionManager(s)
+
+	conn := createEchoConnection(t, s)
+	err := manager.Add(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_RUNNING)
+
+	err = manager.Stop(conn.Uuid, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_STOPPED)
+
+	if manager.Stop(conn.Uuid, time.Second) == nil {
+		t.Error("Expected error stopping a stopped connection")
+	}
+
+	err = manager.Start(conn.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_RUNNING)
+
+	if manager.Start(conn.Uuid) == nil {
+		t.Error("Expected error starting a running connection")
+	}
+
+	err = manager.Restart(conn.Uuid, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_RUNNING)
+
+	// paused connections stay paused across restarts
+	err = manager.Pause(conn.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_PAUSED)
+
+	err = manager.Restart(conn.Uuid, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_PAUSED)
+
+	err = manager.Resume(conn.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_RUNNING)
+
+	stored, err := store.ConnectionFromUuid(s, conn.Uuid)
+	if err != nil || stored.Paused {
+		t.Errorf("Expected stored connection to be resumed, got: %v", err)
+	}
+
+	// our running engine's connection is read without our lock, so pausing leaves it be and our
+	// dispatcher tracks it instead
+	running, _ := manager.Get(conn.Uuid)
+	started := *running.Connection
+	manager.Pause(conn.Uuid)
+	if running.Connection.Paused != started.Paused || !running.Dispatcher.IsPaused() {
+		t.Error("Expected only our dispatcher to be marked paused")
+	}
+	stored, _ = store.ConnectionFromUuid(s, conn.Uuid)
+	if !stored.Paused {
+		t.Error("Expected stored connection to be paused")
+	}
+	manager.Resume(conn.Uuid)
+
+	// connections whose config is no longer valid fail to start
+	conn.Senders.Type = "carrier-pigeon"
+	conn.Save()
+	err = manager.Restart(conn.Uuid, time.Second)
+	if err == nil {
+		t.Error("Expected error restarting invalid connection")
+	}
+	state, err := manager.State(conn.Uuid)
+	if state != engine.STATE_FAILED || err == nil {
+		t.Errorf("Expected connection to have failed, was %s", state)
+	}
+
+	// we start everything in our store, but carry on past connections that fail
+	other := createEchoConnection(t, s)
+	other.Save()
+
+	manager = engine.NewConnectionManager(s)
+	err = manager.StartAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, manager, other.Uuid, engine.STATE_RUNNING)
+	assertState(t, manager, conn.Uuid, engine.STATE_FAILED)
+
+	err = manager.Delete(other, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manager.Uuids()) != 1 {
+		t.Errorf("Expected only our failed connection to remain, got %v", manager.Uuids())
+	}
+	if _, err = store.ConnectionFromUuid(s, other.Uuid); err == nil {
+		t.Error("Expected deleted connection to be gone from our store")
+	}
+
+	manager.StopAll(time.Second)
+}
+
+func TestDrain(t *testing.T) {
+	s := store.NewMemoryStore()
+	manager := engine.NewConnectionManager(s)
+
+	// our echo gets sent back to us, but our receiver can't hand it off so it is left over
+	conn := createEchoConnection(t, s)
+	conn.Paused = true
+	err := manager.Add(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running, _ := manager.Get(conn.Uuid)
+	msg, err := store.MsgFromJson(s, strings.NewReader(`{"address": "+250788383383", "text": "Hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.ConnUuid = conn.Uuid
+	_, _, err = running.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Release()
+
+	leftover, err := manager.Drain(conn.Uuid, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leftover != 1 {
+		t.Errorf("Expected only our echo to be left over, got %d", leftover)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_STOPPED)
+
+	status, _ := conn.GetStatus()
+	if status.SentResults != 1 {
+		t.Errorf("Expected our paused msg to be sent while draining, got %d sent", status.SentResults)
+	}
+
+	pending, _ := conn.GetPendingMsgs()
+	if len(*pending) != 1 {
+		t.Errorf("Expected one pending msg to export, got %d", len(*pending))
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	s := store.NewMemoryStore()
+	manager := engine.NewConnectionManager(s)
+
+	conn := createEchoConnection(t, s)
+	err := manager.Add(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid config is rejected and we carry on as we were
+	invalid, _ := conn.Patch(strings.NewReader(`{"senders": {"type": "carrier-pigeon"}}`))
+	if manager.Update(invalid, time.Second) == nil {
+		t.Error("Expected error updating connection with invalid sender type")
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_RUNNING)
+
+	// as is changing the sender type of a running connection
+	retyped, _ := conn.Patch(strings.NewReader(`{"senders": {"type": "twitter", "config": {"access_token": "token", "access_token_secret": "secret"}}}`))
+	if manager.Update(retyped, time.Second) == nil {
+		t.Error("Expected error changing the sender type of a running connection")
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_RUNNING)
+
+	// msgs queued while we are paused are carried over to our new engine
+	manager.Pause(conn.Uuid)
+	conn, _ = store.ConnectionFromUuid(s, conn.Uuid)
+
+	running, _ := manager.Get(conn.Uuid)
+	msg, err := store.MsgFromJson(s, strings.NewReader(`{"address": "+250788383383", "text": "Hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.ConnUuid = conn.Uuid
+	running.Send(msg)
+	msg.Release()
+
+	updated, err := conn.Patch(strings.NewReader(`{"senders": {"count": 3}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Update(updated, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_PAUSED)
+
+	replaced, _ := manager.Get(conn.Uuid)
+	if replaced == running || len(replaced.Senders) != 3 {
+		t.Errorf("Expected a new engine with 3 senders, got %d", len(replaced.Senders))
+	}
+
+	// our old engine was stopped rather than left running alongside
+	select {
+	case <-running.Dispatcher.Done:
+	default:
+		t.Error("Expected our old engine to be stopped")
+	}
+	stored, _ := store.ConnectionFromUuid(s, conn.Uuid)
+	if stored.Senders.Count != 3 || !stored.Paused {
+		t.Errorf("Expected updated config to be saved, got: %+v", stored)
+	}
+
+	status, _ := replaced.GetStatus()
+	if status.OutgoingQueued != 1 {
+		t.Errorf("Expected our msg to still be queued, got %d", status.OutgoingQueued)
+	}
+
+	manager.StopAll(time.Second)
+}
+
+func TestStopAll(t *testing.T) {
+	s := store.NewMemoryStore()
+	manager := engine.NewConnectionManager(s)
+
+	idle := createEchoConnection(t, s)
+	err := manager.Add(idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// this one's sender is still busy sending when we stop
+	busy, _ := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "echo", "config": {"pause": "3"}},
+		"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`))
+	err = manager.Add(busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running, _ := manager.Get(busy.Uuid)
+	msg, _ := store.MsgFromJson(s, strings.NewReader(`{"address": "+250788383383", "text": "Hello"}`))
+	msg.ConnUuid = busy.Uuid
+	_, _, err = running.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Release()
+
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		status, _ := busy.GetStatus()
+		if status.InFlight == 1 {
+			break
+		}
+	}
+
+	// we give up on our busy connection at our deadline, rather than waiting on its sender
+	started := time.Now()
+	unstopped := manager.StopAll(200 * time.Millisecond)
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Expected StopAll to return at its deadline, took %s", elapsed)
+	}
+	if len(unstopped) != 1 || unstopped[0] != busy.Uuid {
+		t.Errorf("Expected only our busy connection to not have stopped, got %v", unstopped)
+	}
+	assertState(t, manager, idle.Uuid, engine.STATE_STOPPED)
+	assertState(t, manager, busy.Uuid, engine.STATE_STOPPED)
+
+	// stopping again has nothing left to wait on
+	if unstopped = manager.StopAll(time.Second); len(unstopped) != 0 {
+		t.Errorf("Expected nothing left to stop, got %v", unstopped)
+	}
+}
+
+func TestDrainScheduled(t *testing.T) {
+	s := store.NewMemoryStore()
+	manager := engine.NewConnectionManager(s)
+
+	conn := createEchoConnection(t, s)
+	err := manager.Add(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running, _ := manager.Get(conn.Uuid)
+	msg, err := store.MsgFromJson(s, strings.NewReader(`{"address": "+250788383383", "text": "Later", "send_at": "2099-01-01T00:00:00Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.ConnUuid = conn.Uuid
+	_, _, err = running.Send(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := msg.Id
+	msg.Release()
+
+	// draining can't send our scheduled msg so doesn't wait on it, but it is still left over
+	started := time.Now()
+	leftover, err := manager.Drain(conn.Uuid, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Expected drain not to wait on scheduled msgs, took %s", elapsed)
+	}
+	if leftover != 1 {
+		t.Errorf("Expected our scheduled msg to be left over, got %d", leftover)
+	}
+	assertState(t, manager, conn.Uuid, engine.STATE_STOPPED)
+
+	// and it is exported with our other unfinished msgs
+	pending, _ := conn.GetPendingMsgs()
+	if len(*pending) != 1 || (*pending)[0] != id {
+		t.Errorf("Expected our scheduled msg to be pending, got %v", *pending)
+	}
+}
+
+func TestOrderedRestart(t *testing.T) {
+	s := store.NewMemoryStore()
+	manager := engine.NewConnectionManager(s)
+	defer manager.StopAll(5 * time.Second)
+
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "echo", "config": {"pause": "0"}},
+		"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}, "ordered": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Add(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Stop(conn.Uuid, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// while we were stopped, one msg errored and waits to be retried, and another was left in flight
+	// by a sender that is gone
+	ids := make([]uint64, 4)
+	for i, address := range []string{"+250788000001", "+250788000002", "+250788000001", "+250788000002"} {
+		msg := store.MsgFromText(s, conn.Uuid, address, "Hello")
+		err = msg.WriteToOutbox()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = msg.Id
+
+		switch i {
+		case 0:
+			msg.MarkWired("otherhost:1/abc/0", time.Now().Add(time.Minute))
+			err = msg.MarkErrored("Errored", time.Now().Add(1500*time.Millisecond))
+		case 1:
+			err = msg.MarkWired("otherhost:1/abc/0", time.Now().Add(1500*time.Millisecond))
+		}
+		msg.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = manager.Start(conn.Uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the newer msgs in our outbox wait on the older ones to their addresses rather than overtaking them
+	finished := make([]time.Time, 4)
+	for i, id := range ids {
+		msg := waitForStatus(t, s, conn, id, store.STATUS_DELIVERED, 5*time.Second)
+		finished[i] = msg.Finished
+		msg.Release()
+	}
+	if finished[2].Before(finished[0]) {
+		t.Errorf("Expected msg behind our retry to wait for it, was sent %s before it", finished[0].Sub(finished[2]))
+	}
+	if finished[3].Before(finished[1]) {
+		t.Errorf("Expected msg behind our orphaned msg to wait for it, was sent %s before it", finished[1].Sub(finished[3]))
+	}
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"github.com/nyaruka/junebug/disp"
+	"github.com/nyaruka/junebug/store"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Transports register themselves here, by type name, in their init() functions. Each
+// registration carries the schema of the config the transport expects, which is used to
+// validate connections before the transport's factory is ever called.
+
+const FIELD_STRING = "string"
+const FIELD_INTEGER = "integer"
+
+// A single config field a transport accepts, all config values are passed as strings
+type ConfigField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+}
+
+type SenderFactory func(id int, s store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (disp.MsgSender, error)
+type ReceiverFactory func(id int, s store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (disp.MsgReceiver, error)
+type ListenerFactory func(s store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (disp.MsgListener, error)
+
+// A transport that can send (and possibly receive) msgs for a connection, delivery is one of
+// DELIVERY_AT_LEAST_ONCE or DELIVERY_AT_MOST_ONCE
+type SenderType struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Delivery    string        `json:"delivery"`
+	Config      []ConfigField `json:"config"`
+	factory     SenderFactory
+
+	// only set for sender types with a single listener per connection for incoming msgs
+	listener    ListenerFactory
+}
+
+// A transport that passes on incoming msgs for a connection
+type ReceiverType struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Config      []ConfigField `json:"config"`
+	factory     ReceiverFactory
+}
+
+var registryMutex sync.RWMutex
+var senderTypes = make(map[string]*SenderType)
+var receiverTypes = make(map[string]*ReceiverType)
+
+// Registers a sender type, this should be called from the init() of the transport
+func RegisterSender(name string, description string, delivery string, config []ConfigField, factory SenderFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, exists := senderTypes[name]; exists {
+		panic("Sender type registered twice: " + name)
+	}
+	if delivery != DELIVERY_AT_LEAST_ONCE && delivery != DELIVERY_AT_MOST_ONCE {
+		panic("Sender type registered with invalid delivery: " + name)
+	}
+	senderTypes[name] = &SenderType{Name: name, Description: description, Delivery: delivery, Config: config, factory: factory}
+}
+
+// Registers a listener for an already registered sender type, connections with that sender
+// type get one listener taking in their incoming msgs, however many senders they have
+func RegisterListener(senderName string, factory ListenerFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	senderType, exists := senderTypes[senderName]
+	if !exists {
+		panic("Listener registered for unknown sender type: " + senderName)
+	}
+	if senderType.listener != nil {
+		panic("Listener registered twice: " + senderName)
+	}
+	senderType.listener = factory
+}
+
+// Registers a receiver type, this should be called from the init() of the transport
+func RegisterReceiver(name string, description string, config []ConfigField, factory ReceiverFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if _, exists := receiverTypes[name]; exists {
+		panic("Receiver type registered twice: " + name)
+	}
+	receiverTypes[name] = &ReceiverType{Name: name, Description: description, Config: config, factory: factory}
+}
+
+// Returns all our registered sender types, sorted by name
+func SenderTypes() []*SenderType {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	types := make([]*SenderType, 0, len(senderTypes))
+	for _, t := range senderTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
+
+// Returns all our registered receiver types, sorted by name
+func ReceiverTypes() []*ReceiverType {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	types := make([]*ReceiverType, 0, len(receiverTypes))
+	for _, t := range receiverTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
+
+func getSenderType(name string) (*SenderType, error) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	t, exists := senderTypes[name]
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("Unsupported sender type: `%s`", name))
+	}
+	return t, nil
+}
+
+func getReceiverType(name string) (*ReceiverType, error) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	t, exists := receiverTypes[name]
+	if !exists {
+		return nil, errors.New(fmt.Sprintf("Unsupported receiver type: `%s`", name))
+	}
+	return t, nil
+}
+
+// Checks the passed in config against the passed in schema
+func validateConfig(kind string, fields []ConfigField, config map[string]string) error {
+	for _, field := range fields {
+		value := config[field.Name]
+		if value == "" {
+			if field.Required {
+				return errors.New(fmt.Sprintf("Missing required %s config field `%s`", kind, field.Name))
+			}
+			continue
+		}
+
+		if field.Type == FIELD_INTEGER {
+			_, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.New(fmt.Sprintf("%s config field `%s` must be an integer, was: %s", kind, field.Name, value))
+			}
+		}
+	}
+	return nil
+}
+
+// Validates the sender and receiver config of the passed in connection against the schemas
+// of their types
+func ValidateConnection(conn *store.Connection) error {
+	senderType, err := getSenderType(conn.Senders.Type)
+	if err != nil {
+		return err
+	}
+
+	err = validateConfig("Sender", senderType.Config, conn.Senders.Config)
+	if err != nil {
+		return err
+	}
+
+	return ValidateReceivers(conn)
+}
+
+// Validates just the receiver config of the passed in connection, for when we don't know all our
+// sender config yet
+func ValidateReceivers(conn *store.Connection) error {
+	receiverType, err := getReceiverType(conn.Receivers.Type)
+	if err != nil {
+		return err
+	}
+
+	return validateConfig("Receiver", receiverType.Config, conn.Receivers.Config)
+}
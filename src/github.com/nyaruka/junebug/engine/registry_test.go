@@ -0,0 +1,100 @@
+package engine_test
+
+import (
+	"github.com/nyaruka/junebug/engine"
+	"github.com/nyaruka/junebug/store"
+	"strings"
+	"testing"
+)
+
+func TestRegisteredTypes(t *testing.T) {
+	senders := make(map[string]string)
+	for _, senderType := range engine.SenderTypes() {
+		senders[senderType.Name] = senderType.Delivery
+	}
+
+	deliveries := map[string]string{
+		"echo":    engine.DELIVERY_AT_LEAST_ONCE,
+		"twitter": engine.DELIVERY_AT_MOST_ONCE,
+		"smpp":    engine.DELIVERY_AT_LEAST_ONCE}
+
+	for name, delivery := range deliveries {
+		if senders[name] != delivery {
+			t.Errorf("Expected sender type `%s` to be registered with delivery `%s`, got `%s`", name, delivery, senders[name])
+		}
+	}
+
+	receivers := engine.ReceiverTypes()
+	if len(receivers) != 1 || receivers[0].Name != "http" {
+		t.Errorf("Expected only the `http` receiver type to be registered")
+	}
+}
+
+func TestValidateConnection(t *testing.T) {
+	var conn store.Connection
+	conn.Senders.Type = "smpp"
+	conn.Senders.Config = map[string]string{"host": "localhost", "port": "2775", "system_id": "junebug"}
+	conn.Receivers.Type = "http"
+	conn.Receivers.Config = map[string]string{"url": "http://localhost/receive"}
+
+	err := engine.ValidateConnection(&conn)
+	if err != nil {
+		t.Errorf("Expected valid connection, got: %s", err)
+	}
+
+	// integer fields must be integers
+	conn.Senders.Config["port"] = "abc"
+	if engine.ValidateConnection(&conn) == nil {
+		t.Error("Expected error for non-integer port")
+	}
+	conn.Senders.Config["port"] = "2775"
+
+	// required fields must be present
+	delete(conn.Receivers.Config, "url")
+	if engine.ValidateConnection(&conn) == nil {
+		t.Error("Expected error for missing url")
+	}
+	conn.Receivers.Config["url"] = "http://localhost/receive"
+
+	// and types must exist
+	conn.Senders.Type = "carrier-pigeon"
+	if engine.ValidateConnection(&conn) == nil {
+		t.Error("Expected error for unknown sender type")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	s := store.NewMemoryStore()
+
+	// twitter connections get a single listener, however many senders they have
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "twitter", "count": 3,
+		"config": {"username": "junebug", "access_token": "token", "access_token_secret": "secret"}},
+		"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Save()
+	conn.SaveCursor(engine.TWITTER_CURSOR, "1234")
+
+	ce, err := engine.NewConnectionEngine(s, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ce.Listener == nil || len(ce.Senders) != 3 {
+		t.Errorf("Expected one listener and three senders, got %v and %d", ce.Listener, len(ce.Senders))
+	}
+
+	// a cursor we can't read is an error rather than us silently starting over
+	conn.SaveCursor(engine.TWITTER_CURSOR, "abc")
+	_, err = engine.NewConnectionEngine(s, conn)
+	if err == nil {
+		t.Error("Expected error for invalid twitter cursor")
+	}
+
+	// other types don't have one
+	conn.Senders.Type = "echo"
+	ce, err = engine.NewConnectionEngine(s, conn)
+	if err != nil || ce.Listener != nil {
+		t.Errorf("Expected no listener for echo connection, got %v %v", ce, err)
+	}
+}
@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"github.com/nyaruka/junebug/disp"
+	"github.com/nyaruka/junebug/store"
+	"log"
+	"sync"
+	"time"
+)
+
+// how often we check our retry and scheduled buckets for msgs that are due
+const RETRY_INTERVAL = time.Second
+
+// Retrier watches a connection's retry buckets, queuing outgoing and incoming msgs back up
+// with our dispatcher as they become due. It also releases scheduled msgs once their
+// send_at arrives, and reconciles in flight msgs whose lease has expired.
+type Retrier struct {
+	store            store.Store
+	connection       store.Connection
+	outgoing         chan uint64
+	incoming         chan uint64
+	finished         chan uint64
+	done             chan int
+	wg               *sync.WaitGroup
+
+	// the delivery guarantee of our sender type, used when reconciling expired leases
+	delivery         string
+
+	// held while releasing or cancelling scheduled msgs, so a msg can't be both
+	scheduleMutex    *sync.Mutex
+}
+
+// Starts our retrier, this starts a goroutine that periodically checks for due msgs
+func (r Retrier) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(RETRY_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-r.done:
+				return
+			}
+
+			if !r.requeue(r.connection.GetDueRetryMsgs, (*store.Msg).MarkRequeued, r.outgoing) {
+				return
+			}
+			if !r.requeue(r.connection.GetDueInboxRetryMsgs, (*store.Msg).MarkInboxRequeued, r.incoming) {
+				return
+			}
+
+			r.scheduleMutex.Lock()
+			released := r.requeue(r.connection.GetDueScheduledMsgs, (*store.Msg).MarkReleased, r.outgoing)
+			r.scheduleMutex.Unlock()
+			if !released {
+				return
+			}
+
+			if !r.reconcileLeases() {
+				return
+			}
+		}
+	}()
+}
+
+// Requeues the msgs returned by getDue using markRequeued, then passes them to queue. Returns
+// false if we were stopped while doing so.
+func (r Retrier) requeue(getDue func(time.Time) (*[]uint64, error), markRequeued func(*store.Msg) error,
+	queue chan uint64) bool {
+
+	ids, err := getDue(time.Now())
+	if err != nil {
+		log.Printf("[%s] Error reading due msgs: %s", r.connection.Uuid, err.Error())
+		return true
+	}
+
+	for _, id := range *ids {
+		msg, err := store.MsgFromId(r.store, r.connection.Uuid, id)
+		if err != nil {
+			log.Printf("[%s] Error loading due msg (%d): %s", r.connection.Uuid, id, err.Error())
+			continue
+		}
+
+		err = markRequeued(msg)
+		msg.Release()
+		if err != nil {
+			log.Printf("[%s] Error requeuing msg (%d): %s", r.connection.Uuid, id, err.Error())
+			continue
+		}
+
+		select {
+		case queue <- id:
+		case <-r.done:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Cancels the scheduled msg with the passed in id, erroring if it has already been released
+func (r Retrier) CancelScheduled(id uint64) (*store.Msg, error) {
+	r.scheduleMutex.Lock()
+	defer r.scheduleMutex.Unlock()
+
+	msg, err := store.MsgFromId(r.store, r.connection.Uuid, id)
+	if err != nil {
+		return msg, err
+	}
+
+	err = msg.MarkCancelled()
+	if err == nil {
+		log.Printf("[%s] Cancelled scheduled msg (%d)", r.connection.Uuid, id)
+	}
+	return msg, err
+}
+
+func CreateRetrier(st store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) *Retrier {
+	// connections are validated before we are created, but be safe and resend if we can't tell
+	delivery := DELIVERY_AT_LEAST_ONCE
+	senderType, err := getSenderType(conn.Senders.Type)
+	if err == nil {
+		delivery = senderType.Delivery
+	}
+
+	return &Retrier{
+		store:            st,
+		connection:       *conn,
+		outgoing:         dispatcher.Outgoing,
+		incoming:         dispatcher.Incoming,
+		finished:         dispatcher.Finished,
+		done:             dispatcher.Done,
+		wg:               dispatcher.WaitGroup,
+		delivery:         delivery,
+		scheduleMutex:    &sync.Mutex{} }
+}
+
+// Marks the passed in msg as errored by our sender. If it has attempts left it waits in the
+// retry bucket to be sent again, otherwise it is failed. Msgs that would expire before their
+// retry are expired straight away.
+func markErrored(conn *store.Connection, msg *store.Msg, msgLog string) error {
+	retryOn, retry := conn.Retries.NextRetry(msg.Attempts)
+	if retry && msg.IsExpired(retryOn) {
+		log.Printf("[%s] Expired msg (%d) after %d attempts", conn.Uuid, msg.Id, msg.Attempts)
+		return msg.MarkExpired(msgLog)
+	}
+
+	if retry {
+		log.Printf("[%s] Errored msg (%d), retrying at %s", conn.Uuid, msg.Id, retryOn.Format(time.RFC3339))
+		return msg.MarkErrored(msgLog, retryOn)
+	}
+
+	log.Printf("[%s] Failed msg (%d) after %d attempts", conn.Uuid, msg.Id, msg.Attempts)
+	return msg.MarkFailed(msgLog)
+}
+
+// Puts the passed in msg back in our retry bucket until retryOn, when our transport told us its
+// rate limit resets. This doesn't use up one of the msg's attempts, though it may expire waiting.
+func markRateLimited(conn *store.Connection, msg *store.Msg, msgLog string, retryOn time.Time) error {
+	if msg.IsExpired(retryOn) {
+		log.Printf("[%s] Expired msg (%d) while rate limited", conn.Uuid, msg.Id)
+		return msg.MarkExpired(msgLog)
+	}
+
+	log.Printf("[%s] Rate limited msg (%d), retrying at %s", conn.Uuid, msg.Id, retryOn.Format(time.RFC3339))
+	return msg.MarkRateLimited(msgLog, retryOn)
+}
+
+// Expires the passed in msg if it is past its expires_on, returning whether it was. Senders
+// call this before sending each msg, so msgs that waited too long in our queues are dropped.
+func expireIfDue(conn *store.Connection, msg *store.Msg) bool {
+	if !msg.IsExpired(time.Now()) {
+		return false
+	}
+
+	log.Printf("[%s] Expired msg (%d) before sending, expired on %s", conn.Uuid, msg.Id, msg.ExpiresOn.Format(time.RFC3339))
+	err := msg.MarkExpired("")
+	if err != nil {
+		log.Printf("[%s] Error marking msg expired (%d): %s", conn.Uuid, msg.Id, err.Error())
+	}
+	return true
+}
+
+// Marks the passed in msg as errored by our receiver. If the error is retryable and it has
+// attempts left it waits in the inbox retry bucket to be passed on again, otherwise it is
+// dead lettered.
+func markReceiveErrored(conn *store.Connection, msg *store.Msg, msgLog string, retryable bool) error {
+	msg.Attempts++
+
+	if retryable {
+		retryOn, retry := conn.Retries.NextRetry(msg.Attempts)
+		if retry {
+			log.Printf("[%s] Errored handling msg (%d), retrying at %s", conn.Uuid, msg.Id, retryOn.Format(time.RFC3339))
+			return msg.MarkHandleErrored(msgLog, retryOn)
+		}
+	}
+
+	log.Printf("[%s] Dead lettered msg (%d) after %d attempts", conn.Uuid, msg.Id, msg.Attempts)
+	return msg.MarkDeadLettered(msgLog)
+}
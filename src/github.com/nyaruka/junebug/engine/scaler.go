@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"github.com/nyaruka/junebug/disp"
+	"github.com/nyaruka/junebug/store"
+	"log"
+	"sync"
+	"time"
+)
+
+// Scaler adds and removes the senders and receivers of an autoscaled connection as its load
+// changes, staying within the bounds of its autoscale config. Every scale interval it samples
+// its dispatcher's pools and moves each towards the number of workers they call for.
+type Scaler struct {
+	store            store.Store
+	connection       *store.Connection
+	dispatcher       *disp.Dispatcher
+	done             chan int
+	wg               *sync.WaitGroup
+
+	senderType       *SenderType
+	receiverType     *ReceiverType
+
+	// how many workers we have, and the id to give the next one of each we create
+	mutex            sync.Mutex
+	senders          int
+	receivers        int
+	nextSenderId     int
+	nextReceiverId   int
+}
+
+// Starts our scaler, this starts a goroutine that periodically rescales our workers
+func (s *Scaler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(disp.SCALE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.done:
+				return
+			}
+
+			if s.connection.Autoscale.Senders.IsEnabled() {
+				s.scale("senders", &s.senders, s.dispatcher.SampleSenders(), s.connection.Autoscale.Senders,
+					s.addSender, s.dispatcher.RetireSender)
+			}
+			if s.connection.Autoscale.Receivers.IsEnabled() {
+				s.scale("receivers", &s.receivers, s.dispatcher.SampleReceivers(), s.connection.Autoscale.Receivers,
+					s.addReceiver, s.dispatcher.RetireReceiver)
+			}
+		}
+	}()
+}
+
+// Returns how many senders and receivers we have right now
+func (s *Scaler) Workers() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.senders, s.receivers
+}
+
+// moves the passed in count of workers towards what the passed in sample calls for
+func (s *Scaler) scale(kind string, workers *int, sample disp.PoolSample, bounds store.ScaleBounds,
+	add func() error, retire func()) {
+
+	s.mutex.Lock()
+	current := *workers
+	s.mutex.Unlock()
+
+	target := sample.Target(current, bounds)
+	if target == current {
+		return
+	}
+
+	for count := current; count < target; count++ {
+		err := add()
+		if err != nil {
+			log.Printf("[%s] Error adding to our %s: %s", s.connection.Uuid, kind, err.Error())
+			target = count
+			break
+		}
+	}
+	for count := current; count > target; count-- {
+		retire()
+	}
+
+	s.mutex.Lock()
+	*workers = target
+	s.mutex.Unlock()
+
+	log.Printf("[%s] Scaled %s from %d to %d, %d queued, %d idle, %d handled, %d errored, %s average latency",
+		s.connection.Uuid, kind, current, target, sample.Queued, sample.Idle, sample.Handled, sample.Errored,
+		sample.Latency.Round(time.Millisecond))
+}
+
+func (s *Scaler) addSender() error {
+	sender, err := s.senderType.factory(s.nextSenderId, s.store, s.connection, s.dispatcher)
+	if err != nil {
+		return err
+	}
+	s.nextSenderId++
+
+	sender.Start()
+	return nil
+}
+
+func (s *Scaler) addReceiver() error {
+	receiver, err := s.receiverType.factory(s.nextReceiverId, s.store, s.connection, s.dispatcher)
+	if err != nil {
+		return err
+	}
+	s.nextReceiverId++
+
+	receiver.Start()
+	return nil
+}
+
+func CreateScaler(st store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) *Scaler {
+	// connections are validated before we are created
+	senderType, _ := getSenderType(conn.Senders.Type)
+	receiverType, _ := getReceiverType(conn.Receivers.Type)
+
+	return &Scaler{
+		store:            st,
+		connection:       conn,
+		dispatcher:       dispatcher,
+		done:             dispatcher.Done,
+		wg:               dispatcher.WaitGroup,
+		senderType:       senderType,
+		receiverType:     receiverType,
+		senders:          int(conn.Senders.Count),
+		receivers:        int(conn.Receivers.Count),
+		nextSenderId:     int(conn.Senders.Count),
+		nextReceiverId:   int(conn.Receivers.Count) }
+}
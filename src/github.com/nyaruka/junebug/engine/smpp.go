@@ -0,0 +1,388 @@
+package engine
+
+import (
+	"github.com/nyaruka/junebug/codec"
+	"github.com/nyaruka/junebug/disp"
+	"github.com/nyaruka/junebug/smpp"
+	"github.com/nyaruka/junebug/store"
+	"log"
+	"fmt"
+	"sync"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const SMPP_HOST = "host"
+const SMPP_PORT = "port"
+const SMPP_SYSTEM_ID = "system_id"
+const SMPP_PASSWORD = "password"
+const SMPP_SYSTEM_TYPE = "system_type"
+const SMPP_SOURCE = "source"
+const SMPP_ENQUIRE_LINK = "enquire_link"
+
+func init() {
+	RegisterSender("smpp", "Sends and receives SMS over SMPP 3.4 transceiver binds", DELIVERY_AT_LEAST_ONCE, []ConfigField{
+		{SMPP_HOST, FIELD_STRING, true, "The hostname of the SMSC"},
+		{SMPP_PORT, FIELD_INTEGER, true, "The port of the SMSC"},
+		{SMPP_SYSTEM_ID, FIELD_STRING, true, "The system id to bind with"},
+		{SMPP_PASSWORD, FIELD_STRING, false, "The password to bind with"},
+		{SMPP_SYSTEM_TYPE, FIELD_STRING, false, "The system type to bind with"},
+		{SMPP_SOURCE, FIELD_STRING, false, "The source address for outgoing msgs"},
+		{SMPP_ENQUIRE_LINK, FIELD_INTEGER, false, "How many seconds between enquire links, defaults to 30"},
+	}, func(id int, s store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (disp.MsgSender, error) {
+		return CreateSmppSender(id, s, conn, dispatcher)
+	})
+}
+
+const RECEIPT_ATTEMPTS = 5
+const RECEIPT_RETRY_DELAY = time.Second
+
+// how long we wait for all the segments of a concatenated MO before giving up on it
+const MULTIPART_TIMEOUT = 5 * time.Minute
+
+// the reassemblers of our running connections, by their dispatcher's done channel. All the binds of
+// a connection share one, as the SMSC can deliver the segments of a single MO on different binds.
+var smppReassemblers = make(map[chan int]*codec.Reassembler)
+var smppReassemblersMutex sync.Mutex
+
+// SmppSender sends messages over its own SMPP transceiver bind, any messages delivered
+// to us by the SMSC on that bind are written to our inbox.
+//
+// It is an implementation of MsgSender
+type SmppSender struct {
+	id               int
+	store            store.Store
+	connection       store.Connection
+	readySenders     chan disp.MsgSender
+	pendingMsg       chan uint64
+	incoming         chan uint64
+	done             chan int
+	stop             chan int
+	wg               *sync.WaitGroup
+	recordSend       func(time.Time, error)
+
+	client           *smpp.Client
+	source           string
+	reassembler      *codec.Reassembler
+}
+
+func (s SmppSender) Send(id uint64) {
+	s.pendingMsg <- id
+}
+
+func (s SmppSender) Id() int {
+	return s.id
+}
+
+// Stops just this sender, unbinding from our SMSC once we've finished with any msg we are sending
+func (s SmppSender) Stop() {
+	close(s.stop)
+}
+
+// Starts our sender, this binds to our SMSC and starts our sending and receiving goroutines
+func (s SmppSender) Start() {
+	s.reassembler = connectionReassembler(s.done)
+	s.client.Start()
+
+	// this is our sending thread
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.client.Stop()
+		var id uint64
+
+		for {
+			// mark ourselves as ready for work, this never blocks
+			s.readySenders <- s
+
+			// wait for a job to come in, or for us to be shut down
+			select {
+			case id = <-s.pendingMsg:
+			case <-s.done:
+				return
+			case <-s.stop:
+				return
+			}
+
+			// load our msg
+			msg, err := store.MsgFromId(s.store, s.connection.Uuid, id)
+			if err != nil {
+				log.Printf("[%s][%d] Error loading msg (%d): %s", s.connection.Uuid, s.id, id, err.Error())
+				continue
+			}
+
+			// drop it if it expired while waiting to be sent
+			if expireIfDue(&s.connection, msg) {
+				msg.Release()
+				continue
+			}
+
+			// mark it as handed to our SMSC
+			err = markWired(&s.connection, s.id, msg)
+			if err != nil {
+				log.Printf("[%s][%d] Error marking msg wired (%d): %s", s.connection.Uuid, s.id, id, err.Error())
+			}
+
+			// long msgs are sent as several concatenated segments
+			segments, err := codec.Split(msg.Text, byte(msg.Id))
+			if err != nil {
+				err = msg.MarkFailed(fmt.Sprintf("[%s][%d] Unable to send msg (%d): %s", s.connection.Uuid, s.id, id, err.Error()))
+			} else {
+				var smscId string
+				started := time.Now()
+				smscId, err = s.submit(msg, segments)
+				s.recordSend(started, err)
+				if err != nil {
+					err = markErrored(&s.connection, msg, fmt.Sprintf("[%s][%d] Error sending msg (%d): %s", s.connection.Uuid, s.id, id, err.Error()))
+				} else {
+					err = msg.MarkSent(smscId, fmt.Sprintf("[%s][%d] Submitted %d segment(s), SMSC id: %s", s.connection.Uuid, s.id, len(segments), smscId))
+					log.Printf("[%s][%d] Sent msg (%d)", s.connection.Uuid, s.id, id)
+				}
+			}
+
+			if err != nil {
+				log.Printf("[%s][%d] Error saving msg status (%d): %s", s.connection.Uuid, s.id, id, err.Error())
+			}
+			endLease(&s.connection, msg)
+
+			// release our message back to the pool
+			msg.Release()
+		}
+	}()
+
+	// this is our receiving thread
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		var sm *smpp.ShortMessage
+
+		for {
+			// wait for the SMSC to deliver something to us
+			select {
+			case sm = <-s.client.Delivered:
+			case <-s.done:
+				return
+			case <-s.stop:
+				return
+			}
+
+			// delivery receipts update the msg they are for, they aren't new msgs
+			if sm.IsReceipt() {
+				s.wg.Add(1)
+				go s.handleReceipt(sm.Receipt())
+				continue
+			}
+
+			// segments of concatenated MOs wait here until we have them all
+			text, complete := s.decodeMO(sm)
+			if !complete {
+				continue
+			}
+
+			log.Printf("[%s][%d] Received MO from %s: %s", s.connection.Uuid, s.id, sm.Source, text)
+
+			// create a new msg from our MO
+			msg := store.MsgFromText(s.store, s.connection.Uuid, sm.Source, text)
+			err := msg.WriteToInbox()
+			if err != nil {
+				log.Printf("[%s][%d] Error saving MO from %s: %s", s.connection.Uuid, s.id, sm.Source, err.Error())
+				msg.Release()
+				continue
+			}
+
+			// pass our message to be received
+			select {
+			case s.incoming <- msg.Id:
+			case <-s.done:
+				msg.Release()
+				return
+			}
+
+			// release our message back to the pool
+			msg.Release()
+		}
+	}()
+}
+
+// Submits the segments of the passed in msg, returning the SMSC id of the last. We only ask for a
+// receipt for the last segment, its delivery is what tells us the whole msg was delivered.
+func (s SmppSender) submit(msg *store.Msg, segments []*codec.Segment) (string, error) {
+	var smscId string
+	var err error
+
+	for i, segment := range segments {
+		sm := &smpp.ShortMessage{
+			Source:      s.source,
+			Destination: msg.Address,
+			DataCoding:  smpp.DATA_CODING_DEFAULT,
+			Message:     segment.Bytes()}
+
+		if segment.Encoding == codec.ENCODING_UCS2 {
+			sm.DataCoding = smpp.DATA_CODING_UCS2
+		}
+		if len(segment.Header) > 0 {
+			sm.EsmClass = smpp.ESM_CLASS_UDHI
+		}
+		if i == len(segments)-1 {
+			sm.RegisteredDelivery = smpp.REGISTERED_DELIVERY_RECEIPT
+		}
+
+		// let the SMSC drop it too if it can't deliver it before it expires
+		if !msg.ExpiresOn.IsZero() {
+			sm.ValidityPeriod = smpp.FormatRelativeTime(time.Until(msg.ExpiresOn))
+		}
+
+		smscId, err = s.client.Submit(sm)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return smscId, nil
+}
+
+// Decodes the text of the passed in MO. If it is a segment of a concatenated msg we hold onto it,
+// returning false, until all its segments have arrived.
+func (s SmppSender) decodeMO(sm *smpp.ShortMessage) (string, bool) {
+	payload := sm.Message
+
+	if sm.EsmClass&smpp.ESM_CLASS_UDHI != 0 {
+		concat, userData, err := codec.ParseUDH(sm.Message)
+		if err != nil {
+			log.Printf("[%s][%d] Error parsing UDH of MO from %s, ignoring it: %s", s.connection.Uuid, s.id, sm.Source, err.Error())
+		} else if concat != nil {
+			var complete bool
+			payload, complete = s.reassembler.Add(sm.Source, concat, userData)
+			if !complete {
+				return "", false
+			}
+		} else {
+			payload = userData
+		}
+	}
+
+	switch sm.DataCoding {
+	case smpp.DATA_CODING_DEFAULT:
+		return codec.DecodeGSM7(payload), true
+	case smpp.DATA_CODING_UCS2:
+		return codec.DecodeUCS2(payload), true
+	case smpp.DATA_CODING_LATIN1:
+		runes := make([]rune, len(payload))
+		for i, b := range payload {
+			runes[i] = rune(b)
+		}
+		return string(runes), true
+	default:
+		return string(payload), true
+	}
+}
+
+// Updates the status of the msg the passed in receipt is for. Receipts can beat our sending thread
+// to recording the SMSC id on a msg, so we try a few times before giving up on finding it.
+func (s SmppSender) handleReceipt(receipt *smpp.Receipt) {
+	defer s.wg.Done()
+
+	for attempt := 0; attempt < RECEIPT_ATTEMPTS; attempt++ {
+		msg, err := store.MsgFromExternalId(s.store, s.connection.Uuid, receipt.MessageId)
+		if err != nil {
+			select {
+			case <-time.After(RECEIPT_RETRY_DELAY):
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		msgLog := fmt.Sprintf("[%s][%d] Receipt: %s", s.connection.Uuid, s.id, receipt)
+		if receipt.Delivered() {
+			err = msg.MarkDelivered(msgLog)
+		} else if receipt.Stat == smpp.STAT_EXPIRED {
+			err = msg.MarkExpired(msgLog)
+		} else if receipt.Failed() {
+			err = msg.MarkFailed(msgLog)
+		} else {
+			log.Printf("[%s][%d] Ignoring non-final receipt for msg (%d): %s", s.connection.Uuid, s.id, msg.Id, receipt)
+		}
+
+		if err != nil {
+			log.Printf("[%s][%d] Error saving receipt for msg (%d): %s", s.connection.Uuid, s.id, msg.Id, err.Error())
+		}
+
+		msg.Release()
+		return
+	}
+
+	log.Printf("[%s][%d] No msg found for receipt: %s", s.connection.Uuid, s.id, receipt)
+}
+
+func CreateSmppSender(id int, st store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (s *SmppSender, err error) {
+	sender := SmppSender{
+		id:               id,
+		store:            st,
+		connection:       *conn,
+		readySenders:     dispatcher.Senders,
+		incoming:         dispatcher.Incoming,
+		pendingMsg:       make(chan uint64),
+		done:             dispatcher.Done,
+		stop:             make(chan int),
+		wg:               dispatcher.WaitGroup,
+		recordSend:       dispatcher.RecordSend }
+
+	host := conn.Senders.Config[SMPP_HOST]
+	if host == "" {
+		return s, errors.New("Missing required config field `host`")
+	}
+
+	port, err := strconv.ParseUint(conn.Senders.Config[SMPP_PORT], 10, 16)
+	if err != nil || port == 0 {
+		return s, errors.New("Config field `port` must be a valid port number")
+	}
+
+	bind := smpp.Bind{
+		SystemId:   conn.Senders.Config[SMPP_SYSTEM_ID],
+		Password:   conn.Senders.Config[SMPP_PASSWORD],
+		SystemType: conn.Senders.Config[SMPP_SYSTEM_TYPE]}
+
+	if bind.SystemId == "" {
+		return s, errors.New("Missing required config field `system_id`")
+	}
+
+	// how often we check our bind is alive, zero means the default
+	enquireLink := int64(0)
+	if conn.Senders.Config[SMPP_ENQUIRE_LINK] != "" {
+		enquireLink, err = strconv.ParseInt(conn.Senders.Config[SMPP_ENQUIRE_LINK], 10, 32)
+		if err != nil || enquireLink < 0 {
+			return s, errors.New("Config field `enquire_link` must be 0 or a positive integer")
+		}
+	}
+
+	sender.source = conn.Senders.Config[SMPP_SOURCE]
+	sender.client = smpp.NewClient(net.JoinHostPort(host, strconv.FormatUint(port, 10)), bind,
+		time.Duration(enquireLink)*time.Second)
+
+	return &sender, nil
+}
+
+// Returns the reassembler shared by the binds of the running connection with the passed in done
+// channel, creating it for the first to start. It is forgotten once the connection is stopped.
+func connectionReassembler(done chan int) *codec.Reassembler {
+	smppReassemblersMutex.Lock()
+	defer smppReassemblersMutex.Unlock()
+
+	reassembler, found := smppReassemblers[done]
+	if !found {
+		reassembler = codec.NewReassembler(MULTIPART_TIMEOUT)
+		smppReassemblers[done] = reassembler
+
+		go func() {
+			<-done
+
+			smppReassemblersMutex.Lock()
+			delete(smppReassemblers, done)
+			smppReassemblersMutex.Unlock()
+		}()
+	}
+	return reassembler
+}
@@ -1,30 +1,84 @@
 package engine
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"github.com/nyaruka/junebug/disp"
 	"github.com/nyaruka/junebug/store"
 	"github.com/nyaruka/junebug/cfg"
 	"github.com/ChimeraCoder/anaconda"
+	"github.com/garyburd/go-oauth/oauth"
 	"log"
 	"fmt"
 	"sync"
 	"errors"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const ACCESS_TOKEN = "access_token"
 const ACCESS_TOKEN_SECRET = "access_token_secret"
 const USERNAME = "username"
 
+// the cursor holding the id of the last DM we received, so we can recover any sent to us while
+// our stream was down
+const TWITTER_CURSOR = "twitter_last_dm"
+
+// how long we wait before reconnecting a stream Twitter closed on us, doubling each time it fails
+// again up to our max, these are vars so tests don't have to wait as long
+var TWITTER_MIN_BACKOFF = 5 * time.Second
+var TWITTER_MAX_BACKOFF = 5 * time.Minute
+
+// Twitter's endpoints for its three legged OAuth flow, which we use to link accounts, tests
+// point these at a stub of Twitter
+var TWITTER_REQUEST_TOKEN_URL = "https://api.twitter.com/oauth/request_token"
+var TWITTER_AUTHORIZE_URL = "https://api.twitter.com/oauth/authorize"
+var TWITTER_ACCESS_TOKEN_URL = "https://api.twitter.com/oauth/access_token"
+
+// the endpoint we look up the account of a linked access token with
+var TWITTER_VERIFY_CREDENTIALS_URL = "https://api.twitter.com/1.1/account/verify_credentials.json"
+
+// the client we make our OAuth requests with, so a slow Twitter doesn't hang our callers
+var twitterOAuthHttp = &http.Client{Timeout: 30 * time.Second}
+
+// the endpoints we send DMs with media through, anaconda only knows the older DM API which can't
+// carry attachments
+const TWITTER_MEDIA_UPLOAD_URL = "https://upload.twitter.com/1.1/media/upload.json"
+const TWITTER_DM_EVENTS_URL = "https://api.twitter.com/1.1/direct_messages/events/new.json"
+
+// how long Twitter's rate limit windows are, we wait this long if rate limited without a reset time
+const TWITTER_RATE_LIMIT_WINDOW = 15 * time.Minute
+
+func init() {
+	RegisterSender("twitter", "Sends and receives Twitter direct messages", DELIVERY_AT_MOST_ONCE, []ConfigField{
+		{USERNAME, FIELD_STRING, false, "The username of the user sending and receiving DMs, looked up from Twitter if missing"},
+		{ACCESS_TOKEN, FIELD_STRING, true, "The access token for the user sending and receiving DMs"},
+		{ACCESS_TOKEN_SECRET, FIELD_STRING, true, "The access token secret for the user sending and receiving DMs"},
+	}, func(id int, s store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (disp.MsgSender, error) {
+		return CreateTwitterConnection(id, s, conn, dispatcher)
+	})
+
+	RegisterListener("twitter", func(s store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (disp.MsgListener, error) {
+		return CreateTwitterListener(s, conn, dispatcher)
+	})
+}
+
 type TwitterConnection struct {
 	id               int
+	store            store.Store
 	connection       store.Connection
 	readySenders     chan disp.MsgSender
 	pendingMsg       chan uint64
-	incoming         chan uint64 // for receiving out our echos
 	done             chan int
+	stop             chan int
 	wg               *sync.WaitGroup
+	recordSend       func(time.Time, error)
+	holdUntil        func(time.Time)
 
 	token            string
 	secret           string
@@ -35,15 +89,22 @@ func (t TwitterConnection) Send(id uint64) {
 	t.pendingMsg <- id
 }
 
-// Starts our sender, this starts a goroutine that blocks on receiving a message to send
+func (t TwitterConnection) Id() int {
+	return t.id
+}
+
+// Stops just this sender, once it has finished with any msg it is sending
+func (t TwitterConnection) Stop() {
+	close(t.stop)
+}
+
+// Starts our sender, this starts a goroutine that blocks on receiving a message to send. Incoming
+// DMs are taken in by our connection's TwitterListener.
 func (t TwitterConnection) Start() {
-	// todo: this doesn't need to happen for each connection
-	anaconda.SetConsumerKey(cfg.Config.Twitter.Consumer_Key)
-	anaconda.SetConsumerSecret(cfg.Config.Twitter.Consumer_Secret)
+	setTwitterConsumer()
 
-	// this is our sending thread
+	t.wg.Add(1)
 	go func() {
-		t.wg.Add(1)
 		defer t.wg.Done()
 		var id uint64
 
@@ -60,118 +121,577 @@ func (t TwitterConnection) Start() {
 			case id = <-t.pendingMsg:
 			case <- t.done:
 				return
+			case <-t.stop:
+				return
 			}
 
-			var msgLog = ""
-
 			// load our msg
-			msg, err := store.MsgFromId(t.connection.Uuid, id)
+			msg, err := store.MsgFromId(t.store, t.connection.Uuid, id)
 			if err != nil {
-				msgLog = fmt.Sprintf("[%s][%d] Error sending msg (%d): %s", t.connection.Uuid, t.id, id, err.Error())
-			} else {
-				// send the message
-				dm, err := api.PostDMToScreenName(msg.Text, msg.Address)
+				log.Printf("[%s][%d] Error loading msg (%d): %s", t.connection.Uuid, t.id, id, err.Error())
+				continue
+			}
+
+			// drop it if it expired while waiting to be sent
+			if expireIfDue(&t.connection, msg) {
+				msg.Release()
+				continue
+			}
+
+			// DMs can carry a single image, anything else will never send however often we retry
+			if !twitterCanSend(msg) {
+				log.Printf("[%s][%d] Failing msg (%d), Twitter DMs can only have one image attachment", t.connection.Uuid, t.id, id)
+				err = msg.MarkFailed(fmt.Sprintf("[%s][%d] Twitter DMs can only have one image attachment", t.connection.Uuid, t.id))
 				if err != nil {
-					msgLog = fmt.Sprintf("[%s][%d] Error sending msg (%d): %s", t.connection.Uuid, t.id, id, err.Error())
-				} else {
-					msgLog = fmt.Sprintf("[%s][%d] Sent DM, id: %d", t.connection.Uuid, t.id, dm.Id)
+					log.Printf("[%s][%d] Error saving msg status (%d): %s", t.connection.Uuid, t.id, id, err.Error())
 				}
+				msg.Release()
+				continue
 			}
 
-			// mark the message as sent
-			err = msg.MarkSent(msgLog)
+			// mark it as handed to twitter
+			err = markWired(&t.connection, t.id, msg)
 			if err != nil {
-				log.Printf("[%s][%d] Error marking msg sent (%d)", t.connection.Uuid, t.id, id)
+				log.Printf("[%s][%d] Error marking msg wired (%d): %s", t.connection.Uuid, t.id, id, err.Error())
+			}
+
+			// send the message
+			started := time.Now()
+			dmId, err := t.send(api, msg)
+			t.recordSend(started, err)
+			if limited, reset := twitterRateLimit(err); limited {
+				// stop all our senders until our limit resets, this msg waits until then too
+				t.holdUntil(reset)
+				err = markRateLimited(&t.connection, msg, fmt.Sprintf("[%s][%d] Rate limited until %s", t.connection.Uuid,
+					t.id, reset.Format(time.RFC3339)), reset)
+			} else if err != nil {
+				err = markErrored(&t.connection, msg, fmt.Sprintf("[%s][%d] Error sending msg (%d): %s", t.connection.Uuid, t.id, id, err.Error()))
 			} else {
+				err = msg.MarkSent(dmId, fmt.Sprintf("[%s][%d] Sent DM, id: %s", t.connection.Uuid, t.id, dmId))
 				log.Printf("[%s][%d] Sent msg (%d)", t.connection.Uuid, t.id, id)
 			}
 
+			if err != nil {
+				log.Printf("[%s][%d] Error saving msg status (%d): %s", t.connection.Uuid, t.id, id, err.Error())
+			}
+			endLease(&t.connection, msg)
+
 			// release our message back to the pool
 			msg.Release()
 		}
 	}()
+}
+
+// whether the passed in msg is one we can send as a DM, DMs can have at most one attachment, an image
+func twitterCanSend(msg *store.Msg) bool {
+	if len(msg.Attachments) > 1 {
+		return false
+	}
+	return len(msg.Attachments) == 0 || strings.HasPrefix(msg.Attachments[0].ContentType, "image/")
+}
+
+// Sends the passed in msg as a DM, returning the id Twitter gave it. DMs with an attachment go
+// through Twitter's DM events API, the only one which takes media.
+func (t TwitterConnection) send(api *anaconda.TwitterApi, msg *store.Msg) (string, error) {
+	if len(msg.Attachments) == 0 {
+		dm, err := api.PostDMToScreenName(msg.Text, msg.Address)
+		return dm.IdStr, err
+	}
+
+	blob, err := loadAttachment(&t.connection, msg.Attachments[0])
+	if err != nil {
+		return "", err
+	}
+
+	// upload our image, marked for use in DMs
+	form := url.Values{}
+	form.Set("media_data", base64.StdEncoding.EncodeToString(blob.Data))
+	form.Set("media_category", "dm_image")
+
+	credentials := &oauth.Credentials{Token: t.token, Secret: t.secret}
+	resp, err := twitterOAuthClient().Post(twitterOAuthHttp, credentials, TWITTER_MEDIA_UPLOAD_URL, form)
+	if err != nil {
+		return "", err
+	}
+	var media anaconda.Media
+	err = decodeTwitterResponse(resp, &media)
+	if err != nil {
+		return "", err
+	}
+
+	// the events API addresses users by their id rather than their username
+	user, err := api.GetUsersShow(msg.Address, nil)
+	if err != nil {
+		return "", err
+	}
+
+	event := map[string]interface{}{
+		"event": map[string]interface{}{
+			"type": "message_create",
+			"message_create": map[string]interface{}{
+				"target": map[string]string{"recipient_id": user.IdStr},
+				"message_data": map[string]interface{}{
+					"text": msg.Text,
+					"attachment": map[string]interface{}{
+						"type":  "media",
+						"media": map[string]string{"id": media.MediaIDString}}}}}}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", TWITTER_DM_EVENTS_URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// JSON bodies aren't part of the OAuth signature
+	err = twitterOAuthClient().SetAuthorizationHeader(req.Header, credentials, "POST", req.URL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err = twitterOAuthHttp.Do(req)
+	if err != nil {
+		return "", err
+	}
+	var created struct {
+		Event struct {
+			Id string `json:"id"`
+		} `json:"event"`
+	}
+	err = decodeTwitterResponse(resp, &created)
+	return created.Event.Id, err
+}
+
+// Decodes the JSON body of the passed in response from Twitter into result. Unsuccessful responses
+// are returned as anaconda ApiErrors, the same as anaconda's own, so we can tell when we are rate limited.
+func decodeTwitterResponse(resp *http.Response, result interface{}) error {
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &anaconda.ApiError{StatusCode: resp.StatusCode, Header: resp.Header, Body: string(body), URL: resp.Request.URL}
+		json.Unmarshal(body, &apiErr.Decoded)
+		return apiErr
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+func CreateTwitterConnection(id int, st store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (t *TwitterConnection, err error) {
+	twitter := TwitterConnection{
+		id:               id,
+		store:            st,
+		connection:       *conn,
+		readySenders:     dispatcher.Senders,
+		pendingMsg:       make(chan uint64),
+		done:             dispatcher.Done,
+		stop:             make(chan int),
+		wg:               dispatcher.WaitGroup,
+		recordSend:       dispatcher.RecordSend,
+		holdUntil:        dispatcher.HoldUntil }
+
+
+	twitter.token, twitter.secret, twitter.username, err = twitterCredentials(conn)
+	if err != nil {
+		return t, err
+	}
+
+	return &twitter, err
+}
+
+// Returns whether the passed in error is Twitter rate limiting us, and if so when our limit resets.
+// If Twitter doesn't tell us when, we wait out a whole rate limit window.
+func twitterRateLimit(err error) (bool, time.Time) {
+	apiErr, ok := err.(*anaconda.ApiError)
+	if !ok {
+		return false, time.Time{}
+	}
+
+	limited, reset := apiErr.RateLimitCheck()
+	if limited {
+		return true, reset
+	}
+
+	for _, twitterErr := range apiErr.Decoded.Errors {
+		if twitterErr.Code == anaconda.TwitterErrorRateLimitExceeded {
+			limited = true
+		}
+	}
+	if limited || apiErr.StatusCode == 429 {
+		return true, time.Now().Add(TWITTER_RATE_LIMIT_WINDOW)
+	}
+	return false, time.Time{}
+}
+
+// Reads the credentials and username of the passed in twitter connection, the username is empty
+// if it isn't configured, in which case our listener looks it up from Twitter
+func twitterCredentials(conn *store.Connection) (token string, secret string, username string, err error) {
+	token = conn.Senders.Config[ACCESS_TOKEN]
+	if token == "" {
+		return token, secret, username, errors.New("Missing required config field `access_token`")
+	}
+
+	secret = conn.Senders.Config[ACCESS_TOKEN_SECRET]
+	if secret == "" {
+		return token, secret, username, errors.New("Missing required config field `access_token_secret`")
+	}
+
+	username = strings.ToLower(conn.Senders.Config[USERNAME])
+
+	// strip off any leading @s
+	for len(username) > 0 && username[0:1] == "@" {
+		username = username[1:]
+	}
+
+	return token, secret, username, nil
+}
+
+// Starts linking a Twitter account, returning the temporary credentials to finish linking it with
+// and the URL to send the account's user to, to authorize us. Twitter sends them on to callbackURL.
+func StartTwitterAuthorization(callbackURL string) (*oauth.Credentials, string, error) {
+	client := twitterOAuthClient()
+
+	temporary, err := client.RequestTemporaryCredentials(twitterOAuthHttp, callbackURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return temporary, client.AuthorizationURL(temporary, nil), nil
+}
+
+// Finishes linking a Twitter account, exchanging our temporary credentials and the verifier Twitter
+// gave our callback for the sender config of a twitter connection, including the username of the
+// account those credentials verify as
+func FinishTwitterAuthorization(temporary *oauth.Credentials, verifier string) (map[string]string, error) {
+	client := twitterOAuthClient()
+	credentials, _, err := client.RequestToken(twitterOAuthHttp, temporary, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Get(twitterOAuthHttp, credentials, TWITTER_VERIFY_CREDENTIALS_URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var account anaconda.User
+	err = decodeTwitterResponse(resp, &account)
+	if err != nil {
+		return nil, err
+	}
+	if account.ScreenName == "" {
+		return nil, errors.New("Twitter didn't tell us the username of the linked account")
+	}
+
+	return map[string]string{
+		USERNAME:            account.ScreenName,
+		ACCESS_TOKEN:        credentials.Token,
+		ACCESS_TOKEN_SECRET: credentials.Secret}, nil
+}
+
+func twitterOAuthClient() *oauth.Client {
+	return &oauth.Client{
+		TemporaryCredentialRequestURI: TWITTER_REQUEST_TOKEN_URL,
+		ResourceOwnerAuthorizationURI: TWITTER_AUTHORIZE_URL,
+		TokenRequestURI:               TWITTER_ACCESS_TOKEN_URL,
+		Credentials: oauth.Credentials{
+			Token:  cfg.Config.Twitter.Consumer_Key,
+			Secret: cfg.Config.Twitter.Consumer_Secret}}
+}
+
+var consumerOnce sync.Once
 
-	// this is our receiving thread
+// Configures anaconda with our consumer key and secret, these are global so only need setting once
+func setTwitterConsumer() {
+	consumerOnce.Do(func() {
+		anaconda.SetConsumerKey(cfg.Config.Twitter.Consumer_Key)
+		anaconda.SetConsumerSecret(cfg.Config.Twitter.Consumer_Secret)
+	})
+}
+
+// TwitterStream is a stream of the events of a Twitter account. Anaconda's streams reconnect by
+// themselves, sending on Quit once they give up.
+type TwitterStream struct {
+	C         chan interface{}
+	Quit      chan bool
+	Interrupt func()
+}
+
+// TwitterStreamApi is the part of Twitter's API our listeners use
+type TwitterStreamApi interface {
+	UserStream() TwitterStream
+	GetDirectMessages(v url.Values) ([]anaconda.DirectMessage, error)
+	GetSelf(v url.Values) (anaconda.User, error)
+	Close()
+}
+
+// Creates the API our listeners use with the passed in credentials, tests replace this to stand
+// in for Twitter
+var NewTwitterStreamApi = func(token string, secret string) TwitterStreamApi {
+	setTwitterConsumer()
+	return anacondaStreamApi{anaconda.NewTwitterApi(token, secret)}
+}
+
+type anacondaStreamApi struct {
+	*anaconda.TwitterApi
+}
+
+func (a anacondaStreamApi) UserStream() TwitterStream {
+	stream := a.TwitterApi.UserStream(url.Values{})
+	return TwitterStream{C: stream.C, Quit: stream.Quit, Interrupt: stream.Interrupt}
+}
+
+// TwitterListener streams the DMs sent to a connection's user, there is one per connection
+// however many senders it has. When Twitter closes our stream we reconnect with a growing
+// backoff, and every time we connect we recover any DMs sent since the last one we received.
+type TwitterListener struct {
+	store            store.Store
+	connection       store.Connection
+	incoming         chan uint64
+	done             chan int
+	wg               *sync.WaitGroup
+
+	token            string
+	secret           string
+	username         string
+
+	// the id of the last DM we received, zero if we've never received one
+	lastId           int64
+}
+
+// Starts our listener, this starts a goroutine that streams DMs until our dispatcher is stopped
+func (l *TwitterListener) Start() {
+	l.wg.Add(1)
 	go func() {
-		t.wg.Add(1)
-		defer t.wg.Done()
+		defer l.wg.Done()
 
-		api := anaconda.NewTwitterApi(t.token, t.secret)
+		api := NewTwitterStreamApi(l.token, l.secret)
 		defer api.Close()
 
-		userStream := api.UserStream(url.Values{})
-		var event interface{}
-
+		backoff := TWITTER_MIN_BACKOFF
 		for {
-			// wait for a twitter event to arrive
-			select {
-			case event = <-userStream.C:
-			case <- t.done:
-				userStream.Interrupt()
+			connected := time.Now()
+			err := l.stream(api)
+			if err == nil {
 				return
 			}
 
-			// see if this is a direct message
-			dm, ok := event.(anaconda.DirectMessage)
-			if !ok {
-				continue
+			// if our stream stayed up a while, this is a new problem so start our backoff again
+			if time.Since(connected) > TWITTER_MAX_BACKOFF {
+				backoff = TWITTER_MIN_BACKOFF
 			}
 
-			// check that this isn't one of our own DM's echoing back at us
-			if t.username == strings.ToLower(dm.SenderScreenName) {
-				continue
+			log.Printf("[%s] %s, reconnecting in %s", l.connection.Uuid, err.Error(), backoff)
+			select {
+			case <-time.After(backoff):
+			case <-l.done:
+				return
+			}
+
+			backoff *= 2
+			if backoff > TWITTER_MAX_BACKOFF {
+				backoff = TWITTER_MAX_BACKOFF
 			}
+		}
+	}()
+}
 
-			log.Printf("[%s][%d] Received DM from %s: %s", t.connection.Uuid, t.id, dm.SenderScreenName, dm.Text)
+// Streams DMs until either we are stopped, when we return nil, or Twitter gives up on our stream
+func (l *TwitterListener) stream(api TwitterStreamApi) error {
+	// we need our username to tell our own DMs apart, if it isn't configured ask Twitter for it
+	if l.username == "" {
+		self, err := api.GetSelf(url.Values{})
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error looking up our username: %s", err.Error()))
+		}
+		l.username = strings.ToLower(self.ScreenName)
+	}
+
+	userStream := api.UserStream()
+
+	for {
+		// wait for a twitter event to arrive
+		var event interface{}
+		select {
+		case event = <-userStream.C:
+		case <-userStream.Quit:
+			// anaconda sends on Quit when it can't reconnect our stream
+			return errors.New("Twitter stream closed")
+		case <-l.done:
+			userStream.Interrupt()
+			return nil
+		}
 
-			// create a new msg from our DM
-			msg := store.MsgFromText(t.connection.Uuid, dm.SenderScreenName, dm.Text)
-			err := msg.WriteToInbox()
+		switch event := event.(type) {
+		case anaconda.FriendsList:
+			// Twitter starts every stream with our friends, including the ones anaconda reconnects
+			// by itself, so this is when we catch up on anything we missed while disconnected
+			err := l.recoverMissed(api)
 			if err != nil {
-				log.Printf("[%s][%d] Error saving msg (%d): %s", t.connection.Uuid, t.id, dm.Id, err.Error())
+				log.Printf("[%s] Error recovering missed DMs: %s", l.connection.Uuid, err.Error())
 			}
 
-			// pass our message to be received
-			t.incoming <- msg.Id
+		case anaconda.DirectMessage:
+			err := l.receive(event)
+			if err != nil {
+				log.Printf("[%s] Error receiving DM (%s): %s", l.connection.Uuid, event.IdStr, err.Error())
+			}
+		}
+	}
+}
 
-			// release our message back to the pool
-			msg.Release()
+// Receives any DMs sent to us since our cursor, we can't know what we missed if we've never
+// received one
+func (l *TwitterListener) recoverMissed(api TwitterStreamApi) error {
+	if l.lastId == 0 {
+		return nil
+	}
+
+	// page back through the DMs sent since our cursor, Twitter returns the newest first
+	missed := make([]anaconda.DirectMessage, 0)
+	params := url.Values{}
+	params.Set("since_id", strconv.FormatInt(l.lastId, 10))
+	params.Set("count", "200")
+	for {
+		dms, err := api.GetDirectMessages(params)
+		if err != nil {
+			return err
 		}
-	}()
+		if len(dms) == 0 {
+			break
+		}
+
+		missed = append(missed, dms...)
+		params.Set("max_id", strconv.FormatInt(dms[len(dms)-1].Id-1, 10))
+	}
+
+	if len(missed) > 0 {
+		log.Printf("[%s] Recovering %d DMs received while disconnected", l.connection.Uuid, len(missed))
+	}
+
+	// receive them in the order they were sent
+	for i := len(missed) - 1; i >= 0; i-- {
+		err := l.receive(missed[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func CreateTwitterConnection(id int, conn *store.Connection, dispatcher *disp.Dispatcher) (t *TwitterConnection, err error) {
-	twitter := TwitterConnection{
-		id: id,
-		connection:       *conn,
-		readySenders:     dispatcher.Senders,
-		incoming:         dispatcher.Incoming,
-		pendingMsg:       make(chan uint64),
-		done:             dispatcher.Done,
-		wg:               dispatcher.WaitGroup }
+// Writes the passed in DM to our inbox and queues it, advancing our cursor past it
+func (l *TwitterListener) receive(dm anaconda.DirectMessage) error {
+	// check that this isn't one of our own DM's echoing back at us
+	if l.username == strings.ToLower(dm.SenderScreenName) {
+		return nil
+	}
+
+	// we might see a DM both streamed and recovered, or from the listener of a connection we
+	// are replacing, we only want one msg for it
+	_, err := l.store.GetMsgIdByExternalId(l.connection.Uuid, dm.IdStr)
+	if err == nil {
+		return l.advance(dm)
+	}
+
+	log.Printf("[%s] Received DM from %s: %s", l.connection.Uuid, dm.SenderScreenName, dm.Text)
+
+	// Twitter links any media in the DM's text, our attachments take the place of those links
+	text := dm.Text
+	attachments := make([]store.Attachment, 0, len(dm.Entities.Media))
+	for _, media := range dm.Entities.Media {
+		text = strings.TrimSpace(strings.Replace(text, media.Url, "", -1))
+		attachments = append(attachments, l.captureMedia(media))
+	}
 
+	// create a new msg from our DM
+	msg := store.MsgFromText(l.store, l.connection.Uuid, dm.SenderScreenName, text)
+	defer msg.Release()
 
-	twitter.token = conn.Senders.Config[ACCESS_TOKEN]
-	if twitter.token == "" {
-		return t, errors.New("Missing required config field `access_token`")
+	if len(attachments) > 0 {
+		msg.Attachments = attachments
 	}
 
-	twitter.secret = conn.Senders.Config[ACCESS_TOKEN_SECRET]
-	if twitter.secret == "" {
-		return t, errors.New("Missing required config field `access_token_secret`")
+	msg.ExternalId = dm.IdStr
+	err = msg.WriteToInbox()
+	if err != nil {
+		return err
 	}
 
-	twitter.username = strings.ToLower(conn.Senders.Config[USERNAME])
+	// pass our message to be received, if we've been stopped it is in our inbox for when we start
+	select {
+	case l.incoming <- msg.Id:
+	case <-l.done:
+	}
 
-	// strip off any leading @s
-	for len(twitter.username) > 0 && twitter.username[0:1] == "@" {
-		twitter.username = twitter.username[1:]
+	return l.advance(dm)
+}
+
+// Stores the passed in DM media as a blob, DM media can only be fetched with our account's
+// credentials so our clients can't fetch it themselves. If we can't, we attach its URL instead.
+func (l *TwitterListener) captureMedia(media anaconda.EntityMedia) store.Attachment {
+	// for videos and GIFs this is their preview image
+	contentType := "image/jpeg"
+
+	credentials := &oauth.Credentials{Token: l.token, Secret: l.secret}
+	resp, err := twitterOAuthClient().Get(twitterOAuthHttp, credentials, media.Media_url_https, nil)
+	if err == nil {
+		var blob *store.Blob
+		blob, err = readBlob(resp)
+		if err == nil {
+			if blob.ContentType != "" {
+				contentType = blob.ContentType
+			}
+
+			var attachment *store.Attachment
+			attachment, err = l.connection.SaveBlob(contentType, blob.Data)
+			if err == nil {
+				return *attachment
+			}
+		}
+	}
+
+	log.Printf("[%s] Error capturing DM media %s, attaching its URL: %s", l.connection.Uuid, media.Media_url_https, err.Error())
+	return store.Attachment{ContentType: contentType, Url: media.Media_url_https}
+}
+
+// moves our cursor forward to the passed in DM, if it is newer than the last one we saw
+func (l *TwitterListener) advance(dm anaconda.DirectMessage) error {
+	if dm.Id <= l.lastId {
+		return nil
+	}
+	l.lastId = dm.Id
+	return l.connection.SaveCursor(TWITTER_CURSOR, dm.IdStr)
+}
+
+func CreateTwitterListener(st store.Store, conn *store.Connection, dispatcher *disp.Dispatcher) (l *TwitterListener, err error) {
+	listener := TwitterListener{
+		store:            st,
+		connection:       *conn,
+		incoming:         dispatcher.Incoming,
+		done:             dispatcher.Done,
+		wg:               dispatcher.WaitGroup }
+
+	listener.token, listener.secret, listener.username, err = twitterCredentials(conn)
+	if err != nil {
+		return l, err
 	}
 
-	// make sure we aren't empty
-	if twitter.username == "" {
-		return t, errors.New("Missing required field `username`")
+	// pick up where we left off
+	cursor, err := conn.LoadCursor(TWITTER_CURSOR)
+	if err != nil {
+		return l, err
+	}
+	if cursor != "" {
+		listener.lastId, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			return l, errors.New(fmt.Sprintf("Invalid twitter cursor: %s", cursor))
+		}
 	}
 
-	return &twitter, err
+	return &listener, nil
 }
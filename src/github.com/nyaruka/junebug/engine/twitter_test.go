@@ -0,0 +1,329 @@
+package engine_test
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/nyaruka/junebug/disp"
+	"github.com/nyaruka/junebug/engine"
+	"github.com/nyaruka/junebug/store"
+)
+
+// stands in for Twitter, handing each stream our listener opens to our test to drive
+type fakeTwitter struct {
+	streams chan engine.TwitterStream
+
+	// the DMs sent to our account, newest first as Twitter returns them, and the since_id of each
+	// recovery we were asked for
+	mutex    sync.Mutex
+	dms      []anaconda.DirectMessage
+	sinceIds []string
+
+	// how many times we were asked who our account is
+	selfLookups int
+}
+
+func newFakeTwitter(dms ...anaconda.DirectMessage) *fakeTwitter {
+	return &fakeTwitter{streams: make(chan engine.TwitterStream, 10), dms: dms}
+}
+
+func (f *fakeTwitter) UserStream() engine.TwitterStream {
+	stream := engine.TwitterStream{C: make(chan interface{}), Quit: make(chan bool, 1), Interrupt: func() {}}
+	f.streams <- stream
+	return stream
+}
+
+func (f *fakeTwitter) GetDirectMessages(v url.Values) ([]anaconda.DirectMessage, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	since, _ := strconv.ParseInt(v.Get("since_id"), 10, 64)
+	max, err := strconv.ParseInt(v.Get("max_id"), 10, 64)
+	if err != nil {
+		f.sinceIds = append(f.sinceIds, v.Get("since_id"))
+		max = 1<<63 - 1
+	}
+
+	dms := make([]anaconda.DirectMessage, 0)
+	for _, dm := range f.dms {
+		if dm.Id > since && dm.Id <= max {
+			dms = append(dms, dm)
+		}
+	}
+	return dms, nil
+}
+
+func (f *fakeTwitter) GetSelf(v url.Values) (anaconda.User, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.selfLookups++
+	return anaconda.User{ScreenName: "JuneBug"}, nil
+}
+
+func (f *fakeTwitter) Close() {}
+
+// adds a DM sent to our account, as the newest
+func (f *fakeTwitter) send(dm anaconda.DirectMessage) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.dms = append([]anaconda.DirectMessage{dm}, f.dms...)
+}
+
+func (f *fakeTwitter) recoveredSince() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.sinceIds...)
+}
+
+func (f *fakeTwitter) lookedUpSelf() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.selfLookups
+}
+
+// waits for our listener to open its next stream
+func (f *fakeTwitter) nextStream(t *testing.T) engine.TwitterStream {
+	select {
+	case stream := <-f.streams:
+		return stream
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for stream to be opened")
+		return engine.TwitterStream{}
+	}
+}
+
+func newDM(id int64, from string, text string) anaconda.DirectMessage {
+	return anaconda.DirectMessage{Id: id, IdStr: strconv.FormatInt(id, 10), SenderScreenName: from, Text: text}
+}
+
+func createTwitterConnection(t *testing.T, s store.Store) *store.Connection {
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "twitter",
+		"config": {"username": "junebug", "access_token": "token", "access_token_secret": "secret"}},
+		"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// starts a listener for the passed in connection against the passed in fake, callers should stop
+// the returned dispatcher, which our listener passes the DMs it receives to
+func startTwitterListener(t *testing.T, s store.Store, conn *store.Connection, fake *fakeTwitter) *disp.Dispatcher {
+	dispatcher := disp.CreateDispatcher(1, 1)
+	listener, err := engine.CreateTwitterListener(s, conn, dispatcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Start()
+	return dispatcher
+}
+
+// asserts our listener receives DMs with the passed in texts, in order
+func assertReceived(t *testing.T, s store.Store, conn *store.Connection, dispatcher *disp.Dispatcher, texts ...string) {
+	for _, text := range texts {
+		select {
+		case id := <-dispatcher.Incoming:
+			msg, err := store.MsgFromId(s, conn.Uuid, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Text != text || msg.ExternalId == "" {
+				t.Errorf("Expected to receive %s, got %s (%s)", text, msg.Text, msg.ExternalId)
+			}
+			msg.Release()
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting to receive %s", text)
+		}
+	}
+}
+
+func assertCursor(t *testing.T, conn *store.Connection, expected string) {
+	var cursor string
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		cursor, _ = conn.LoadCursor(engine.TWITTER_CURSOR)
+		if cursor == expected {
+			return
+		}
+	}
+	t.Errorf("Expected cursor to be %s, was %s", expected, cursor)
+}
+
+func TestTwitterListener(t *testing.T) {
+	s := store.NewMemoryStore()
+	conn := createTwitterConnection(t, s)
+	conn.SaveCursor(engine.TWITTER_CURSOR, "100")
+
+	fake := newFakeTwitter(newDM(103, "bob", "three"), newDM(102, "JuneBug", "mine"), newDM(101, "bob", "one"),
+		newDM(100, "bob", "zero"))
+	newApi := engine.NewTwitterStreamApi
+	defer func() { engine.NewTwitterStreamApi = newApi }()
+	engine.NewTwitterStreamApi = func(token string, secret string) engine.TwitterStreamApi { return fake }
+
+	minBackoff := engine.TWITTER_MIN_BACKOFF
+	defer func() { engine.TWITTER_MIN_BACKOFF = minBackoff }()
+	engine.TWITTER_MIN_BACKOFF = 10 * time.Millisecond
+
+	dispatcher := startTwitterListener(t, s, conn, fake)
+	defer dispatcher.Stop()
+
+	// once connected we recover the DMs sent since our cursor, oldest first and without our own
+	stream := fake.nextStream(t)
+	stream.C <- anaconda.FriendsList{}
+	assertReceived(t, s, conn, dispatcher, "one", "three")
+	assertCursor(t, conn, "103")
+
+	// DMs we already have aren't received again when streamed
+	stream.C <- newDM(103, "bob", "three")
+	stream.C <- newDM(104, "bob", "four")
+	assertReceived(t, s, conn, dispatcher, "four")
+	assertCursor(t, conn, "104")
+
+	// when our stream gives up we reconnect, recovering what we missed since our cursor
+	fake.send(newDM(105, "bob", "five"))
+	stream.Quit <- true
+	stream = fake.nextStream(t)
+	stream.C <- anaconda.FriendsList{}
+	assertReceived(t, s, conn, dispatcher, "five")
+	assertCursor(t, conn, "105")
+
+	if since := fake.recoveredSince(); len(since) != 2 || since[0] != "100" || since[1] != "104" {
+		t.Errorf("Expected to recover since our cursor each time we connected, got %v", since)
+	}
+
+	// we knew our username, so never had to ask Twitter for it
+	if lookups := fake.lookedUpSelf(); lookups != 0 {
+		t.Errorf("Expected no username lookups for a connection with a username, got %d", lookups)
+	}
+
+	// a listener without a cursor can't know what it missed, so doesn't try
+	s = store.NewMemoryStore()
+	conn = createTwitterConnection(t, s)
+	fake = newFakeTwitter(newDM(101, "bob", "one"))
+
+	other := startTwitterListener(t, s, conn, fake)
+	defer other.Stop()
+
+	stream = fake.nextStream(t)
+	stream.C <- anaconda.FriendsList{}
+	stream.C <- newDM(102, "bob", "two")
+	assertReceived(t, s, conn, other, "two")
+	assertCursor(t, conn, "102")
+	if since := fake.recoveredSince(); len(since) != 0 {
+		t.Errorf("Expected no recovery without a cursor, got %v", since)
+	}
+
+	// and cursors we can't read are an error
+	conn.SaveCursor(engine.TWITTER_CURSOR, "abc")
+	_, err := engine.CreateTwitterListener(s, conn, disp.CreateDispatcher(1, 1))
+	if err == nil {
+		t.Error("Expected error creating listener with an invalid cursor")
+	}
+}
+
+func TestTwitterListenerUsername(t *testing.T) {
+	s := store.NewMemoryStore()
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "twitter",
+		"config": {"access_token": "token", "access_token_secret": "secret"}},
+		"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeTwitter()
+	newApi := engine.NewTwitterStreamApi
+	defer func() { engine.NewTwitterStreamApi = newApi }()
+	engine.NewTwitterStreamApi = func(token string, secret string) engine.TwitterStreamApi { return fake }
+
+	dispatcher := startTwitterListener(t, s, conn, fake)
+	defer dispatcher.Stop()
+
+	// without a configured username we ask Twitter who we are, so we still skip our own DMs
+	stream := fake.nextStream(t)
+	stream.C <- newDM(101, "JuneBug", "mine")
+	stream.C <- newDM(102, "bob", "two")
+	assertReceived(t, s, conn, dispatcher, "two")
+
+	if lookups := fake.lookedUpSelf(); lookups != 1 {
+		t.Errorf("Expected our username to be looked up once, got %d", lookups)
+	}
+}
+
+func TestAddTwitterConnection(t *testing.T) {
+	s := store.NewMemoryStore()
+	manager := engine.NewConnectionManager(s)
+	defer manager.StopAll(5 * time.Second)
+
+	fake := newFakeTwitter()
+	newApi := engine.NewTwitterStreamApi
+	defer func() { engine.NewTwitterStreamApi = newApi }()
+	engine.NewTwitterStreamApi = func(token string, secret string) engine.TwitterStreamApi { return fake }
+
+	// new connections aren't saved until their engine is created, so have no cursor to load yet
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "twitter",
+		"config": {"username": "junebug", "access_token": "token", "access_token_secret": "secret"}},
+		"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.Add(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.nextStream(t)
+}
+
+func TestTwitterListenerBackoff(t *testing.T) {
+	s := store.NewMemoryStore()
+	conn := createTwitterConnection(t, s)
+
+	fake := newFakeTwitter()
+	newApi := engine.NewTwitterStreamApi
+	defer func() { engine.NewTwitterStreamApi = newApi }()
+	engine.NewTwitterStreamApi = func(token string, secret string) engine.TwitterStreamApi { return fake }
+
+	minBackoff, maxBackoff := engine.TWITTER_MIN_BACKOFF, engine.TWITTER_MAX_BACKOFF
+	defer func() { engine.TWITTER_MIN_BACKOFF, engine.TWITTER_MAX_BACKOFF = minBackoff, maxBackoff }()
+	engine.TWITTER_MIN_BACKOFF, engine.TWITTER_MAX_BACKOFF = 50*time.Millisecond, 200*time.Millisecond
+
+	dispatcher := startTwitterListener(t, s, conn, fake)
+	defer dispatcher.Stop()
+
+	// each time our stream gives up straight away we wait twice as long to reconnect, up to our max
+	connected := make([]time.Time, 0)
+	for i := 0; i < 5; i++ {
+		stream := fake.nextStream(t)
+		connected = append(connected, time.Now())
+		stream.Quit <- true
+	}
+
+	for i, backoff := range []time.Duration{50, 100, 200, 200} {
+		backoff *= time.Millisecond
+		if waited := connected[i+1].Sub(connected[i]); waited < backoff || waited > backoff*3/2 {
+			t.Errorf("Expected to reconnect after %s, waited %s", backoff, waited)
+		}
+	}
+
+	// but a stream that stayed up longer than that starts our backoff again
+	stream := fake.nextStream(t)
+	time.Sleep(250 * time.Millisecond)
+	quit := time.Now()
+	stream.Quit <- true
+
+	fake.nextStream(t)
+	if waited := time.Since(quit); waited > 100*time.Millisecond {
+		t.Errorf("Expected to reconnect after our min backoff, waited %s", waited)
+	}
+}
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nyaruka/junebug/store"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// uploads the body of our request as a blob of our connection, its content type is our request's.
+// The attachment we return can be added to msgs sent on the connection.
+func uploadBlob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	connection, err := store.ConnectionFromUuid(db, ps.ByName("conn_uuid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		http.Error(w, "Must specify the blob's Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	// read one byte past our max so we know when we've been sent too much
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, store.MAX_BLOB_SIZE+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > store.MAX_BLOB_SIZE {
+		http.Error(w, "Blob is too large, send larger attachments by URL", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	attachment, err := connection.SaveBlob(contentType, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(attachment)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// serves the blob with the passed in id, including those captured from incoming msgs
+func readBlob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	connection, err := store.ConnectionFromUuid(db, ps.ByName("conn_uuid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	blob, err := connection.LoadBlob(ps.ByName("blob_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Write(blob.Data)
+}
@@ -0,0 +1,101 @@
+package http_test
+
+import (
+	"bytes"
+	"encoding/json"
+	gohttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/junebug/store"
+)
+
+// uploads the passed in data as a blob of the passed in connection, returning its attachment
+func uploadBlob(t *testing.T, server *httptest.Server, uuid string, contentType string, data string) store.Attachment {
+	resp, body := request(t, server, "PUT", "/connection/"+uuid+"/blob", contentType, strings.NewReader(data))
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected blob to be uploaded, got %d: %s", resp.StatusCode, body)
+	}
+
+	var attachment store.Attachment
+	err := json.Unmarshal([]byte(body), &attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attachment
+}
+
+func TestBlobs(t *testing.T) {
+	server, manager, _ := startServer(t)
+	defer server.Close()
+	defer manager.StopAll(5 * time.Second)
+
+	uuid := addEchoConnection(t, server)
+	other := addEchoConnection(t, server)
+
+	// blobs are read back with the content type they were uploaded with
+	attachment := uploadBlob(t, server, uuid, "image/png", "png data")
+	if attachment.Blob == "" || attachment.ContentType != "image/png" || attachment.Size != 8 {
+		t.Errorf("Unexpected attachment for blob: %+v", attachment)
+	}
+
+	resp, body := request(t, server, "GET", "/connection/"+uuid+"/blob/"+attachment.Blob, "", nil)
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "image/png" || body != "png data" {
+		t.Errorf("Expected our blob back, got %d %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	// but only from the connection they belong to
+	resp, _ = request(t, server, "GET", "/connection/"+other+"/blob/"+attachment.Blob, "", nil)
+	if resp.StatusCode != gohttp.StatusNotFound {
+		t.Errorf("Expected 404 reading another connection's blob, got %d", resp.StatusCode)
+	}
+
+	// blobs must say what they are
+	resp, _ = request(t, server, "PUT", "/connection/"+uuid+"/blob", "", strings.NewReader("png data"))
+	if resp.StatusCode != gohttp.StatusBadRequest {
+		t.Errorf("Expected 400 for blob without a content type, got %d", resp.StatusCode)
+	}
+
+	// and can't be larger than our max, though they can be right up to it
+	tooLarge := bytes.Repeat([]byte("a"), store.MAX_BLOB_SIZE+1)
+	resp, _ = request(t, server, "PUT", "/connection/"+uuid+"/blob", "image/png", bytes.NewReader(tooLarge))
+	if resp.StatusCode != gohttp.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for blob over our max size, got %d", resp.StatusCode)
+	}
+	uploadBlob(t, server, uuid, "image/png", string(tooLarge[1:]))
+}
+
+func TestSendBlobs(t *testing.T) {
+	server, manager, _ := startServer(t)
+	defer server.Close()
+	defer manager.StopAll(5 * time.Second)
+
+	uuid := addEchoConnection(t, server)
+	other := addEchoConnection(t, server)
+	attachment := uploadBlob(t, server, uuid, "image/png", "png data")
+
+	send := func(connUuid string, blob string) (int, string) {
+		resp, body := request(t, server, "PUT", "/connection/"+connUuid+"/send", "application/json", strings.NewReader(
+			`{"address": "+250788383383", "attachments": [{"content_type": "image/png", "blob": "`+blob+`"}]}`))
+		return resp.StatusCode, body
+	}
+
+	// our blob can be sent on its connection
+	status, body := send(uuid, attachment.Blob)
+	if status != 200 {
+		t.Errorf("Expected msg with our blob to be sent, got %d: %s", status, body)
+	}
+
+	// but blobs we don't know, or that belong to other connections, are rejected
+	status, body = send(uuid, "f6f2cc0c-5ac6-4d5b-b1b6-2b5c7a1c3e5e")
+	if status != gohttp.StatusBadRequest || !strings.Contains(body, "Unknown blob") {
+		t.Errorf("Expected 400 for unknown blob, got %d: %s", status, body)
+	}
+
+	status, body = send(other, attachment.Blob)
+	if status != gohttp.StatusBadRequest || !strings.Contains(body, "Unknown blob") {
+		t.Errorf("Expected 400 for another connection's blob, got %d: %s", status, body)
+	}
+}
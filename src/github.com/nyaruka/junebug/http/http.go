@@ -10,44 +10,50 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
+// clients can send this header when sending a msg so that retrying their request doesn't send
+// it twice, repeated requests get the original msg back with our replayed header set
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+const IDEMPOTENT_REPLAYED_HEADER = "Idempotent-Replayed"
+
 // our payload for a connection read response
 type ConnectionResponse struct {
 	Connection *store.Connection       `json:"connection"`
 	Status     *store.ConnectionStatus `json:"status"`
+	State      string                  `json:"state"`
+	Error      string                  `json:"error,omitempty"`
 }
 
 type ConnectionListResponse struct {
 	Connection *[]store.Connection `json:"connections"`
 }
 
+type TypeListResponse struct {
+	Senders   []*engine.SenderType   `json:"senders"`
+	Receivers []*engine.ReceiverType `json:"receivers"`
+}
+
+type MsgListResponse struct {
+	Msgs []*store.Msg `json:"msgs"`
+}
+
 func addConnection(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// read the connection from the body
-	connection, err := store.ConnectionFromJson(r.Body)
+	connection, err := store.ConnectionFromJson(db, r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// gentlemen, start your engines!
-	engine, err := engine.NewConnectionEngine(connection)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// ok, things look good, let's start our connection
-	err = connection.Save()
+	// validate, save and start it
+	err = manager.Add(connection)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// start our engines!
-	engine.Start()
-	engines[connection.Uuid] = engine
-
 	// write our config to the response
 	w.Header().Set("Content-Type", "application/json")
 
@@ -62,25 +68,72 @@ func addConnection(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	w.Write(js)
 }
 
+func updateConnection(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	connection, err := store.ConnectionFromUuid(db, ps.ByName("conn_uuid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// apply our changes to our current config
+	updated, err := connection.Patch(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// validate, save and roll it out
+	err = manager.Update(updated, cfg.Config.ShutdownTimeout())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	readConnection(w, r, ps)
+}
+
 func deleteConnection(w http.ResponseWriter, r *http.Request, ps httprouter.Params){
 	uuid := ps.ByName("conn_uuid")
 	var resp ConnectionResponse
 
 	// load our connection config
-	connection, err := store.ConnectionFromUuid(uuid)
+	connection, err := store.ConnectionFromUuid(db, uuid)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	resp.Connection = connection
 
+	// if asked, drain our connection first, we won't delete any msgs that are left over
+	drain := r.URL.Query().Get("drain")
+	if drain != "" {
+		seconds, err := strconv.ParseUint(drain, 10, 32)
+		if err != nil {
+			http.Error(w, "`drain` must be a number of seconds", http.StatusBadRequest)
+			return
+		}
+
+		leftover, err := manager.Drain(uuid, time.Duration(seconds)*time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if leftover > 0 {
+			http.Error(w, fmt.Sprintf("%d msgs left after draining, the connection is now stopped, export them from "+
+				"/connection/%s/export then delete again, or start it again from /connection/%s/start",
+				leftover, uuid, uuid), http.StatusConflict)
+			return
+		}
+	}
+
 	// load our status
-	status, err := connection.GetStatus()
+	status, err := connectionStatus(connection)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	resp.Status = status
+	resp.State, resp.Error = connectionState(connection.Uuid)
 
 	// output it
 	js, err := json.Marshal(resp)
@@ -89,22 +142,51 @@ func deleteConnection(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 		return
 	}
 
-	// shut down our connection
-	engine, exists := engines[uuid]
-	if exists {
-		engine.Stop()
-		delete(engines, uuid)
+	// shut down our connection and remove all our data for it
+	err = manager.Delete(connection, cfg.Config.ShutdownTimeout())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// remove all our data for it
-	connection.Delete()
-
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
 }
 
+// Returns the status of the passed in connection, including how it is sending if it is running
+func connectionStatus(connection *store.Connection) (*store.ConnectionStatus, error) {
+	engine, err := manager.Get(connection.Uuid)
+	if err == nil {
+		return engine.GetStatus()
+	}
+	return connection.GetStatus()
+}
+
+// Returns the lifecycle state of the passed in connection, and why it failed if it did
+func connectionState(uuid string) (string, string) {
+	state, err := manager.State(uuid)
+	if err != nil {
+		return state, err.Error()
+	}
+	return state, ""
+}
+
+// Returns a handler which calls the passed in lifecycle operation on a connection, then
+// responds with the connection's config, status and state
+func changeConnection(operation func(uuid string) error) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		err := operation(ps.ByName("conn_uuid"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		readConnection(w, r, ps)
+	}
+}
+
 func listConnections(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	connections, err := store.LoadAllConnections()
+	connections, err := store.LoadAllConnections(db)
 	connectionList := ConnectionListResponse{connections}
 
 	js, err := json.Marshal(connectionList)
@@ -123,7 +205,7 @@ func readConnection(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	var resp ConnectionResponse
 
 	// load our connection config
-	connection, err := store.ConnectionFromUuid(uuid)
+	connection, err := store.ConnectionFromUuid(db, uuid)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -131,12 +213,13 @@ func readConnection(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	resp.Connection = connection
 
 	// load our status
-	status, err := connection.GetStatus()
+	status, err := connectionStatus(connection)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	resp.Status = status
+	resp.State, resp.Error = connectionState(connection.Uuid)
 
 	// output it
 	js, err := json.Marshal(resp)
@@ -152,14 +235,15 @@ func readConnection(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 func sendMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	conn_uuid := ps.ByName("conn_uuid")
 
-	// make sure this is a valid connection
-	engine, exists := engines[conn_uuid]
-	if !exists {
-		http.Error(w, "No connection with uuid: "+conn_uuid, http.StatusBadRequest)
+	// make sure this is a running connection
+	engine, err := manager.Get(conn_uuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	// read the message from our body
-	msg, err := store.MsgFromJson(r.Body)
+	msg, err := store.MsgFromJson(db, r.Body)
 	defer msg.Release()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -169,18 +253,43 @@ func sendMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// assign our connection UUID
 	msg.ConnUuid = conn_uuid
 
-	// write it out
-	err = msg.WriteToOutbox()
+	// blobs must have been uploaded to this connection before they are attached
+	for _, attachment := range msg.Attachments {
+		if attachment.Blob != "" {
+			_, err = engine.Connection.LoadBlob(attachment.Blob)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Unknown blob: %s", attachment.Blob), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	// our idempotency key can come from our header or our body, but they must agree
+	key := r.Header.Get(IDEMPOTENCY_KEY_HEADER)
+	if key != "" && msg.IdempotencyKey != "" && key != msg.IdempotencyKey {
+		http.Error(w, "Idempotency-Key header doesn't match `idempotency_key`", http.StatusBadRequest)
+		return
+	} else if key != "" {
+		msg.IdempotencyKey = key
+	}
+
+	// write it out and dispatch it
+	sent, repeated, err := engine.Send(msg)
+	if sent != msg {
+		defer sent.Release()
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// dispatch it
-	engine.Dispatcher.Outgoing <- msg.Id
+	// let our client know this is the msg from their earlier request
+	if repeated {
+		w.Header().Set(IDEMPOTENT_REPLAYED_HEADER, "true")
+	}
 
 	// output it
-	js, err := json.Marshal(msg)
+	js, err := json.Marshal(sent)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -200,7 +309,7 @@ func readMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 
 	// load our msg and status
-	msg, err := store.MsgFromId(connUuid, msgId)
+	msg, err := store.MsgFromId(db, connUuid, msgId)
 	defer msg.Release()
 
 	if err != nil {
@@ -219,38 +328,324 @@ func readMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	w.Write(js)
 }
 
+// reads the msg our transport assigned the passed in external id, such as the id of a DM or SMS
+func readExternalMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	// we get a msg back to release even when it fails to load, but not when its id is unknown
+	msg, err := store.MsgFromExternalId(db, ps.ByName("conn_uuid"), ps.ByName("external_id"))
+	if msg != nil {
+		defer msg.Release()
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func listDeadLetters(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	listMsgs(w, ps.ByName("conn_uuid"), (*store.Connection).GetDeadLetterMsgs)
+}
+
+func listScheduled(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	listMsgs(w, ps.ByName("conn_uuid"), (*store.Connection).GetScheduledMsgs)
+}
+
+// writes out every msg the connection hasn't finished sending or handling as JSON lines, so they
+// can be kept before it is deleted
+func exportPending(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	connection, err := store.ConnectionFromUuid(db, ps.ByName("conn_uuid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ids, err := connection.GetPendingMsgs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// we stream our msgs, so once we've started we can only stop if something goes wrong
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	for _, id := range *ids {
+		msg, err := store.MsgFromId(db, connection.Uuid, id)
+		if err != nil {
+			log.Printf("[%.8s] Error loading msg (%d) for export: %s\n", connection.Uuid, id, err.Error())
+			return
+		}
+
+		err = encoder.Encode(msg)
+		msg.Release()
+		if err != nil {
+			log.Printf("[%.8s] Error exporting msg (%d): %s\n", connection.Uuid, id, err.Error())
+			return
+		}
+	}
+}
+
+// writes out the msgs with the ids returned by getIds for the passed in connection
+func listMsgs(w http.ResponseWriter, connUuid string, getIds func(*store.Connection) (*[]uint64, error)) {
+	connection, err := store.ConnectionFromUuid(db, connUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ids, err := getIds(connection)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// load each of our msgs, releasing them all once we are done
+	resp := MsgListResponse{make([]*store.Msg, 0, len(*ids))}
+	defer func() {
+		for _, msg := range resp.Msgs {
+			msg.Release()
+		}
+	}()
+
+	for _, id := range *ids {
+		msg, err := store.MsgFromId(db, connection.Uuid, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Msgs = append(resp.Msgs, msg)
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func replayDeadLetter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	connUuid := ps.ByName("conn_uuid")
+
+	// make sure this is a running connection
+	engine, err := manager.Get(connUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msgId, err := strconv.ParseUint(ps.ByName("msg_id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg, err := store.MsgFromId(db, connUuid, msgId)
+	defer msg.Release()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// move it back to our inbox
+	err = msg.MarkReplayed()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// and pass it to our receivers again
+	engine.QueueIncoming(msg.Id)
+
+	js, err := json.Marshal(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func dropDeadLetter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	connection, err := store.ConnectionFromUuid(db, ps.ByName("conn_uuid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msgId, err := strconv.ParseUint(ps.ByName("msg_id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = connection.DropDeadLetterMsg(msgId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func cancelScheduled(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	connUuid := ps.ByName("conn_uuid")
+
+	// make sure this is a running connection
+	engine, err := manager.Get(connUuid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msgId, err := strconv.ParseUint(ps.ByName("msg_id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	msg, err := engine.Retrier.CancelScheduled(msgId)
+	defer msg.Release()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	js, err := json.Marshal(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func listTypes(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	types := TypeListResponse{engine.SenderTypes(), engine.ReceiverTypes()}
+
+	js, err := json.Marshal(types)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
 func serveIndex(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	http.ServeFile(w, r, "static/index.html")
 }
 
-var engines map[string]*engine.ConnectionEngine
+var manager *engine.ConnectionManager
+var db store.Store
 
-func StartServer(e *map[string]*engine.ConnectionEngine) {
-	engines = *e
+// Builds the router for our API, serving the connections of the passed in manager and store
+func NewRouter(s store.Store, m *engine.ConnectionManager) *httprouter.Router {
+	db = s
+	manager = m
 
 	router := httprouter.New()
 	router.GET("/", serveIndex)
 	router.ServeFiles("/static/*filepath", http.Dir("static"))
 
+	router.GET("/types", listTypes)
 	router.GET("/connection", listConnections)
 	router.PUT("/connection", addConnection)
+	router.PATCH("/connection/:conn_uuid", updateConnection)
 	router.DELETE("/connection/:conn_uuid", deleteConnection)
 	router.GET("/connection/:conn_uuid", readConnection)
+	router.POST("/connection/:conn_uuid/start", changeConnection(manager.Start))
+	router.POST("/connection/:conn_uuid/stop", changeConnection(func(uuid string) error {
+		return manager.Stop(uuid, cfg.Config.ShutdownTimeout())
+	}))
+	router.POST("/connection/:conn_uuid/restart", changeConnection(func(uuid string) error {
+		return manager.Restart(uuid, cfg.Config.ShutdownTimeout())
+	}))
+	router.POST("/connection/:conn_uuid/pause", changeConnection(manager.Pause))
+	router.POST("/connection/:conn_uuid/resume", changeConnection(manager.Resume))
+	router.GET("/connection/:conn_uuid/export", exportPending)
 	router.PUT("/connection/:conn_uuid/send", sendMessage)
 	router.GET("/connection/:conn_uuid/status/:msg_uuid", readMessage)
+	router.GET("/connection/:conn_uuid/external/:external_id", readExternalMessage)
+	router.GET("/connection/:conn_uuid/deadletter", listDeadLetters)
+	router.POST("/connection/:conn_uuid/deadletter/:msg_id/replay", replayDeadLetter)
+	router.DELETE("/connection/:conn_uuid/deadletter/:msg_id", dropDeadLetter)
+	router.GET("/connection/:conn_uuid/scheduled", listScheduled)
+	router.DELETE("/connection/:conn_uuid/scheduled/:msg_id", cancelScheduled)
+
+	router.PUT("/connection/:conn_uuid/blob", uploadBlob)
+	router.GET("/connection/:conn_uuid/blob/:blob_id", readBlob)
+
+	router.PUT("/twitter/authorize", authorizeNewTwitter)
+	router.POST("/connection/:conn_uuid/twitter/authorize", authorizeExistingTwitter)
+	router.GET("/twitter/callback", twitterCallback)
+
+	return router
+}
+
+// Starts our server listening in the background, callers should Shutdown the returned server
+// before stopping our connections
+func StartServer(s store.Store, m *engine.ConnectionManager) *http.Server {
+	router := NewRouter(s, m)
 
 	log.Println("")
 	log.Println(fmt.Sprintf("Starting server on http://localhost:%d", cfg.Config.Server.Port))
+	log.Println("\tGET     /types                         - List Sender and Receiver Types")
+	log.Println("")
 	log.Println("\tPUT     /connection                    - Add a connection")
 	log.Println("\tGET     /connection                    - List Connections")
 	log.Println("\tGET     /connection/[uuid]             - Read Connection Status")
+	log.Println("\tPATCH   /connection/[uuid]             - Update a Connection's config")
 	log.Println("\tDELETE  /connection/[uuid]             - Shut down and delete a Connection")
+	log.Println("\tDELETE  /connection/[uuid]?drain=[secs] - Drain, shut down and delete a Connection")
+	log.Println("\tGET     /connection/[uuid]/export      - Export unfinished Messages as JSON lines")
+	log.Println("\tPOST    /connection/[uuid]/start       - Start a stopped Connection")
+	log.Println("\tPOST    /connection/[uuid]/stop        - Stop a Connection")
+	log.Println("\tPOST    /connection/[uuid]/restart     - Restart a Connection")
+	log.Println("\tPOST    /connection/[uuid]/pause       - Pause sending on a Connection")
+	log.Println("\tPOST    /connection/[uuid]/resume      - Resume sending on a Connection")
 	log.Println("")
 	log.Println("\tPUT     /connection/[uuid]/send        - Send Message")
 	log.Println("\tGET     /connection/[uuid]/status/[id] - Get Message Status")
+	log.Println("\tGET     /connection/[uuid]/external/[id] - Get Message Status by its external id")
+	log.Println("")
+	log.Println("\tGET     /connection/[uuid]/deadletter  - List Dead Lettered Messages")
+	log.Println("\tPOST    /connection/[uuid]/deadletter/[id]/replay - Replay a Dead Lettered Message")
+	log.Println("\tDELETE  /connection/[uuid]/deadletter/[id] - Drop a Dead Lettered Message")
+	log.Println("")
+	log.Println("\tGET     /connection/[uuid]/scheduled   - List Scheduled Messages")
+	log.Println("\tDELETE  /connection/[uuid]/scheduled/[id] - Cancel a Scheduled Message")
+	log.Println("")
+	log.Println("\tPUT     /connection/[uuid]/blob        - Upload a Blob to attach to Messages")
+	log.Println("\tGET     /connection/[uuid]/blob/[id]   - Read a Blob")
+	log.Println("")
+	log.Println("\tPUT     /twitter/authorize             - Link a Twitter account to a new Connection")
+	log.Println("\tPOST    /connection/[uuid]/twitter/authorize - Link a Twitter account to a Connection")
+	log.Println("\tGET     /twitter/callback              - Where Twitter sends users who authorized us")
 	log.Println("")
 
 	log.Println()
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Config.Server.Port), router))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Config.Server.Port), Handler: router}
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	return server
 }
@@ -0,0 +1,165 @@
+package http_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	gohttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/junebug/engine"
+	"github.com/nyaruka/junebug/http"
+	"github.com/nyaruka/junebug/store"
+)
+
+// starts serving our API against a fresh memory store, callers should close the returned server
+// and stop its manager's connections
+func startServer(t *testing.T) (*httptest.Server, *engine.ConnectionManager, store.Store) {
+	s := store.NewMemoryStore()
+	manager := engine.NewConnectionManager(s)
+	server := httptest.NewServer(http.NewRouter(s, manager))
+	return server, manager, s
+}
+
+// makes a request against the passed in server, returning the response and its body
+func request(t *testing.T, server *httptest.Server, method string, path string, contentType string, body io.Reader) (*gohttp.Response, string) {
+	req, err := gohttp.NewRequest(method, server.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := gohttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+// makes a request that must succeed, decoding its JSON response into the passed in value
+func requestJson(t *testing.T, server *httptest.Server, method string, path string, body string, value interface{}) {
+	resp, data := request(t, server, method, path, "application/json", strings.NewReader(body))
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected 200 from %s %s, got %d: %s", method, path, resp.StatusCode, data)
+	}
+	if value != nil {
+		err := json.Unmarshal([]byte(data), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// adds an echo connection through our API, returning its uuid
+func addEchoConnection(t *testing.T, server *httptest.Server) string {
+	var connection store.Connection
+	requestJson(t, server, "PUT", "/connection", `{"senders": {"type": "echo", "config": {"pause": "0"}},
+		"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`, &connection)
+	return connection.Uuid
+}
+
+func TestReadExternalMessage(t *testing.T) {
+	server, manager, s := startServer(t)
+	defer server.Close()
+	defer manager.StopAll(5 * time.Second)
+
+	uuid := addEchoConnection(t, server)
+
+	var sent store.Msg
+	requestJson(t, server, "PUT", "/connection/"+uuid+"/send", `{"address": "+250788383383", "text": "Hello"}`, &sent)
+
+	// once sent, our msg can be looked up by the id our echo transport gave it
+	externalId := fmt.Sprintf("echo-%d", sent.Id)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if _, err := s.GetMsgIdByExternalId(uuid, externalId); err == nil {
+			break
+		}
+	}
+
+	var msg store.Msg
+	requestJson(t, server, "GET", "/connection/"+uuid+"/external/"+externalId, "", &msg)
+	if msg.Id != sent.Id || msg.ExternalId != externalId {
+		t.Errorf("Expected our sent msg, got %+v", msg)
+	}
+
+	// unknown external ids, or those of other connections, aren't found
+	resp, _ := request(t, server, "GET", "/connection/"+uuid+"/external/echo-0", "", nil)
+	if resp.StatusCode != gohttp.StatusNotFound {
+		t.Errorf("Expected 404 for unknown external id, got %d", resp.StatusCode)
+	}
+
+	// nor are those of msgs that were dropped
+	incoming := store.MsgFromText(s, uuid, "+250788383383", "Hi")
+	incoming.ExternalId = "ext1"
+	err := incoming.WriteToInbox()
+	if err == nil {
+		err = incoming.MarkDeadLettered("gave up")
+	}
+	id := incoming.Id
+	incoming.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ = request(t, server, "DELETE", fmt.Sprintf("/connection/%s/deadletter/%d", uuid, id), "", nil)
+	if resp.StatusCode != gohttp.StatusNoContent {
+		t.Fatalf("Expected dead letter to be dropped, got %d", resp.StatusCode)
+	}
+
+	resp, _ = request(t, server, "GET", "/connection/"+uuid+"/external/ext1", "", nil)
+	if resp.StatusCode != gohttp.StatusNotFound {
+		t.Errorf("Expected 404 for dropped msg's external id, got %d", resp.StatusCode)
+	}
+
+	other := addEchoConnection(t, server)
+	resp, _ = request(t, server, "GET", "/connection/"+other+"/external/"+externalId, "", nil)
+	if resp.StatusCode != gohttp.StatusNotFound {
+		t.Errorf("Expected 404 for another connection's external id, got %d", resp.StatusCode)
+	}
+}
+
+func TestDeleteDrained(t *testing.T) {
+	server, manager, _ := startServer(t)
+	defer server.Close()
+	defer manager.StopAll(5 * time.Second)
+
+	// our echo comes back to a receiver that can't hand it off, so is left over after draining
+	uuid := addEchoConnection(t, server)
+	requestJson(t, server, "PUT", "/connection/"+uuid+"/send", `{"address": "+250788383383", "text": "Hello"}`, nil)
+
+	resp, body := request(t, server, "DELETE", "/connection/"+uuid+"?drain=1", "", nil)
+	if resp.StatusCode != gohttp.StatusConflict || !strings.Contains(body, "now stopped") {
+		t.Fatalf("Expected 409 saying our connection is stopped, got %d: %s", resp.StatusCode, body)
+	}
+
+	// our connection is kept, but stopped
+	var conn http.ConnectionResponse
+	requestJson(t, server, "GET", "/connection/"+uuid, "", &conn)
+	if conn.State != engine.STATE_STOPPED {
+		t.Errorf("Expected connection to be stopped after draining, was %s", conn.State)
+	}
+
+	// until it is started again, or deleted without draining
+	requestJson(t, server, "POST", "/connection/"+uuid+"/start", "", nil)
+	requestJson(t, server, "GET", "/connection/"+uuid, "", &conn)
+	if conn.State != engine.STATE_RUNNING {
+		t.Errorf("Expected connection to be running once started, was %s", conn.State)
+	}
+
+	requestJson(t, server, "DELETE", "/connection/"+uuid, "", nil)
+	resp, _ = request(t, server, "GET", "/connection/"+uuid, "", nil)
+	if resp.StatusCode == 200 {
+		t.Error("Expected connection to be gone once deleted")
+	}
+}
@@ -0,0 +1,189 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/go-oauth/oauth"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nyaruka/junebug/cfg"
+	"github.com/nyaruka/junebug/engine"
+	"github.com/nyaruka/junebug/store"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Twitter accounts are linked with Twitter's three legged OAuth flow. A client starts linking an
+// account, either for a new connection or an existing one, and sends the account's user to the
+// authorization URL we return. Once they authorize us Twitter sends them to our callback, where
+// we create or update the connection with the account's credentials and username.
+
+// how long a user has to authorize us before we forget about their authorization, a var so tests
+// can expire authorizations without waiting
+var TWITTER_AUTHORIZATION_TIMEOUT = 15 * time.Minute
+
+// a Twitter authorization we are waiting on the callback for
+type twitterAuthorization struct {
+	temporary  *oauth.Credentials
+	connection *store.Connection
+	existing   bool
+	started    time.Time
+}
+
+// our pending authorizations, by their temporary token, these don't survive a restart
+var twitterAuthorizations = make(map[string]*twitterAuthorization)
+var twitterAuthorizationsMutex sync.Mutex
+
+type TwitterAuthorizationResponse struct {
+	AuthorizationUrl string `json:"authorization_url"`
+}
+
+// starts linking a Twitter account for a new connection, the body is the connection as for adding
+// one, without its twitter credentials
+func authorizeNewTwitter(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	connection, err := store.ConnectionFromJson(db, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if connection.Senders.Type != "twitter" {
+		http.Error(w, "Sender `type` must be `twitter`", http.StatusBadRequest)
+		return
+	}
+
+	// check what we can now, rather than after the user has authorized us
+	err = engine.ValidateReceivers(connection)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	startTwitterAuthorization(w, r, connection, false)
+}
+
+// starts linking a Twitter account for an existing twitter connection, replacing its credentials
+func authorizeExistingTwitter(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	connection, err := store.ConnectionFromUuid(db, ps.ByName("conn_uuid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if connection.Senders.Type != "twitter" {
+		http.Error(w, fmt.Sprintf("Connection %s is not a twitter connection", connection.Uuid), http.StatusBadRequest)
+		return
+	}
+
+	startTwitterAuthorization(w, r, connection, true)
+}
+
+func startTwitterAuthorization(w http.ResponseWriter, r *http.Request, connection *store.Connection, existing bool) {
+	// we don't trust the host we were reached through to send our users back to, it is up to our caller
+	callbackUrl := cfg.Config.Twitter.Callback_Url
+	if callbackUrl == "" {
+		http.Error(w, "Linking Twitter accounts needs `callback-url` set in our `twitter` settings", http.StatusInternalServerError)
+		return
+	}
+
+	temporary, authorizationUrl, err := engine.StartTwitterAuthorization(callbackUrl)
+	if err != nil {
+		http.Error(w, "Error starting Twitter authorization: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	twitterAuthorizationsMutex.Lock()
+	for token, authorization := range twitterAuthorizations {
+		if time.Since(authorization.started) > TWITTER_AUTHORIZATION_TIMEOUT {
+			delete(twitterAuthorizations, token)
+		}
+	}
+	twitterAuthorizations[temporary.Token] = &twitterAuthorization{
+		temporary:  temporary,
+		connection: connection,
+		existing:   existing,
+		started:    time.Now()}
+	twitterAuthorizationsMutex.Unlock()
+
+	js, err := json.Marshal(TwitterAuthorizationResponse{authorizationUrl})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// where Twitter sends users once they've authorized us, or declined to
+func twitterCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query := r.URL.Query()
+
+	// users who decline come back with their token in denied instead
+	token := query.Get("oauth_token")
+	if token == "" {
+		token = query.Get("denied")
+	}
+
+	twitterAuthorizationsMutex.Lock()
+	authorization, found := twitterAuthorizations[token]
+	delete(twitterAuthorizations, token)
+	twitterAuthorizationsMutex.Unlock()
+
+	if !found || time.Since(authorization.started) > TWITTER_AUTHORIZATION_TIMEOUT {
+		http.Error(w, "Unknown or expired Twitter authorization, please start again", http.StatusBadRequest)
+		return
+	}
+	if query.Get("denied") != "" {
+		http.Error(w, "Twitter authorization was declined", http.StatusForbidden)
+		return
+	}
+
+	config, err := engine.FinishTwitterAuthorization(authorization.temporary, query.Get("oauth_verifier"))
+	if err != nil {
+		http.Error(w, "Error finishing Twitter authorization: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	connection, err := linkTwitter(authorization, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	readConnection(w, r, httprouter.Params{{Key: "conn_uuid", Value: connection.Uuid}})
+}
+
+// creates or updates the connection of the passed in authorization with the passed in twitter config
+func linkTwitter(authorization *twitterAuthorization, config map[string]string) (*store.Connection, error) {
+	if !authorization.existing {
+		connection := authorization.connection
+		if connection.Senders.Config == nil {
+			connection.Senders.Config = make(map[string]string)
+		}
+		for key, value := range config {
+			connection.Senders.Config[key] = value
+		}
+		return connection, manager.Add(connection)
+	}
+
+	// reload our connection, it may have changed while we were waiting on our user
+	connection, err := store.ConnectionFromUuid(db, authorization.connection.Uuid)
+	if err != nil {
+		return nil, err
+	}
+	if connection.Senders.Type != "twitter" {
+		return nil, errors.New(fmt.Sprintf("Connection %s is no longer a twitter connection", connection.Uuid))
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{"senders": map[string]interface{}{"config": config}})
+	if err != nil {
+		return nil, err
+	}
+	updated, err := connection.Patch(bytes.NewReader(patch))
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, manager.Update(updated, cfg.Config.ShutdownTimeout())
+}
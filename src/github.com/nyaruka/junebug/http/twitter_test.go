@@ -0,0 +1,292 @@
+package http_test
+
+import (
+	"encoding/json"
+	"fmt"
+	gohttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/nyaruka/junebug/cfg"
+	"github.com/nyaruka/junebug/engine"
+	"github.com/nyaruka/junebug/http"
+	"github.com/nyaruka/junebug/store"
+)
+
+// a Twitter that never sends us anything, so the connections we link don't stream from the real one
+type idleTwitter struct{}
+
+func (idleTwitter) UserStream() engine.TwitterStream {
+	return engine.TwitterStream{C: make(chan interface{}), Quit: make(chan bool), Interrupt: func() {}}
+}
+
+func (idleTwitter) GetDirectMessages(v url.Values) ([]anaconda.DirectMessage, error) {
+	return nil, nil
+}
+
+func (idleTwitter) GetSelf(v url.Values) (anaconda.User, error) {
+	return anaconda.User{ScreenName: "JuneBug"}, nil
+}
+
+func (idleTwitter) Close() {}
+
+var authorizationParam = regexp.MustCompile(`(oauth_\w+)="([^"]*)"`)
+
+// reads the passed in OAuth param from either the body or the authorization header of our request
+func oauthParam(r *gohttp.Request, name string) string {
+	r.ParseForm()
+	if value := r.Form.Get(name); value != "" {
+		return value
+	}
+
+	for _, match := range authorizationParam.FindAllStringSubmatch(r.Header.Get("Authorization"), -1) {
+		if match[1] == name {
+			value, _ := url.QueryUnescape(match[2])
+			return value
+		}
+	}
+	return ""
+}
+
+// stands in for Twitter's OAuth endpoints, handing out numbered temporary tokens which it exchanges
+// for access tokens as long as they come with our user's verifier, access tokens verify as our
+// user's account
+func startOAuthStub(t *testing.T) (*httptest.Server, func()) {
+	var mutex sync.Mutex
+	issued := 0
+
+	stub := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		switch r.URL.Path {
+		case "/oauth/request_token":
+			mutex.Lock()
+			issued++
+			token := fmt.Sprintf("temp%d", issued)
+			mutex.Unlock()
+			if oauthParam(r, "oauth_callback") != "https://junebug.example.com/twitter/callback" {
+				gohttp.Error(w, "Unexpected callback", gohttp.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, "oauth_token=%s&oauth_token_secret=%s-secret&oauth_callback_confirmed=true", token, token)
+
+		case "/oauth/access_token":
+			if oauthParam(r, "oauth_verifier") != "verified" {
+				gohttp.Error(w, "Invalid verifier", gohttp.StatusUnauthorized)
+				return
+			}
+			token := oauthParam(r, "oauth_token")
+			fmt.Fprintf(w, "oauth_token=access-%s&oauth_token_secret=secret-%s", token, token)
+
+		case "/1.1/account/verify_credentials.json":
+			if !strings.HasPrefix(oauthParam(r, "oauth_token"), "access-") {
+				gohttp.Error(w, `{"errors": [{"code": 89, "message": "Invalid or expired token."}]}`, gohttp.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"id_str": "1234", "screen_name": "JuneBug"}`)
+
+		default:
+			gohttp.NotFound(w, r)
+		}
+	}))
+
+	requestUrl, authorizeUrl, accessUrl := engine.TWITTER_REQUEST_TOKEN_URL, engine.TWITTER_AUTHORIZE_URL, engine.TWITTER_ACCESS_TOKEN_URL
+	verifyUrl := engine.TWITTER_VERIFY_CREDENTIALS_URL
+	callbackUrl := cfg.Config.Twitter.Callback_Url
+	newApi := engine.NewTwitterStreamApi
+
+	engine.TWITTER_REQUEST_TOKEN_URL = stub.URL + "/oauth/request_token"
+	engine.TWITTER_AUTHORIZE_URL = stub.URL + "/oauth/authorize"
+	engine.TWITTER_ACCESS_TOKEN_URL = stub.URL + "/oauth/access_token"
+	engine.TWITTER_VERIFY_CREDENTIALS_URL = stub.URL + "/1.1/account/verify_credentials.json"
+	cfg.Config.Twitter.Callback_Url = "https://junebug.example.com/twitter/callback"
+	engine.NewTwitterStreamApi = func(token string, secret string) engine.TwitterStreamApi { return idleTwitter{} }
+
+	return stub, func() {
+		stub.Close()
+		engine.TWITTER_REQUEST_TOKEN_URL, engine.TWITTER_AUTHORIZE_URL, engine.TWITTER_ACCESS_TOKEN_URL = requestUrl, authorizeUrl, accessUrl
+		engine.TWITTER_VERIFY_CREDENTIALS_URL = verifyUrl
+		cfg.Config.Twitter.Callback_Url = callbackUrl
+		engine.NewTwitterStreamApi = newApi
+	}
+}
+
+// starts an authorization with the passed in request, returning the temporary token our user
+// would authorize
+func authorize(t *testing.T, server *httptest.Server, stub *httptest.Server, method string, path string, body string) string {
+	var resp http.TwitterAuthorizationResponse
+	requestJson(t, server, method, path, body, &resp)
+
+	authorizationUrl, err := url.Parse(resp.AuthorizationUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.AuthorizationUrl, stub.URL+"/oauth/authorize?") {
+		t.Errorf("Expected to be sent to Twitter to authorize us, got %s", resp.AuthorizationUrl)
+	}
+	return authorizationUrl.Query().Get("oauth_token")
+}
+
+// makes the request Twitter would send our user back to us with
+func callback(t *testing.T, server *httptest.Server, query string) (*gohttp.Response, string) {
+	return request(t, server, "GET", "/twitter/callback?"+query, "", nil)
+}
+
+const newTwitterConnection = `{"senders": {"type": "twitter"},
+	"receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`
+
+func TestTwitterAuthorization(t *testing.T) {
+	stub, restore := startOAuthStub(t)
+	defer restore()
+
+	server, manager, s := startServer(t)
+	defer server.Close()
+	defer manager.StopAll(5 * time.Second)
+
+	// callbacks for authorizations we never started are rejected
+	resp, _ := callback(t, server, "oauth_token=unknown&oauth_verifier=verified")
+	if resp.StatusCode != gohttp.StatusBadRequest {
+		t.Errorf("Expected 400 for unknown authorization, got %d", resp.StatusCode)
+	}
+
+	// once our user authorizes us, we add their connection with their account's credentials
+	token := authorize(t, server, stub, "PUT", "/twitter/authorize", newTwitterConnection)
+	resp, body := callback(t, server, "oauth_token="+token+"&oauth_verifier=verified")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected connection to be linked, got %d: %s", resp.StatusCode, body)
+	}
+
+	var linked http.ConnectionResponse
+	err := json.Unmarshal([]byte(body), &linked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := linked.Connection.Senders.Config
+	if config[engine.USERNAME] != "JuneBug" || config[engine.ACCESS_TOKEN] != "access-"+token ||
+		config[engine.ACCESS_TOKEN_SECRET] != "secret-"+token {
+		t.Errorf("Expected connection to be linked to our account, got %v", config)
+	}
+	if linked.State != engine.STATE_RUNNING {
+		t.Errorf("Expected linked connection to be running, was %s", linked.State)
+	}
+	uuid := linked.Connection.Uuid
+
+	// each authorization can only be finished once
+	resp, _ = callback(t, server, "oauth_token="+token+"&oauth_verifier=verified")
+	if resp.StatusCode != gohttp.StatusBadRequest {
+		t.Errorf("Expected 400 finishing an authorization again, got %d", resp.StatusCode)
+	}
+
+	// users who decline to authorize us are told so, and their authorization is forgotten
+	token = authorize(t, server, stub, "PUT", "/twitter/authorize", newTwitterConnection)
+	resp, _ = callback(t, server, "denied="+token)
+	if resp.StatusCode != gohttp.StatusForbidden {
+		t.Errorf("Expected 403 for declined authorization, got %d", resp.StatusCode)
+	}
+	resp, _ = callback(t, server, "oauth_token="+token+"&oauth_verifier=verified")
+	if resp.StatusCode != gohttp.StatusBadRequest {
+		t.Errorf("Expected 400 finishing a declined authorization, got %d", resp.StatusCode)
+	}
+
+	// Twitter refusing our verifier isn't our client's fault
+	token = authorize(t, server, stub, "PUT", "/twitter/authorize", newTwitterConnection)
+	resp, _ = callback(t, server, "oauth_token="+token+"&oauth_verifier=forged")
+	if resp.StatusCode != gohttp.StatusBadGateway {
+		t.Errorf("Expected 502 when Twitter rejects our verifier, got %d", resp.StatusCode)
+	}
+
+	// our linked connection can be linked again, which updates its running engine
+	token = authorize(t, server, stub, "POST", "/connection/"+uuid+"/twitter/authorize", "")
+	resp, body = callback(t, server, "oauth_token="+token+"&oauth_verifier=verified")
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected connection to be linked again, got %d: %s", resp.StatusCode, body)
+	}
+
+	connection, err := store.ConnectionFromUuid(s, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connection.Senders.Config[engine.ACCESS_TOKEN] != "access-"+token {
+		t.Errorf("Expected relinked connection to have our new credentials, got %v", connection.Senders.Config)
+	}
+	running, err := manager.Get(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running.Connection.Senders.Config[engine.ACCESS_TOKEN] != "access-"+token {
+		t.Errorf("Expected running connection to be updated, got %v", running.Connection.Senders.Config)
+	}
+
+	// only twitter connections can be linked to Twitter accounts
+	resp, _ = request(t, server, "PUT", "/twitter/authorize", "application/json", strings.NewReader(
+		`{"senders": {"type": "echo"}, "receivers": {"type": "http", "config": {"url": "http://localhost/receive"}}}`))
+	if resp.StatusCode != gohttp.StatusBadRequest {
+		t.Errorf("Expected 400 authorizing a new echo connection, got %d", resp.StatusCode)
+	}
+
+	echo := addEchoConnection(t, server)
+	resp, _ = request(t, server, "POST", "/connection/"+echo+"/twitter/authorize", "", nil)
+	if resp.StatusCode != gohttp.StatusBadRequest {
+		t.Errorf("Expected 400 authorizing an existing echo connection, got %d", resp.StatusCode)
+	}
+}
+
+func TestTwitterAuthorizationTimeout(t *testing.T) {
+	stub, restore := startOAuthStub(t)
+	defer restore()
+
+	server, manager, _ := startServer(t)
+	defer server.Close()
+	defer manager.StopAll(5 * time.Second)
+
+	timeout := http.TWITTER_AUTHORIZATION_TIMEOUT
+	defer func() { http.TWITTER_AUTHORIZATION_TIMEOUT = timeout }()
+	http.TWITTER_AUTHORIZATION_TIMEOUT = 50 * time.Millisecond
+
+	// users who take too long to authorize us have to start again
+	token := authorize(t, server, stub, "PUT", "/twitter/authorize", newTwitterConnection)
+	time.Sleep(100 * time.Millisecond)
+
+	resp, _ := callback(t, server, "oauth_token="+token+"&oauth_verifier=verified")
+	if resp.StatusCode != gohttp.StatusBadRequest {
+		t.Errorf("Expected 400 for expired authorization, got %d", resp.StatusCode)
+	}
+	if uuids := manager.Uuids(); len(uuids) != 0 {
+		t.Errorf("Expected no connection to be added, got %v", uuids)
+	}
+}
+
+func TestTwitterAuthorizationCallbackUrl(t *testing.T) {
+	_, restore := startOAuthStub(t)
+	defer restore()
+
+	server, manager, _ := startServer(t)
+	defer server.Close()
+	defer manager.StopAll(5 * time.Second)
+
+	// we only send users back to the callback we were configured with, whatever host we were reached through
+	req, err := gohttp.NewRequest("PUT", server.URL+"/twitter/authorize", strings.NewReader(newTwitterConnection))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "evil.example.com"
+	resp, err := gohttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected authorization to start with our configured callback, got %d", resp.StatusCode)
+	}
+
+	// and can't link accounts without one
+	cfg.Config.Twitter.Callback_Url = ""
+	resp, body := request(t, server, "PUT", "/twitter/authorize", "application/json", strings.NewReader(newTwitterConnection))
+	if resp.StatusCode != gohttp.StatusInternalServerError || !strings.Contains(body, "callback-url") {
+		t.Errorf("Expected 500 without a callback url, got %d: %s", resp.StatusCode, body)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/nyaruka/junebug/cfg"
@@ -8,8 +10,13 @@ import (
 	"github.com/nyaruka/junebug/http"
 	"github.com/nyaruka/junebug/store"
 	"log"
+	gohttp "net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -38,46 +45,69 @@ func main() {
 	runtime.GOMAXPROCS(*procs)
 
 	// Open our Database
-	store.OpenDB(config.Db.Filename)
-
-	// load our connection configurations
-	connections, err := store.LoadAllConnections()
+	db, err := openStore(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	fmt.Println("")
 
-	// for each one, create a real connection
-	engines := make(map[string]*engine.ConnectionEngine)
-	for i := 0; i < len(*connections); i++ {
-		connection := (*connections)[i]
-
-		// warm our cache by getting our status
-		_, err = connection.GetStatus()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// and create our actual connection
-		engine, err := engine.NewConnectionEngine(&connection)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		engine.Start()
-		incoming, outgoing, err := engine.AddPendingMsgsFromDB()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		log.Printf("[%.8s] Started with %d queued outgoing, %d queued incoming\n",
-			connection.Uuid, outgoing, incoming)
-
-		// stash it
-		engines[connection.Uuid] = engine
+	// start all our connections
+	manager := engine.NewConnectionManager(db)
+	err = manager.StartAll()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// start our server
-	http.StartServer(&engines)
+	server := http.StartServer(db, manager)
+
+	// run until we are told to stop
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	log.Printf("Received %s, shutting down\n", sig)
+	shutdown(server, manager, db, config.ShutdownTimeout())
+	log.Println("Shutdown complete")
+}
+
+// Stops accepting requests, then stops all our connections, giving their in-flight msgs until our
+// timeout to finish, before closing our store. Msgs still in flight are reconciled once their lease
+// expires after our next start, they are requeued or failed depending on their sender type.
+func shutdown(server *gohttp.Server, manager *engine.ConnectionManager, db store.Store, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// wait for any requests we are in the middle of, no new ones will make it to our connections
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Error stopping server: %s\n", err.Error())
+	}
+
+	// workers that didn't finish in time may still be writing to our store as we close it
+	unstopped := manager.StopAll(time.Until(deadline))
+	if len(unstopped) > 0 {
+		log.Printf("Closing store while connections are still stopping: %s\n", strings.Join(unstopped, ", "))
+	}
+
+	err = db.Close()
+	if err != nil {
+		log.Printf("Error closing store: %s\n", err.Error())
+	}
+}
+
+// Opens the store our config asks for, bolt if none is set
+func openStore(config cfg.ConfigFormat) (store.Store, error) {
+	switch config.Db.Backend {
+	case "", "bolt":
+		return store.OpenBoltStore(config.Db.Filename)
+	case "postgres":
+		return store.OpenPostgresStore(config.Db.Url)
+	case "memory":
+		return store.NewMemoryStore(), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported db backend: `%s`", config.Db.Backend))
+	}
 }
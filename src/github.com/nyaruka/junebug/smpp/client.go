@@ -0,0 +1,351 @@
+package smpp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const DEFAULT_ENQUIRE_LINK = 30 * time.Second
+const DEFAULT_TIMEOUT = 10 * time.Second
+const MIN_REBIND_DELAY = time.Second
+const MAX_REBIND_DELAY = 30 * time.Second
+
+var ErrNotBound = errors.New("Not bound to SMSC")
+var ErrStopped = errors.New("SMPP client stopped")
+
+// The error returned when the SMSC responds with a non-zero command status
+type StatusError uint32
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("SMSC returned error status 0x%08x", uint32(e))
+}
+
+// Client maintains a single transceiver bind to an SMSC. Once started it will keep
+// trying to (re)bind whenever the connection drops, sending enquire_links to detect
+// dead connections, until it is stopped.
+//
+// Messages delivered by the SMSC (deliver_sm) are pushed onto the Delivered channel,
+// they are only acknowledged once they have been read off of it.
+type Client struct {
+	Delivered chan *ShortMessage
+
+	addr        string
+	bind        Bind
+	enquireLink time.Duration
+	timeout     time.Duration
+
+	mutex   sync.Mutex
+	conn    net.Conn
+	bound   chan int // closed once we are bound, replaced each time we lose our bind
+	seq     uint32
+	pending map[uint32]chan *PDU
+
+	writeMutex sync.Mutex
+	done       chan int
+	wg         sync.WaitGroup
+}
+
+// Creates a new client for the SMSC at the passed in address, enquireLink is how often
+// we check our bind is still alive
+func NewClient(addr string, bind Bind, enquireLink time.Duration) *Client {
+	if enquireLink <= 0 {
+		enquireLink = DEFAULT_ENQUIRE_LINK
+	}
+
+	return &Client{
+		Delivered:   make(chan *ShortMessage),
+		addr:        addr,
+		bind:        bind,
+		enquireLink: enquireLink,
+		timeout:     DEFAULT_TIMEOUT,
+		bound:       make(chan int),
+		pending:     make(map[uint32]chan *PDU),
+		done:        make(chan int)}
+}
+
+// Starts the goroutine that maintains our bind
+func (c *Client) Start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		delay := MIN_REBIND_DELAY
+
+		for {
+			wasBound, err := c.session()
+
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+
+			// only back off further if we are failing to bind at all
+			if wasBound {
+				delay = MIN_REBIND_DELAY
+			}
+
+			log.Printf("[smpp][%s] Lost bind: %s, rebinding in %s", c.addr, err.Error(), delay)
+
+			select {
+			case <-time.After(delay):
+			case <-c.done:
+				return
+			}
+
+			delay *= 2
+			if delay > MAX_REBIND_DELAY {
+				delay = MAX_REBIND_DELAY
+			}
+		}
+	}()
+}
+
+// Stops our client, unbinding if we are currently bound, blocks until all our goroutines have exited
+func (c *Client) Stop() {
+	if c.IsBound() {
+		// be polite, but don't wait around long for the SMSC to answer
+		_, err := c.request(UNBIND, nil, time.Second)
+		if err != nil {
+			log.Printf("[smpp][%s] Error unbinding: %s", c.addr, err.Error())
+		}
+	}
+
+	close(c.done)
+	c.wg.Wait()
+}
+
+// Whether we are currently bound to the SMSC
+func (c *Client) IsBound() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn != nil
+}
+
+// Submits the passed in message, returning the message id assigned by the SMSC. If we are
+// not currently bound, we wait up to our timeout for a bind to be established.
+func (c *Client) Submit(sm *ShortMessage) (string, error) {
+	c.mutex.Lock()
+	bound := c.bound
+	c.mutex.Unlock()
+
+	select {
+	case <-bound:
+	case <-time.After(c.timeout):
+		return "", ErrNotBound
+	case <-c.done:
+		return "", ErrStopped
+	}
+
+	resp, err := c.request(SUBMIT_SM, sm.Bytes(), c.timeout)
+	if err != nil {
+		return "", err
+	}
+
+	return MessageIdFromBytes(resp.Body)
+}
+
+// Dials and binds to our SMSC, then services the connection until it drops. Returns
+// whether we managed to bind and the error which ended the session.
+func (c *Client) session() (bool, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return false, err
+	}
+
+	// close our connection if we are stopped, this is what breaks us out of our read loop
+	sessionDone := make(chan int)
+	defer close(sessionDone)
+	go func() {
+		select {
+		case <-c.done:
+		case <-sessionDone:
+		}
+		conn.Close()
+	}()
+
+	// bind synchronously, nothing else can happen on this connection until we are bound
+	c.mutex.Lock()
+	req := &PDU{CommandId: BIND_TRANSCEIVER, Sequence: c.nextSequence(), Body: c.bind.Bytes()}
+	c.mutex.Unlock()
+
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err = conn.Write(req.Bytes())
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := ReadPDU(conn)
+	if err != nil {
+		return false, err
+	}
+	if resp.CommandId != BIND_TRANSCEIVER_RESP || resp.Sequence != req.Sequence {
+		return false, errors.New(fmt.Sprintf("Unexpected response to bind: %s", resp))
+	}
+	if resp.Status != ESME_ROK {
+		return false, StatusError(resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// we are bound, let everybody know
+	c.mutex.Lock()
+	c.conn = conn
+	close(c.bound)
+	c.mutex.Unlock()
+
+	log.Printf("[smpp][%s] Bound as transceiver with system id '%s'", c.addr, c.bind.SystemId)
+
+	// keep our link alive, closing our connection if the SMSC stops answering
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.enquireLink)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				_, err := c.request(ENQUIRE_LINK, nil, c.timeout)
+				if err != nil {
+					log.Printf("[smpp][%s] Enquire link failed: %s", c.addr, err.Error())
+					conn.Close()
+					return
+				}
+			case <-sessionDone:
+				return
+			}
+		}
+	}()
+
+	err = c.readLoop(conn)
+
+	// we are no longer bound, fail anything waiting on a response
+	c.mutex.Lock()
+	c.conn = nil
+	c.bound = make(chan int)
+	for seq, ch := range c.pending {
+		close(ch)
+		delete(c.pending, seq)
+	}
+	c.mutex.Unlock()
+
+	return true, err
+}
+
+// Reads PDUs off our connection until it errors
+func (c *Client) readLoop(conn net.Conn) error {
+	for {
+		pdu, err := ReadPDU(conn)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case pdu.IsResponse():
+			c.mutex.Lock()
+			ch, found := c.pending[pdu.Sequence]
+			delete(c.pending, pdu.Sequence)
+			c.mutex.Unlock()
+
+			if found {
+				ch <- pdu
+			}
+
+		case pdu.CommandId == DELIVER_SM:
+			sm, decodeErr := ShortMessageFromBytes(pdu.Body)
+			if decodeErr != nil {
+				log.Printf("[smpp][%s] Error decoding deliver_sm: %s", c.addr, decodeErr.Error())
+				err = c.write(conn, pdu.Response(ESME_RSYSERR, MessageIdBytes("")))
+				break
+			}
+
+			// only ack once our message has been taken, this way a backed up consumer
+			// pushes back on the SMSC instead of us losing messages
+			select {
+			case c.Delivered <- sm:
+			case <-c.done:
+				return ErrStopped
+			}
+			err = c.write(conn, pdu.Response(ESME_ROK, MessageIdBytes("")))
+
+		case pdu.CommandId == ENQUIRE_LINK:
+			err = c.write(conn, pdu.Response(ESME_ROK, nil))
+
+		case pdu.CommandId == UNBIND:
+			c.write(conn, pdu.Response(ESME_ROK, nil))
+			return errors.New("SMSC requested unbind")
+
+		default:
+			err = c.write(conn, &PDU{CommandId: GENERIC_NACK, Status: ESME_RINVCMDID, Sequence: pdu.Sequence})
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Sends a request to the SMSC, waiting up to timeout for the response
+func (c *Client) request(commandId uint32, body []byte, timeout time.Duration) (*PDU, error) {
+	c.mutex.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mutex.Unlock()
+		return nil, ErrNotBound
+	}
+	seq := c.nextSequence()
+	ch := make(chan *PDU, 1)
+	c.pending[seq] = ch
+	c.mutex.Unlock()
+
+	err := c.write(conn, &PDU{CommandId: commandId, Sequence: seq, Body: body})
+	if err != nil {
+		c.forget(seq)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, ErrNotBound
+		}
+		if resp.Status != ESME_ROK {
+			return resp, StatusError(resp.Status)
+		}
+		if resp.CommandId == GENERIC_NACK {
+			return resp, errors.New(fmt.Sprintf("SMSC rejected request: %s", resp))
+		}
+		return resp, nil
+
+	case <-time.After(timeout):
+		c.forget(seq)
+		return nil, errors.New(fmt.Sprintf("Timed out waiting for response to command 0x%08x", commandId))
+	}
+}
+
+// Stops waiting on a response for the passed in sequence number
+func (c *Client) forget(seq uint32) {
+	c.mutex.Lock()
+	delete(c.pending, seq)
+	c.mutex.Unlock()
+}
+
+// Writes a single PDU, our goroutines share a connection so writes are serialized
+func (c *Client) write(conn net.Conn, pdu *PDU) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := conn.Write(pdu.Bytes())
+	return err
+}
+
+// Returns our next sequence number, callers must hold our mutex
+func (c *Client) nextSequence() uint32 {
+	// sequence numbers are only allowed to go up to 0x7FFFFFFF
+	c.seq = c.seq%0x7FFFFFFF + 1
+	return c.seq
+}
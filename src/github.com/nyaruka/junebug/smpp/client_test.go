@@ -0,0 +1,184 @@
+package smpp
+
+import (
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, desc string, check func() bool) {
+	for i := 0; i < 100; i++ {
+		if check() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", desc)
+}
+
+func TestShortMessageRoundTrip(t *testing.T) {
+	sm := &ShortMessage{
+		Source:             "1234",
+		Destination:        "+250788383383",
+		RegisteredDelivery: 1,
+		ValidityPeriod:     "000001000000000R",
+		Message:            []byte("Hello World"),
+		TLVs:               map[uint16][]byte{0x001E: []byte("abc\x00")}}
+
+	decoded, err := ShortMessageFromBytes(sm.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Source != "1234" || decoded.Destination != "+250788383383" || string(decoded.Message) != "Hello World" {
+		t.Errorf("Decoded message doesn't match: %+v", decoded)
+	}
+	if decoded.RegisteredDelivery != 1 || decoded.ValidityPeriod != "000001000000000R" {
+		t.Errorf("Decoded flags don't match: %+v", decoded)
+	}
+	if string(decoded.TLVs[0x001E]) != "abc\x00" {
+		t.Errorf("Decoded TLV doesn't match: %v", decoded.TLVs)
+	}
+
+	// truncated bodies should error, not panic
+	body := sm.Bytes()
+	for i := 0; i < 30; i++ {
+		ShortMessageFromBytes(body[:i])
+	}
+}
+
+func TestFormatRelativeTime(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                            "000000000001000R",
+		90 * time.Second:             "000000000130000R",
+		26*time.Hour + 5*time.Minute: "000001020500000R",
+		365 * 24 * time.Hour:         "000099235959000R",
+	}
+
+	for d, expected := range tests {
+		if FormatRelativeTime(d) != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, d, FormatRelativeTime(d))
+		}
+	}
+}
+
+func TestReceipt(t *testing.T) {
+	sm := &ShortMessage{
+		EsmClass: ESM_CLASS_RECEIPT,
+		Message:  []byte("id:abc123 sub:001 dlvrd:000 submit date:1507211200 done date:1507211205 stat:UNDELIV err:011 text:Hello")}
+
+	if !sm.IsReceipt() {
+		t.Fatal("Expected message to be a receipt")
+	}
+
+	receipt := sm.Receipt()
+	if receipt.MessageId != "abc123" || receipt.Stat != STAT_UNDELIVERABLE || receipt.Err != "011" {
+		t.Errorf("Receipt doesn't match: %s", receipt)
+	}
+	if receipt.Delivered() || !receipt.Failed() {
+		t.Errorf("Receipt should be failed: %s", receipt)
+	}
+
+	// optional parameters take precedence over the text
+	sm.TLVs = map[uint16][]byte{TLV_RECEIPTED_MESSAGE_ID: []byte("ABC123\x00"), TLV_MESSAGE_STATE: []byte{2}}
+	receipt = sm.Receipt()
+	if receipt.MessageId != "ABC123" || !receipt.Delivered() {
+		t.Errorf("Receipt doesn't match: %s", receipt)
+	}
+}
+
+func TestClient(t *testing.T) {
+	bind := Bind{SystemId: "junebug", Password: "secret"}
+	sim, err := NewSimulator(bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	client := NewClient(sim.Addr(), bind, 100*time.Millisecond)
+	client.Start()
+	defer client.Stop()
+
+	// submit a message, this will wait for our bind
+	id, err := client.Submit(&ShortMessage{Destination: "+250788383383", Message: []byte("Hello World")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Error("Expected a message id from the SMSC")
+	}
+
+	submitted := <-sim.Submitted
+	if submitted.Destination != "+250788383383" || string(submitted.Message) != "Hello World" {
+		t.Errorf("Submitted message doesn't match: %+v", submitted)
+	}
+
+	// ask for a receipt this time, the simulator delivers it straight away
+	id, err = client.Submit(&ShortMessage{Destination: "+250788383383", Message: []byte("Receipt please"),
+		RegisteredDelivery: REGISTERED_DELIVERY_RECEIPT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sim.Submitted
+
+	select {
+	case dlr := <-client.Delivered:
+		if !dlr.IsReceipt() {
+			t.Fatalf("Expected a delivery receipt, got: %+v", dlr)
+		}
+		receipt := dlr.Receipt()
+		if receipt.MessageId != id || !receipt.Delivered() || receipt.Failed() {
+			t.Errorf("Receipt doesn't match: %s", receipt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delivery receipt")
+	}
+
+	// deliver an MO to our client
+	err = sim.Deliver(&ShortMessage{Source: "+250788383383", Message: []byte("Hi back")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case mo := <-client.Delivered:
+		if mo.Source != "+250788383383" || string(mo.Message) != "Hi back" {
+			t.Errorf("Delivered message doesn't match: %+v", mo)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delivered message")
+	}
+
+	// we should be keeping our link alive
+	waitFor(t, "enquire links", func() bool { return sim.EnquireLinks() >= 2 })
+
+	// drop our connection, we should rebind and be able to keep sending
+	sim.DropSessions()
+	waitFor(t, "rebind", func() bool { return sim.Binds() == 2 && client.IsBound() })
+
+	_, err = client.Submit(&ShortMessage{Destination: "+250788383383", Message: []byte("Still there?")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sim.Submitted
+}
+
+func TestClientBadPassword(t *testing.T) {
+	sim, err := NewSimulator(Bind{SystemId: "junebug", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sim.Close()
+
+	client := NewClient(sim.Addr(), Bind{SystemId: "junebug", Password: "wrong"}, 0)
+	client.timeout = 500 * time.Millisecond
+	client.Start()
+	defer client.Stop()
+
+	_, err = client.Submit(&ShortMessage{Destination: "+250788383383", Message: []byte("Hello World")})
+	if err != ErrNotBound {
+		t.Errorf("Expected ErrNotBound, got: %v", err)
+	}
+	if sim.Binds() != 0 {
+		t.Errorf("Expected no binds, got %d", sim.Binds())
+	}
+}
@@ -0,0 +1,328 @@
+package smpp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A minimal implementation of the SMPP 3.4 wire protocol, just enough to bind as a
+// transceiver, submit messages, receive deliveries and keep our bind alive.
+
+const GENERIC_NACK = 0x80000000
+const BIND_RECEIVER = 0x00000001
+const BIND_RECEIVER_RESP = 0x80000001
+const BIND_TRANSMITTER = 0x00000002
+const BIND_TRANSMITTER_RESP = 0x80000002
+const SUBMIT_SM = 0x00000004
+const SUBMIT_SM_RESP = 0x80000004
+const DELIVER_SM = 0x00000005
+const DELIVER_SM_RESP = 0x80000005
+const UNBIND = 0x00000006
+const UNBIND_RESP = 0x80000006
+const BIND_TRANSCEIVER = 0x00000009
+const BIND_TRANSCEIVER_RESP = 0x80000009
+const ENQUIRE_LINK = 0x00000015
+const ENQUIRE_LINK_RESP = 0x80000015
+
+// bit set on all response command ids
+const RESPONSE_MASK = 0x80000000
+
+const ESME_ROK = 0x00000000
+const ESME_RINVMSGLEN = 0x00000001
+const ESME_RINVCMDID = 0x00000003
+const ESME_RALYBND = 0x00000005
+const ESME_RSYSERR = 0x00000008
+const ESME_RBINDFAIL = 0x0000000D
+const ESME_RINVPASWD = 0x0000000E
+const ESME_RINVSYSID = 0x0000000F
+const ESME_RTHROTTLED = 0x00000058
+
+const INTERFACE_VERSION = 0x34
+
+// the data codings we send and understand
+const DATA_CODING_DEFAULT = 0x00
+const DATA_CODING_IA5 = 0x01
+const DATA_CODING_LATIN1 = 0x03
+const DATA_CODING_UCS2 = 0x08
+
+// set in esm_class when the short message starts with a user data header
+const ESM_CLASS_UDHI = 0x40
+
+const HEADER_LENGTH = 16
+
+// we never expect anything close to this, but it keeps a garbage length from eating our memory
+const MAX_PDU_LENGTH = 64 * 1024
+
+// A single SMPP protocol data unit, the body is left encoded
+type PDU struct {
+	CommandId uint32
+	Status    uint32
+	Sequence  uint32
+	Body      []byte
+}
+
+// A short message, this is the body of both submit_sm and deliver_sm
+type ShortMessage struct {
+	ServiceType        string
+	SourceTon          byte
+	SourceNpi          byte
+	Source             string
+	DestTon            byte
+	DestNpi            byte
+	Destination        string
+	EsmClass           byte
+	ProtocolId         byte
+	PriorityFlag       byte
+	ScheduleDelivery   string
+	ValidityPeriod     string
+	RegisteredDelivery byte
+	ReplaceIfPresent   byte
+	DataCoding         byte
+	DefaultMsgId       byte
+	Message            []byte
+	TLVs               map[uint16][]byte
+}
+
+// The credentials we bind with
+type Bind struct {
+	SystemId   string
+	Password   string
+	SystemType string
+}
+
+// Reads a single PDU off of the passed in reader
+func ReadPDU(r io.Reader) (*PDU, error) {
+	header := make([]byte, HEADER_LENGTH)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < HEADER_LENGTH || length > MAX_PDU_LENGTH {
+		return nil, errors.New(fmt.Sprintf("Invalid PDU length: %d", length))
+	}
+
+	pdu := &PDU{
+		CommandId: binary.BigEndian.Uint32(header[4:8]),
+		Status:    binary.BigEndian.Uint32(header[8:12]),
+		Sequence:  binary.BigEndian.Uint32(header[12:16]),
+		Body:      make([]byte, length-HEADER_LENGTH)}
+
+	_, err = io.ReadFull(r, pdu.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return pdu, nil
+}
+
+// Encodes this PDU to its wire format
+func (p *PDU) Bytes() []byte {
+	buf := make([]byte, HEADER_LENGTH+len(p.Body))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)))
+	binary.BigEndian.PutUint32(buf[4:8], p.CommandId)
+	binary.BigEndian.PutUint32(buf[8:12], p.Status)
+	binary.BigEndian.PutUint32(buf[12:16], p.Sequence)
+	copy(buf[HEADER_LENGTH:], p.Body)
+	return buf
+}
+
+// Whether this PDU is a response to a request we made
+func (p *PDU) IsResponse() bool {
+	return p.CommandId&RESPONSE_MASK != 0
+}
+
+// Builds the response for this PDU with the passed in status and body
+func (p *PDU) Response(status uint32, body []byte) *PDU {
+	return &PDU{CommandId: p.CommandId | RESPONSE_MASK, Status: status, Sequence: p.Sequence, Body: body}
+}
+
+func (p *PDU) String() string {
+	return fmt.Sprintf("PDU[command: 0x%08x status: 0x%08x seq: %d len: %d]",
+		p.CommandId, p.Status, p.Sequence, len(p.Body))
+}
+
+//------------------------------------------------------------------------
+// Body encoding
+//------------------------------------------------------------------------
+
+func writeCString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.WriteByte(0)
+}
+
+// bodyReader reads fields sequentially out of a PDU body, once an error occurs all
+// further reads are no-ops and the first error is left in err
+type bodyReader struct {
+	body   []byte
+	offset int
+	err    error
+}
+
+// reads a null terminated string
+func (r *bodyReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	if r.offset > len(r.body) {
+		r.err = errors.New("Unexpected end of PDU body")
+		return ""
+	}
+
+	end := bytes.IndexByte(r.body[r.offset:], 0)
+	if end < 0 {
+		r.err = errors.New("Unterminated string in PDU body")
+		return ""
+	}
+	s := string(r.body[r.offset : r.offset+end])
+	r.offset += end + 1
+	return s
+}
+
+func (r *bodyReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.offset >= len(r.body) {
+		r.err = errors.New("Unexpected end of PDU body")
+		return 0
+	}
+	r.offset++
+	return r.body[r.offset-1]
+}
+
+func (r *bodyReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.offset+n > len(r.body) {
+		r.err = errors.New("Unexpected end of PDU body")
+		return nil
+	}
+	r.offset += n
+	return r.body[r.offset-n : r.offset]
+}
+
+func (r *bodyReader) remaining() int {
+	return len(r.body) - r.offset
+}
+
+// Encodes the body of a bind request
+func (b *Bind) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	writeCString(buf, b.SystemId)
+	writeCString(buf, b.Password)
+	writeCString(buf, b.SystemType)
+	buf.WriteByte(INTERFACE_VERSION)
+	buf.WriteByte(0) // addr_ton
+	buf.WriteByte(0) // addr_npi
+	writeCString(buf, "")
+	return buf.Bytes()
+}
+
+// Decodes the body of a bind request
+func BindFromBytes(body []byte) (*Bind, error) {
+	r := &bodyReader{body: body}
+	bind := &Bind{
+		SystemId:   r.cstring(),
+		Password:   r.cstring(),
+		SystemType: r.cstring()}
+
+	return bind, r.err
+}
+
+// Encodes the body of a submit_sm or deliver_sm
+func (m *ShortMessage) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	writeCString(buf, m.ServiceType)
+	buf.WriteByte(m.SourceTon)
+	buf.WriteByte(m.SourceNpi)
+	writeCString(buf, m.Source)
+	buf.WriteByte(m.DestTon)
+	buf.WriteByte(m.DestNpi)
+	writeCString(buf, m.Destination)
+	buf.WriteByte(m.EsmClass)
+	buf.WriteByte(m.ProtocolId)
+	buf.WriteByte(m.PriorityFlag)
+	writeCString(buf, m.ScheduleDelivery)
+	writeCString(buf, m.ValidityPeriod)
+	buf.WriteByte(m.RegisteredDelivery)
+	buf.WriteByte(m.ReplaceIfPresent)
+	buf.WriteByte(m.DataCoding)
+	buf.WriteByte(m.DefaultMsgId)
+	buf.WriteByte(byte(len(m.Message)))
+	buf.Write(m.Message)
+
+	for tag, value := range m.TLVs {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint16(header[0:2], tag)
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(value)))
+		buf.Write(header)
+		buf.Write(value)
+	}
+
+	return buf.Bytes()
+}
+
+// Decodes the body of a submit_sm or deliver_sm
+func ShortMessageFromBytes(body []byte) (*ShortMessage, error) {
+	r := &bodyReader{body: body}
+	m := &ShortMessage{
+		ServiceType:        r.cstring(),
+		SourceTon:          r.byte(),
+		SourceNpi:          r.byte(),
+		Source:             r.cstring(),
+		DestTon:            r.byte(),
+		DestNpi:            r.byte(),
+		Destination:        r.cstring(),
+		EsmClass:           r.byte(),
+		ProtocolId:         r.byte(),
+		PriorityFlag:       r.byte(),
+		ScheduleDelivery:   r.cstring(),
+		ValidityPeriod:     r.cstring(),
+		RegisteredDelivery: r.byte(),
+		ReplaceIfPresent:   r.byte(),
+		DataCoding:         r.byte(),
+		DefaultMsgId:       r.byte()}
+
+	length := r.byte()
+	m.Message = r.bytes(int(length))
+
+	// anything left is optional parameters
+	for r.err == nil && r.remaining() >= 4 {
+		header := r.bytes(4)
+		tag := binary.BigEndian.Uint16(header[0:2])
+		value := r.bytes(int(binary.BigEndian.Uint16(header[2:4])))
+
+		if m.TLVs == nil {
+			m.TLVs = make(map[uint16][]byte)
+		}
+		m.TLVs[tag] = value
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	return m, nil
+}
+
+// Encodes the body of a response carrying only a message id (submit_sm_resp, deliver_sm_resp)
+func MessageIdBytes(id string) []byte {
+	buf := &bytes.Buffer{}
+	writeCString(buf, id)
+	return buf.Bytes()
+}
+
+// Decodes the body of a response carrying only a message id, an empty body is allowed
+func MessageIdFromBytes(body []byte) (string, error) {
+	if len(body) == 0 {
+		return "", nil
+	}
+	r := &bodyReader{body: body}
+	id := r.cstring()
+	return id, r.err
+}
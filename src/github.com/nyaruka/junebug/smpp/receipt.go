@@ -0,0 +1,95 @@
+package smpp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// esm_class bit set on deliver_sm PDUs which are delivery receipts rather than MOs
+const ESM_CLASS_RECEIPT = 0x04
+
+// registered_delivery value asking the SMSC for a receipt on final delivery or failure
+const REGISTERED_DELIVERY_RECEIPT = 0x01
+
+const TLV_RECEIPTED_MESSAGE_ID = 0x001E
+const TLV_MESSAGE_STATE = 0x0427
+
+// the final states an SMSC can report in the stat: field of a receipt
+const STAT_DELIVERED = "DELIVRD"
+const STAT_EXPIRED = "EXPIRED"
+const STAT_DELETED = "DELETED"
+const STAT_UNDELIVERABLE = "UNDELIV"
+const STAT_ACCEPTED = "ACCEPTD"
+const STAT_UNKNOWN = "UNKNOWN"
+const STAT_REJECTED = "REJECTD"
+const STAT_ENROUTE = "ENROUTE"
+
+// maps the values of the message_state TLV to their stat: equivalent
+var messageStates = map[byte]string{
+	1: STAT_ENROUTE,
+	2: STAT_DELIVERED,
+	3: STAT_EXPIRED,
+	4: STAT_DELETED,
+	5: STAT_UNDELIVERABLE,
+	6: STAT_ACCEPTED,
+	7: STAT_UNKNOWN,
+	8: STAT_REJECTED,
+}
+
+// A delivery receipt for a message we previously submitted
+type Receipt struct {
+	MessageId string
+	Stat      string
+	Err       string
+}
+
+// Whether this message is a delivery receipt as opposed to an MO
+func (m *ShortMessage) IsReceipt() bool {
+	return m.EsmClass&ESM_CLASS_RECEIPT != 0
+}
+
+// Parses the receipt carried by this message. The text of the message is in the de facto
+// standard format below, but we prefer the optional parameters if the SMSC sent them:
+//
+//	id:IIIIIIIIII sub:SSS dlvrd:DDD submit date:YYMMDDhhmm done date:YYMMDDhhmm stat:DDDDDDD err:E text:...
+func (m *ShortMessage) Receipt() *Receipt {
+	r := &Receipt{}
+	text := string(m.Message)
+
+	for _, field := range strings.Fields(text) {
+		switch {
+		case strings.HasPrefix(field, "id:") && r.MessageId == "":
+			r.MessageId = field[3:]
+		case strings.HasPrefix(field, "stat:"):
+			r.Stat = strings.ToUpper(field[5:])
+		case strings.HasPrefix(field, "err:"):
+			r.Err = field[4:]
+		}
+	}
+
+	if id, found := m.TLVs[TLV_RECEIPTED_MESSAGE_ID]; found {
+		r.MessageId = strings.TrimRight(string(id), "\x00")
+	}
+	if state, found := m.TLVs[TLV_MESSAGE_STATE]; found && len(state) == 1 {
+		if stat, known := messageStates[state[0]]; known {
+			r.Stat = stat
+		}
+	}
+
+	return r
+}
+
+// Whether this receipt reports the message as delivered
+func (r *Receipt) Delivered() bool {
+	return r.Stat == STAT_DELIVERED
+}
+
+// Whether this receipt reports the message as permanently failed
+func (r *Receipt) Failed() bool {
+	return r.Stat == STAT_EXPIRED || r.Stat == STAT_DELETED || r.Stat == STAT_UNDELIVERABLE ||
+		r.Stat == STAT_REJECTED
+}
+
+func (r *Receipt) String() string {
+	return fmt.Sprintf("id:%s stat:%s err:%s", r.MessageId, r.Stat, r.Err)
+}
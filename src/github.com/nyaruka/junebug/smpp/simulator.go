@@ -0,0 +1,223 @@
+package smpp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Simulator is a tiny in-process SMSC, it accepts transceiver binds using the configured
+// credentials, acks submitted messages (sending delivery receipts if asked for them) and
+// lets callers deliver messages to bound clients.
+// It exists so that our client and senders can be exercised without a real SMSC.
+type Simulator struct {
+	Bind      Bind
+	Submitted chan *ShortMessage
+
+	listener     net.Listener
+	mutex        sync.Mutex
+	sessions     []*simSession
+	binds        int
+	enquireLinks int
+	nextId       int
+	wg           sync.WaitGroup
+}
+
+type simSession struct {
+	conn       net.Conn
+	bound      bool
+	writeMutex sync.Mutex
+}
+
+// Starts a new simulator listening on a random local port
+func NewSimulator(bind Bind) (*Simulator, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Simulator{
+		Bind:      bind,
+		Submitted: make(chan *ShortMessage, 100),
+		listener:  listener}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			session := &simSession{conn: conn}
+			s.mutex.Lock()
+			s.sessions = append(s.sessions, session)
+			s.mutex.Unlock()
+
+			s.wg.Add(1)
+			go s.serve(session)
+		}
+	}()
+
+	return s, nil
+}
+
+// The address clients should connect to
+func (s *Simulator) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// How many successful binds we have seen
+func (s *Simulator) Binds() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.binds
+}
+
+// How many enquire_links we have answered
+func (s *Simulator) EnquireLinks() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.enquireLinks
+}
+
+// Delivers the passed in message to the most recently bound client
+func (s *Simulator) Deliver(sm *ShortMessage) error {
+	s.mutex.Lock()
+	var session *simSession
+	for i := len(s.sessions) - 1; i >= 0; i-- {
+		if s.sessions[i].bound {
+			session = s.sessions[i]
+			break
+		}
+	}
+	s.nextId++
+	seq := uint32(s.nextId)
+	s.mutex.Unlock()
+
+	if session == nil {
+		return errors.New("No bound sessions to deliver to")
+	}
+
+	return session.write(&PDU{CommandId: DELIVER_SM, Sequence: seq, Body: sm.Bytes()})
+}
+
+// Drops the connection of every client, as a flaky SMSC might
+func (s *Simulator) DropSessions() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, session := range s.sessions {
+		session.conn.Close()
+	}
+	s.sessions = nil
+}
+
+// Shuts down our simulator and all its sessions
+func (s *Simulator) Close() {
+	s.listener.Close()
+	s.DropSessions()
+	s.wg.Wait()
+}
+
+func (s *Simulator) serve(session *simSession) {
+	defer s.wg.Done()
+	defer session.conn.Close()
+
+	for {
+		pdu, err := ReadPDU(session.conn)
+		if err != nil {
+			return
+		}
+
+		switch pdu.CommandId {
+		case BIND_TRANSCEIVER, BIND_TRANSMITTER, BIND_RECEIVER:
+			status := uint32(ESME_ROK)
+			bind, decodeErr := BindFromBytes(pdu.Body)
+			if decodeErr != nil {
+				status = ESME_RBINDFAIL
+			} else if bind.SystemId != s.Bind.SystemId {
+				status = ESME_RINVSYSID
+			} else if bind.Password != s.Bind.Password {
+				status = ESME_RINVPASWD
+			}
+
+			s.mutex.Lock()
+			if status == ESME_ROK {
+				session.bound = true
+				s.binds++
+			}
+			s.mutex.Unlock()
+
+			err = session.write(pdu.Response(status, MessageIdBytes(s.Bind.SystemId)))
+
+		case SUBMIT_SM:
+			sm, decodeErr := ShortMessageFromBytes(pdu.Body)
+			if decodeErr != nil {
+				session.write(pdu.Response(ESME_RSYSERR, nil))
+				continue
+			}
+
+			s.mutex.Lock()
+			s.nextId++
+			id := fmt.Sprintf("sim-%d", s.nextId)
+			s.mutex.Unlock()
+
+			s.Submitted <- sm
+			err = session.write(pdu.Response(ESME_ROK, MessageIdBytes(id)))
+
+			// they asked for a receipt, pretend we delivered it straight away
+			if err == nil && sm.RegisteredDelivery&REGISTERED_DELIVERY_RECEIPT != 0 {
+				err = s.deliverReceipt(session, sm, id, STAT_DELIVERED)
+			}
+
+		case ENQUIRE_LINK:
+			s.mutex.Lock()
+			s.enquireLinks++
+			s.mutex.Unlock()
+
+			err = session.write(pdu.Response(ESME_ROK, nil))
+
+		case UNBIND:
+			session.write(pdu.Response(ESME_ROK, nil))
+			return
+
+		case DELIVER_SM_RESP:
+			// nothing to do, our client got our delivery
+
+		default:
+			err = session.write(&PDU{CommandId: GENERIC_NACK, Status: ESME_RINVCMDID, Sequence: pdu.Sequence})
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Sends a delivery receipt with the passed in stat for the submitted message
+func (s *Simulator) deliverReceipt(session *simSession, submitted *ShortMessage, id string, stat string) error {
+	receipt := &ShortMessage{
+		Source:      submitted.Destination,
+		Destination: submitted.Source,
+		EsmClass:    ESM_CLASS_RECEIPT,
+		Message:     []byte(fmt.Sprintf("id:%s sub:001 dlvrd:001 submit date:1507211200 done date:1507211200 stat:%s err:000 text:", id, stat)),
+		TLVs:        map[uint16][]byte{TLV_RECEIPTED_MESSAGE_ID: MessageIdBytes(id)}}
+
+	s.mutex.Lock()
+	s.nextId++
+	seq := uint32(s.nextId)
+	s.mutex.Unlock()
+
+	return session.write(&PDU{CommandId: DELIVER_SM, Sequence: seq, Body: receipt.Bytes()})
+}
+
+func (s *simSession) write(pdu *PDU) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	_, err := s.conn.Write(pdu.Bytes())
+	return err
+}
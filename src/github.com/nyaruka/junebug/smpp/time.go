@@ -0,0 +1,23 @@
+package smpp
+
+import (
+	"fmt"
+	"time"
+)
+
+// the longest relative time we can express without counting months, which SMSCs disagree on
+const MAX_RELATIVE_TIME = 99*24*time.Hour + 23*time.Hour + 59*time.Minute + 59*time.Second
+
+// Formats the passed in duration as an SMPP relative time, as used by the schedule_delivery_time
+// and validity_period fields of submit_sm. Relative times are YYMMDDhhmmss000R, we only ever
+// use days and below, capping at MAX_RELATIVE_TIME. Durations under a second round up to one.
+func FormatRelativeTime(d time.Duration) string {
+	if d > MAX_RELATIVE_TIME {
+		d = MAX_RELATIVE_TIME
+	} else if d < time.Second {
+		d = time.Second
+	}
+
+	secs := int64(d / time.Second)
+	return fmt.Sprintf("0000%02d%02d%02d%02d000R", secs/86400, secs%86400/3600, secs%3600/60, secs%60)
+}
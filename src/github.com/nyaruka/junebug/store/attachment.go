@@ -0,0 +1,57 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/satori/go.uuid"
+)
+
+// the largest blob we'll store, in bytes, attachments bigger than this have to be sent by URL
+const MAX_BLOB_SIZE = 5 * 1024 * 1024
+
+// A media attachment on a msg, its content is either at a URL or in a blob we store with its
+// connection, blobs are deleted along with their connection
+type Attachment struct {
+	ContentType string `json:"content_type"`
+	Url         string `json:"url,omitempty"`
+	Blob        string `json:"blob,omitempty"`
+	Size        int    `json:"size,omitempty"`
+}
+
+// A blob as our stores hold it
+type Blob struct {
+	ContentType string
+	Data        []byte
+}
+
+func (a *Attachment) validate() error {
+	if a.ContentType == "" {
+		return errors.New("Attachments must specify a `content_type`")
+	}
+	if (a.Url == "") == (a.Blob == "") {
+		return errors.New("Attachments must specify one of `url` or `blob`")
+	}
+	return nil
+}
+
+// Saves the passed in data as a blob of this connection, returning an attachment for it
+func (c *Connection) SaveBlob(contentType string, data []byte) (*Attachment, error) {
+	if len(data) > MAX_BLOB_SIZE {
+		return nil, errors.New(fmt.Sprintf("Blob of %d bytes is larger than the maximum of %d", len(data), MAX_BLOB_SIZE))
+	}
+	if contentType == "" {
+		return nil, errors.New("Blobs must have a content type")
+	}
+
+	id := uuid.NewV4().String()
+	err := c.store.SaveBlob(c.Uuid, id, &Blob{ContentType: contentType, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	return &Attachment{ContentType: contentType, Blob: id, Size: len(data)}, nil
+}
+
+// Loads the blob of this connection with the passed in id
+func (c *Connection) LoadBlob(id string) (*Blob, error) {
+	return c.store.LoadBlob(c.Uuid, id)
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// How many workers of one kind a connection may scale between. Autoscaling is off when Max is
+// zero, otherwise Min defaults to one.
+type ScaleBounds struct {
+	Min uint `json:"min"`
+	Max uint `json:"max"`
+}
+
+// Which of a connection's senders and receivers are scaled with their load, those that aren't
+// stay at their count
+type AutoscaleConfig struct {
+	Senders   ScaleBounds `json:"senders"`
+	Receivers ScaleBounds `json:"receivers"`
+}
+
+func (a *AutoscaleConfig) setDefaults() {
+	a.Senders.setDefaults()
+	a.Receivers.setDefaults()
+}
+
+func (a *AutoscaleConfig) validate() error {
+	err := a.Senders.validate("senders")
+	if err != nil {
+		return err
+	}
+	return a.Receivers.validate("receivers")
+}
+
+func (b *ScaleBounds) setDefaults() {
+	if b.Max > 0 && b.Min == 0 {
+		b.Min = 1
+	}
+}
+
+func (b *ScaleBounds) validate(kind string) error {
+	if b.Max > 0 && b.Min > b.Max {
+		return errors.New(fmt.Sprintf("`autoscale.%s.min` can't be more than `autoscale.%s.max`", kind, kind))
+	}
+	return nil
+}
+
+// Whether this kind of worker is scaled at all
+func (b ScaleBounds) IsEnabled() bool {
+	return b.Max > 0
+}
+
+// Returns the passed in count of workers, moved within our bounds if we are enabled
+func (b ScaleBounds) Clamp(count uint) uint {
+	if !b.IsEnabled() {
+		return count
+	}
+	if count < b.Min {
+		return b.Min
+	}
+	if count > b.Max {
+		return b.Max
+	}
+	return count
+}
@@ -2,101 +2,67 @@ package store
 
 import (
 	"bytes"
-	"encoding/json"
     "github.com/boltdb/bolt"
-	"github.com/satori/go.uuid"
 	"encoding/gob"
 	"encoding/binary"
-	"io"
 	"errors"
 	"time"
 	"fmt"
-	"sync"
 )
 
-type Msg struct {
-	Id         uint64    `json:"id,string"` // javascript doesn't like 64 bit ints
-	ConnUuid   string    `json:"conn_uuid"`
-	Address    string    `json:"address"`
-	Text       string    `json:"text"`
-	Priority   string    `json:"priority"`
-	Status     string    `json:"status"`
-	Log        string    `json:"log"`
-	Created    time.Time `json:"created"`
-	Finished   time.Time `json:"finished"`
-}
-
-type Connection struct {
-	Uuid               string `json:"uuid"`
-
-	Senders struct {
-		Type           string            `json:"type"`
-		Count          uint              `json:"count"`
-	    Config         map[string]string `json:"config"` } `json:"senders"`
-
-
-	Receivers struct {
-		Type           string            `json:"type"`
-		Count          uint              `json:"count"`
-	    Config         map[string]string `json:"config"` } `json:"receivers"`
-}
-
-type ConnectionStatus struct {
-	OutgoingQueued int `json:"outgoing_queued"`
-	IncomingQueued int `json:"incoming_queued"`
-	HandledResults int `json:"handled_results"`
-	SentResults    int `json:"sent_results"`
-}
-
-const OUTBOX_BUCKET = "outbox"
-const SENT_BUCKET = "sent"
-const INBOX_BUCKET = "inbox"
-const HANDLED_BUCKET = "handled"
+// buckets only our bolt store uses, msgs holds our encoded msgs by id, external indexes
+// them by the id our transport gave them and idempotency by their client's idempotency key,
+// cursors holds our transports' cursors by name and blobs our encoded blobs by id
 const MSG_BUCKET = "msgs"
+const EXTERNAL_BUCKET = "external"
+const IDEMPOTENCY_BUCKET = "idempotency"
+const CURSOR_BUCKET = "cursors"
+const BLOB_BUCKET = "blobs"
 const CONNECTION_BUCKET = "connections"
 
-const STATUS_QUEUED = "Q"
-const STATUS_SENT = "S"
-const STATUS_HANDLED = "H"
-
-const PRIORITY_HIGH = "H"
-const PRIORITY_LOW = "L"
+var boltConnectionBuckets = append([]string{MSG_BUCKET, EXTERNAL_BUCKET, IDEMPOTENCY_BUCKET, CURSOR_BUCKET,
+	BLOB_BUCKET}, CONNECTION_BUCKETS...)
 
-const LOW_PRIORITY_MASK = 1<<63
-
-// our global DB connection
-var db *bolt.DB
+// BoltStore keeps everything in a single BoltDB file. Every connection gets a top level
+// bucket named by its uuid, holding a sub bucket for each of our queue buckets. The keys
+// of those are msg ids and the values the time the msg entered the bucket.
+//
+// It is an implementation of Store
+type BoltStore struct {
+	db *bolt.DB
+}
 
-func OpenDB(filename string) (*bolt.DB, error) {
-	var err error
-    db, err = bolt.Open(filename, 0600, nil)
+// Opens (creating if needed) the BoltDB file with the passed in filename
+func OpenBoltStore(filename string) (*BoltStore, error) {
+	db, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create our connection bucket, so that our views can be read only
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(CONNECTION_BUCKET))
-		return err
-	})
+		b, err := tx.CreateBucketIfNotExists([]byte(CONNECTION_BUCKET))
+		if err != nil {
+			return err
+		}
 
-	return db, err
-}
+		// connections created by older versions may be missing some buckets, add them
+		return b.ForEach(func(k, v []byte) error {
+			return ensureConnectionBuckets(tx, string(k))
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-func CloseDB() error {
-	return db.Close()
+	return &BoltStore{db: db}, nil
 }
 
-//------------------------------------------------------------------------
-// Msg Pool (this saves us GC allocations as we build a LOT of msgs)
-// ------------------------------------------------------------------------
-var msgPool = sync.Pool{
-    New: func() interface{} {
-        return &Msg{}
-    },
+func (s *BoltStore) Close() error {
+	return s.db.Close()
 }
 
-//------------------------------------------------------------------------
-// Bolt Operations
-//------------------------------------------------------------------------
-
 func getMsgBucket(tx *bolt.Tx, connection string, bucket string) (b *bolt.Bucket, err error) {
 	// grab our connections bucket
 	b = tx.Bucket([]byte(CONNECTION_BUCKET))
@@ -135,9 +101,20 @@ func ensureMsgBucket(tx *bolt.Tx, connection string, bucket string) (b *bolt.Buc
 	return b, err
 }
 
-func getMsgBucketKeys(connection string, bucket string) (*[]uint64, error) {
+func ensureConnectionBuckets(tx *bolt.Tx, connection string) error {
+	for _, bucket_name := range(boltConnectionBuckets) {
+		_, err := ensureMsgBucket(tx, connection, bucket_name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the ids of all the msgs in the passed in bucket
+func (s *BoltStore) GetBucketMsgs(connection string, bucket string) (*[]uint64, error) {
 	var k *[]uint64
-	return k, db.View(func(tx *bolt.Tx) error {
+	return k, s.db.View(func(tx *bolt.Tx) error {
 		b, err := getMsgBucket(tx, connection, bucket)
 		if err != nil {
 			return err
@@ -158,8 +135,34 @@ func getMsgBucketKeys(connection string, bucket string) (*[]uint64, error) {
 	})
 }
 
-func saveMsgToBucket(msg *Msg, addBucket string, deleteBucket string) error {
-	return db.Update(func(tx *bolt.Tx) error {
+// Returns the ids in the passed in bucket whose time is at or before the passed in time
+func (s *BoltStore) GetBucketMsgsBefore(connection string, bucket string, before time.Time) (*[]uint64, error) {
+	var k *[]uint64
+	return k, s.db.View(func(tx *bolt.Tx) error {
+		b, err := getMsgBucket(tx, connection, bucket)
+		if err != nil {
+			return err
+		}
+
+		keys := make([]uint64, 0, 100)
+		cutoff := uint64(before.UnixNano())
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if binary.LittleEndian.Uint64(v) <= cutoff {
+				keys = append(keys, binary.LittleEndian.Uint64(k))
+			}
+		}
+
+		k = &keys
+		return nil
+	})
+}
+
+// Saves our msg, adding it to addBucket with the passed in time and removing it from
+// all the deleteBuckets, either bucket can be empty
+func (s *BoltStore) SaveMsg(msg *Msg, at time.Time, addBucket string, deleteBuckets ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		b, err := getMsgBucket(tx, msg.ConnUuid, MSG_BUCKET)
 		if err != nil {
 			return err
@@ -196,6 +199,32 @@ func saveMsgToBucket(msg *Msg, addBucket string, deleteBucket string) error {
 			return err
 		}
 
+		// if our transport gave us an id, index it so we can find ourselves by it later
+		if msg.ExternalId != "" {
+			b, err := getMsgBucket(tx, msg.ConnUuid, EXTERNAL_BUCKET)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put([]byte(msg.ExternalId), idBuf)
+			if err != nil {
+				return err
+			}
+		}
+
+		// same for the idempotency key our client gave us
+		if msg.IdempotencyKey != "" {
+			b, err := getMsgBucket(tx, msg.ConnUuid, IDEMPOTENCY_BUCKET)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put([]byte(msg.IdempotencyKey), idBuf)
+			if err != nil {
+				return err
+			}
+		}
+
 		// if we have bucket to add to, insert there
 		if addBucket != "" {
 			b, err := getMsgBucket(tx, msg.ConnUuid, addBucket)
@@ -204,7 +233,7 @@ func saveMsgToBucket(msg *Msg, addBucket string, deleteBucket string) error {
 			}
 
 			timeBuf := make([]byte, 8, 8)
-			binary.LittleEndian.PutUint64(timeBuf, uint64(time.Now().UnixNano()))
+			binary.LittleEndian.PutUint64(timeBuf, uint64(at.UnixNano()))
 
 			err = b.Put(idBuf, timeBuf)
 			if err != nil {
@@ -212,8 +241,12 @@ func saveMsgToBucket(msg *Msg, addBucket string, deleteBucket string) error {
 			}
 		}
 
-		// if we have a bucket to remove from, delete there
-		if deleteBucket != "" {
+		// remove from any buckets we are leaving
+		for _, deleteBucket := range deleteBuckets {
+			if deleteBucket == "" {
+				continue
+			}
+
 			b, err := getMsgBucket(tx, msg.ConnUuid, deleteBucket)
 			if err != nil {
 				return err
@@ -229,10 +262,9 @@ func saveMsgToBucket(msg *Msg, addBucket string, deleteBucket string) error {
 	})
 }
 
-func getMsg(connection string, id uint64) (*Msg, error) {
-	msg := msgPool.Get().(*Msg)
-	msg.init()
-	return msg, db.View(func(tx *bolt.Tx) error {
+// Loads the msg with the passed in id into msg
+func (s *BoltStore) LoadMsg(connection string, id uint64, msg *Msg) error {
+	return s.db.View(func(tx *bolt.Tx) error {
 		b, err := getMsgBucket(tx, connection, MSG_BUCKET)
 		if err != nil {
 			return err
@@ -242,7 +274,9 @@ func getMsg(connection string, id uint64) (*Msg, error) {
 		binary.LittleEndian.PutUint64(idBuf, uint64(id))
 
 		msgBytes := b.Get(idBuf)
-
+		if msgBytes == nil {
+			return errors.New(fmt.Sprintf("No msg with id %d", id))
+		}
 
 		dec := gob.NewDecoder(bytes.NewReader(msgBytes))
 		err = dec.Decode(msg)
@@ -250,8 +284,98 @@ func getMsg(connection string, id uint64) (*Msg, error) {
 	})
 }
 
-func deleteConnection(connection *Connection) (err error) {
-	return db.Update(func(tx *bolt.Tx) error {
+// Looks up the id of the msg our transport assigned the passed in external id
+func (s *BoltStore) GetMsgIdByExternalId(connection string, externalId string) (id uint64, err error) {
+	return s.getIndexedMsgId(connection, EXTERNAL_BUCKET, "external id", externalId)
+}
+
+// Looks up the id of the last msg saved with the passed in idempotency key
+func (s *BoltStore) GetMsgIdByIdempotencyKey(connection string, key string) (id uint64, err error) {
+	return s.getIndexedMsgId(connection, IDEMPOTENCY_BUCKET, "idempotency key", key)
+}
+
+// reads the msg id stored under the passed in key in one of our index buckets
+func (s *BoltStore) getIndexedMsgId(connection string, index string, desc string, key string) (id uint64, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b, err := getMsgBucket(tx, connection, index)
+		if err != nil {
+			return err
+		}
+
+		idBytes := b.Get([]byte(key))
+		if idBytes == nil {
+			return errors.New(fmt.Sprintf("No msg with %s \"%s\"", desc, key))
+		}
+
+		id = binary.LittleEndian.Uint64(idBytes)
+		return nil
+	})
+	return id, err
+}
+
+// Removes the msg with the passed in id from the passed in bucket and deletes it entirely
+func (s *BoltStore) DeleteMsg(connection string, bucket string, id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := getMsgBucket(tx, connection, bucket)
+		if err != nil {
+			return err
+		}
+
+		idBuf := make([]byte, 8, 8)
+		binary.LittleEndian.PutUint64(idBuf, id)
+
+		if b.Get(idBuf) == nil {
+			return errors.New(fmt.Sprintf("No msg with id %d in bucket \"%s\"", id, bucket))
+		}
+
+		err = b.Delete(idBuf)
+		if err != nil {
+			return err
+		}
+
+		b, err = getMsgBucket(tx, connection, MSG_BUCKET)
+		if err != nil {
+			return err
+		}
+
+		// drop our idempotency key and external id from their indexes, so they don't point at a msg that's gone
+		var msg Msg
+		msgBytes := b.Get(idBuf)
+		if msgBytes != nil && gob.NewDecoder(bytes.NewReader(msgBytes)).Decode(&msg) == nil {
+			err = unindexMsg(tx, connection, IDEMPOTENCY_BUCKET, msg.IdempotencyKey, idBuf)
+			if err != nil {
+				return err
+			}
+			err = unindexMsg(tx, connection, EXTERNAL_BUCKET, msg.ExternalId, idBuf)
+			if err != nil {
+				return err
+			}
+		}
+
+		return b.Delete(idBuf)
+	})
+}
+
+// removes the passed in key from one of our index buckets, as long as it still points at the
+// msg with the passed in id rather than a newer msg saved with the same key
+func unindexMsg(tx *bolt.Tx, connection string, index string, key string, idBuf []byte) error {
+	if key == "" {
+		return nil
+	}
+
+	b, err := getMsgBucket(tx, connection, index)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b.Get([]byte(key)), idBuf) {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+// Deletes the passed in connection along with all its msgs
+func (s *BoltStore) DeleteConnection(connection *Connection) (err error) {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		// Delete our connection from the connnections bucket
 		b := tx.Bucket([]byte(CONNECTION_BUCKET))
 
@@ -271,8 +395,9 @@ func deleteConnection(connection *Connection) (err error) {
 	})
 }
 
-func saveConnection(connection *Connection) error {
-	return db.Update(func(tx *bolt.Tx) error {
+// Saves the passed in connection, creating its buckets if needed
+func (s *BoltStore) SaveConnection(connection *Connection) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		// Create our bucket
 		b, err := tx.CreateBucketIfNotExists([]byte(CONNECTION_BUCKET))
 		if err != nil {
@@ -280,12 +405,9 @@ func saveConnection(connection *Connection) error {
 		}
 
 		// ensure all our buckets exist
-		required_buckets := []string{OUTBOX_BUCKET, SENT_BUCKET, INBOX_BUCKET, HANDLED_BUCKET, MSG_BUCKET}
-		for _, bucket_name := range(required_buckets) {
-			_, err := ensureMsgBucket(tx, connection.Uuid, bucket_name)
-			if err != nil {
-				return err
-			}
+		err = ensureConnectionBuckets(tx, connection.Uuid)
+		if err != nil {
+			return err
 		}
 
 		// encode our Connection using gob
@@ -301,9 +423,10 @@ func saveConnection(connection *Connection) error {
 	})
 }
 
-func loadConnection(uuid string) (*Connection, error) {
+// Loads the connection with the passed in uuid
+func (s *BoltStore) LoadConnection(uuid string) (*Connection, error) {
 	var connection Connection
-	return &connection, db.View(func(tx *bolt.Tx) error {
+	return &connection, s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(CONNECTION_BUCKET))
 		if b == nil {
 			return errors.New(fmt.Sprintf("Unable to get connection bucket: %s", CONNECTION_BUCKET))
@@ -316,8 +439,9 @@ func loadConnection(uuid string) (*Connection, error) {
 	})
 }
 
-func getConnectionBucketSize(connUuid string, bucket string) (size int, err error){
-	err = db.View(func(tx *bolt.Tx) error {
+// Returns the number of msgs in the passed in bucket
+func (s *BoltStore) GetBucketSize(connUuid string, bucket string) (size int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
 		b, err := getMsgBucket(tx, connUuid, bucket)
 		if err != nil {
 			return err
@@ -329,161 +453,70 @@ func getConnectionBucketSize(connUuid string, bucket string) (size int, err erro
 	return size, err
 }
 
-//------------------------------------------------------------------------
-// Msg Operations
-//------------------------------------------------------------------------
-
-// Write ourselves to the outbox
-func (m *Msg) WriteToOutbox() (err error) {
-	return saveMsgToBucket(m, OUTBOX_BUCKET, "")
-}
-
-// Write ourselves to the inbox
-func (m *Msg) WriteToInbox() (err error) {
-	return saveMsgToBucket(m, INBOX_BUCKET, "")
-}
-
-// Mark ourselves as sent, this just updates our status and saves
-func (m *Msg) MarkSent(msgLog string) (err error) {
-	m.Status = STATUS_SENT
-	m.Finished = time.Now()
-	m.Log = msgLog
-	return saveMsgToBucket(m, SENT_BUCKET, OUTBOX_BUCKET)
-}
-
-// Mark ourselves as handled, this just update our status and saves
-func (m *Msg) MarkHandled(msgLog string) (err error) {
-	m.Status = STATUS_HANDLED
-	m.Finished = time.Now()
-	m.Log = msgLog
-	return saveMsgToBucket(m, HANDLED_BUCKET, INBOX_BUCKET)
-}
-
-// Clears the values on this msg
-func (m *Msg) init() {
-	m.Id = 0
-	m.ConnUuid = ""
-	m.Address = ""
-	m.Text = ""
-	m.Priority = ""
-	m.Status = ""
-	m.Log = ""
-	m.Created = time.Time{}
-	m.Finished = time.Time{}
-}
-
-// Releases this message back to our pool
-func (m *Msg) Release() {
-	msgPool.Put(m)
-}
-
-// Reads an Inbox Msg
-func MsgFromId(connUuid string, id uint64) (msg *Msg, err error) {
-	return getMsg(connUuid, id)
-}
-
-// Builds a Msg object from the passed in text and from
-func MsgFromText(connUuid string, from string, text string) *Msg {
-	msg := msgPool.Get().(*Msg)
-	msg.init()
-
-	msg.ConnUuid = connUuid
-	msg.Address = from
-	msg.Text = text
-	msg.Priority = PRIORITY_LOW
-	msg.Status = STATUS_QUEUED
-	msg.Created = time.Now()
-
-	return msg
-}
-
-// Builds a Msg object from the passed in JSON
-func MsgFromJson(body io.Reader) (*Msg, error) {
-	msg := msgPool.Get().(*Msg)
-	msg.init()
-
-	// Decode it from the passed in JSON
-	decoder := json.NewDecoder(body)
-	err := decoder.Decode(msg)
-	if err != nil {
-		return msg, err
-	}
-
-	// to and text and required
-	if msg.Address == "" || msg.Text == "" {
-		return msg, errors.New("Must specify `address` and `text`")
-	}
-
-	if msg.Priority == "" {
-		msg.Priority = PRIORITY_LOW
-	}
-
-	// check that priority is set correctly
-	if msg.Priority != PRIORITY_HIGH && msg.Priority != PRIORITY_LOW {
-		return msg, errors.New("`priority` must be one of `H` (high) or `L` (low)")
-	}
-
-	// all messages start as queued
-	msg.Status = STATUS_QUEUED
-	msg.Created = time.Now()
-
-	// return our msg
-	return msg, nil
+// Saves the value of the passed in named cursor for a connection
+func (s *BoltStore) SaveCursor(connUuid string, name string, value string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := getMsgBucket(tx, connUuid, CURSOR_BUCKET)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), []byte(value))
+	})
 }
 
-//------------------------------------------------------------------------
-// Connection Operations
-//------------------------------------------------------------------------
-
-// Writes this connection to disk
-func (c *Connection) Save() (err error) {
-	return saveConnection(c)
-}
+// Loads the value of the passed in named cursor, empty if it was never saved
+func (s *BoltStore) LoadCursor(connUuid string, name string) (value string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		// connections that aren't saved yet don't have any cursors
+		b, err := getMsgBucket(tx, connUuid, CURSOR_BUCKET)
+		if err != nil {
+			return nil
+		}
 
-// Deletes this connection entirely, callers should make sure that
-// any running ConnectionEngine's have been stopped beforehand
-func (c *Connection) Delete() (err error) {
-	return deleteConnection(c)
+		value = string(b.Get([]byte(name)))
+		return nil
+	})
+	return value, err
 }
 
-// loads our number of queued messages
-func (c *Connection) GetStatus() (*ConnectionStatus, error) {
-	var status ConnectionStatus
-	var err error
-
-	status.IncomingQueued, err = getConnectionBucketSize(c.Uuid, INBOX_BUCKET)
+// Saves the passed in blob for a connection with the passed in id
+func (s *BoltStore) SaveBlob(connUuid string, id string, blob *Blob) error {
+	blobBuf := &bytes.Buffer{}
+	err := gob.NewEncoder(blobBuf).Encode(blob)
 	if err != nil {
-		return &status, err
-	}
-
-	status.OutgoingQueued, err = getConnectionBucketSize(c.Uuid, OUTBOX_BUCKET)
-	if err != nil {
-		return &status, err
-	}
-
-	status.HandledResults, err = getConnectionBucketSize(c.Uuid, HANDLED_BUCKET)
-	if err != nil {
-		return &status, err
+		return err
 	}
 
-	status.SentResults, err = getConnectionBucketSize(c.Uuid, SENT_BUCKET)
-	return &status, err
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := getMsgBucket(tx, connUuid, BLOB_BUCKET)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), blobBuf.Bytes())
+	})
 }
 
-// loads the ids of our inbox messages
-func (c *Connection) GetInboxMsgs() (ids *[]uint64, err error) {
-	return getMsgBucketKeys(c.Uuid, INBOX_BUCKET)
-}
+// Loads the blob with the passed in id
+func (s *BoltStore) LoadBlob(connUuid string, id string) (*Blob, error) {
+	var blob Blob
+	return &blob, s.db.View(func(tx *bolt.Tx) error {
+		b, err := getMsgBucket(tx, connUuid, BLOB_BUCKET)
+		if err != nil {
+			return err
+		}
 
-// loads the ids of our outbox messages
-func (c *Connection) GetOutboxMsgs() (ids *[]uint64, err error) {
-	return getMsgBucketKeys(c.Uuid, OUTBOX_BUCKET)
+		blobBytes := b.Get([]byte(id))
+		if blobBytes == nil {
+			return errors.New(fmt.Sprintf("No blob with id \"%s\"", id))
+		}
+		return gob.NewDecoder(bytes.NewReader(blobBytes)).Decode(&blob)
+	})
 }
 
-// loads all our connections from the db
-func LoadAllConnections() (*[]Connection, error) {
+// Loads all our connections
+func (s *BoltStore) LoadAllConnections() (*[]Connection, error) {
 	var return_conns *[]Connection
-	return return_conns, db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(CONNECTION_BUCKET))
 		if b == nil {
 			return errors.New(fmt.Sprintf("Unable to load connection bucket: %s", CONNECTION_BUCKET))
@@ -510,51 +543,5 @@ func LoadAllConnections() (*[]Connection, error) {
 
 		return nil
 	})
+	return return_conns, err
 }
-
-// Builds a single configuration from a file
-func ConnectionFromUuid(uuid string) (connection *Connection, err error) {
-	return loadConnection(uuid)
-}
-
-// Builds a single configuration from JSON
-func ConnectionFromJson(body io.Reader) (*Connection, error) {
-	var connection Connection
-
-	decoder := json.NewDecoder(body)
-	err := decoder.Decode(&connection)
-	if err != nil {
-		return &connection, errors.New("Invalid JSON, please check the body of your request: " + err.Error())
-	}
-
-	// type is required
-	if connection.Senders.Type == "" {
-		return &connection, errors.New("Must specify a sender type in field `sender_type`")
-	}
-
-	if connection.Senders.Type != "echo" && connection.Senders.Type != "twitter" {
-		return &connection, errors.New("Invalid sender_type, must be `echo` or `twitter`")
-	}
-
-	if connection.Receivers.Type == "" {
-		connection.Receivers.Type = "http"
-	}
-
-	if connection.Receivers.Type != "http" {
-		return &connection, errors.New("Invalid receiver_type, must be `http`")
-	}
-
-	if connection.Senders.Count == 0 {
-		connection.Senders.Count = 1
-	}
-
-	if connection.Receivers.Count == 0 {
-		connection.Receivers.Count = 1
-	}
-
-	// ok, all looks good, generate a new UUID
-	connection.Uuid = uuid.NewV4().String()
-
-	// and return it
-	return &connection, nil
-}
\ No newline at end of file
@@ -0,0 +1,369 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/satori/go.uuid"
+	"io"
+	"time"
+)
+
+type Connection struct {
+	Uuid               string `json:"uuid"`
+
+	Senders struct {
+		Type           string            `json:"type"`
+		Count          uint              `json:"count"`
+	    Config         map[string]string `json:"config"` } `json:"senders"`
+
+
+	Receivers struct {
+		Type           string            `json:"type"`
+		Count          uint              `json:"count"`
+	    Config         map[string]string `json:"config"` } `json:"receivers"`
+
+	Retries            RetryConfig `json:"retries"`
+	Throttle           ThrottleConfig `json:"throttle"`
+	Autoscale          AutoscaleConfig `json:"autoscale"`
+
+	// how many seconds we remember idempotency keys for
+	IdempotencyWindow  uint `json:"idempotency_window"`
+
+	// whether msgs to each address are sent one at a time, in the order they were queued
+	Ordered            bool `json:"ordered"`
+
+	// paused connections accept msgs but don't send them until they are resumed
+	Paused             bool `json:"paused"`
+
+	// the store we were loaded from or will be saved to
+	store              Store
+}
+
+type ConnectionStatus struct {
+	OutgoingQueued      int `json:"outgoing_queued"`
+	IncomingQueued      int `json:"incoming_queued"`
+	HandledResults      int `json:"handled_results"`
+	RetryQueued         int `json:"retry_queued"`
+	IncomingRetryQueued int `json:"incoming_retry_queued"`
+	DeadLetters         int `json:"dead_letters"`
+	SentResults         int `json:"sent_results"`
+	FailedResults       int `json:"failed_results"`
+	Scheduled           int `json:"scheduled"`
+	ExpiredResults      int `json:"expired_results"`
+	InFlight            int `json:"in_flight"`
+
+	// these are only known for connections that are running
+	SendRate            float64 `json:"send_rate"`
+	Throttled           int     `json:"throttled"`
+	Senders             int     `json:"senders"`
+	Receivers           int     `json:"receivers"`
+
+	// set while our transport has rate limited us, until when we aren't sending
+	RateLimitedUntil    *time.Time `json:"rate_limited_until,omitempty"`
+}
+
+// Our default for how long we remember idempotency keys, a day
+const DEFAULT_IDEMPOTENCY_WINDOW = 86400
+
+//------------------------------------------------------------------------
+// Connection Operations
+//------------------------------------------------------------------------
+
+// Returns how long we remember idempotency keys for, connections created before we had
+// idempotency keys get our default
+func (c *Connection) GetIdempotencyWindow() time.Duration {
+	if c.IdempotencyWindow == 0 {
+		return DEFAULT_IDEMPOTENCY_WINDOW * time.Second
+	}
+	return time.Duration(c.IdempotencyWindow) * time.Second
+}
+
+// Writes this connection to our store
+func (c *Connection) Save() (err error) {
+	return c.store.SaveConnection(c)
+}
+
+// Deletes this connection entirely, callers should make sure that
+// any running ConnectionEngine's have been stopped beforehand
+func (c *Connection) Delete() (err error) {
+	return c.store.DeleteConnection(c)
+}
+
+// loads our number of queued messages
+func (c *Connection) GetStatus() (*ConnectionStatus, error) {
+	var status ConnectionStatus
+	var err error
+
+	status.IncomingQueued, err = c.store.GetBucketSize(c.Uuid, INBOX_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.OutgoingQueued, err = c.store.GetBucketSize(c.Uuid, OUTBOX_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.HandledResults, err = c.store.GetBucketSize(c.Uuid, HANDLED_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.RetryQueued, err = c.store.GetBucketSize(c.Uuid, RETRY_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.IncomingRetryQueued, err = c.store.GetBucketSize(c.Uuid, INBOX_RETRY_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.DeadLetters, err = c.store.GetBucketSize(c.Uuid, DEAD_LETTER_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.SentResults, err = c.store.GetBucketSize(c.Uuid, SENT_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.FailedResults, err = c.store.GetBucketSize(c.Uuid, FAILED_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.Scheduled, err = c.store.GetBucketSize(c.Uuid, SCHEDULED_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.ExpiredResults, err = c.store.GetBucketSize(c.Uuid, EXPIRED_BUCKET)
+	if err != nil {
+		return &status, err
+	}
+
+	status.InFlight, err = c.store.GetBucketSize(c.Uuid, IN_FLIGHT_BUCKET)
+	return &status, err
+}
+
+// loads the ids of our inbox messages
+func (c *Connection) GetInboxMsgs() (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgs(c.Uuid, INBOX_BUCKET)
+}
+
+// loads the ids of our outbox messages
+func (c *Connection) GetOutboxMsgs() (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgs(c.Uuid, OUTBOX_BUCKET)
+}
+
+// loads the ids of our in flight msgs
+func (c *Connection) GetInFlightMsgs() (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgs(c.Uuid, IN_FLIGHT_BUCKET)
+}
+
+// loads the ids of our msgs waiting to be retried
+func (c *Connection) GetRetryMsgs() (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgs(c.Uuid, RETRY_BUCKET)
+}
+
+// loads the ids of our in flight msgs whose lease has expired at the passed in time
+func (c *Connection) GetExpiredLeaseMsgs(now time.Time) (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgsBefore(c.Uuid, IN_FLIGHT_BUCKET, now)
+}
+
+// loads the ids of our msgs waiting to be retried which are due at the passed in time
+func (c *Connection) GetDueRetryMsgs(now time.Time) (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgsBefore(c.Uuid, RETRY_BUCKET, now)
+}
+
+// loads the ids of our incoming msgs waiting to be retried which are due at the passed in time
+func (c *Connection) GetDueInboxRetryMsgs(now time.Time) (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgsBefore(c.Uuid, INBOX_RETRY_BUCKET, now)
+}
+
+// loads the ids of our scheduled msgs
+func (c *Connection) GetScheduledMsgs() (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgs(c.Uuid, SCHEDULED_BUCKET)
+}
+
+// loads the ids of our scheduled msgs whose send_at is at or before the passed in time
+func (c *Connection) GetDueScheduledMsgs(now time.Time) (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgsBefore(c.Uuid, SCHEDULED_BUCKET, now)
+}
+
+// loads the ids of our dead lettered messages
+func (c *Connection) GetDeadLetterMsgs() (ids *[]uint64, err error) {
+	return c.store.GetBucketMsgs(c.Uuid, DEAD_LETTER_BUCKET)
+}
+
+// drops the dead lettered msg with the passed in id, deleting it entirely
+func (c *Connection) DropDeadLetterMsg(id uint64) (err error) {
+	return c.store.DeleteMsg(c.Uuid, DEAD_LETTER_BUCKET, id)
+}
+
+// loads the ids of all the msgs we haven't finished sending or handling yet
+func (c *Connection) GetPendingMsgs() (*[]uint64, error) {
+	pending := make([]uint64, 0)
+	for _, bucket := range PENDING_BUCKETS {
+		ids, err := c.store.GetBucketMsgs(c.Uuid, bucket)
+		if err != nil {
+			return &pending, err
+		}
+		pending = append(pending, *ids...)
+	}
+	return &pending, nil
+}
+
+// counts the msgs we haven't finished sending or handling yet
+func (c *Connection) GetPendingCount() (int, error) {
+	return c.countBuckets(PENDING_BUCKETS)
+}
+
+// counts the msgs we can still finish by draining, that is our pending msgs other than scheduled ones
+func (c *Connection) GetDrainableCount() (int, error) {
+	return c.countBuckets(DRAINABLE_BUCKETS)
+}
+
+func (c *Connection) countBuckets(buckets []string) (int, error) {
+	count := 0
+	for _, bucket := range buckets {
+		size, err := c.store.GetBucketSize(c.Uuid, bucket)
+		if err != nil {
+			return count, err
+		}
+		count += size
+	}
+	return count, nil
+}
+
+// loads the value of the passed in named cursor, empty if it was never saved
+func (c *Connection) LoadCursor(name string) (string, error) {
+	return c.store.LoadCursor(c.Uuid, name)
+}
+
+// saves the value of the passed in named cursor
+func (c *Connection) SaveCursor(name string, value string) error {
+	return c.store.SaveCursor(c.Uuid, name, value)
+}
+
+// loads all our connections from the passed in store
+func LoadAllConnections(s Store) (*[]Connection, error) {
+	connections, err := s.LoadAllConnections()
+	if err != nil {
+		return connections, err
+	}
+
+	for i := range *connections {
+		(*connections)[i].store = s
+	}
+	return connections, nil
+}
+
+// Builds a single configuration from the passed in store
+func ConnectionFromUuid(s Store, uuid string) (connection *Connection, err error) {
+	connection, err = s.LoadConnection(uuid)
+	if connection != nil {
+		connection.store = s
+	}
+	return connection, err
+}
+
+// Builds a single configuration from JSON, it will be saved to the passed in store
+func ConnectionFromJson(s Store, body io.Reader) (*Connection, error) {
+	var connection Connection
+	connection.store = s
+
+	decoder := json.NewDecoder(body)
+	err := decoder.Decode(&connection)
+	if err != nil {
+		return &connection, errors.New("Invalid JSON, please check the body of your request: " + err.Error())
+	}
+
+	err = connection.validate()
+	if err != nil {
+		return &connection, err
+	}
+
+	// ok, all looks good, generate a new UUID
+	connection.Uuid = uuid.NewV4().String()
+
+	// and return it
+	return &connection, nil
+}
+
+// Returns a copy of this connection with the passed in JSON applied over it. Fields that aren't
+// in the JSON keep their current values and config keys are merged into our current config.
+// Our uuid and whether we are paused can't be changed this way.
+func (c *Connection) Patch(body io.Reader) (*Connection, error) {
+	// copy ourselves by way of JSON, so we don't share our config maps with our copy
+	js, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var patched Connection
+	err = json.Unmarshal(js, &patched)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(body)
+	err = decoder.Decode(&patched)
+	if err != nil {
+		return &patched, errors.New("Invalid JSON, please check the body of your request: " + err.Error())
+	}
+
+	patched.Uuid = c.Uuid
+	patched.Paused = c.Paused
+	patched.store = c.store
+
+	err = patched.validate()
+	return &patched, err
+}
+
+// validates our config and fills in defaults for anything that wasn't specified, the sender and
+// receiver config is validated against their types by the engine
+func (c *Connection) validate() error {
+	// type is required, it is validated against our registered types by the engine
+	if c.Senders.Type == "" {
+		return errors.New("Must specify a sender type in field `type`")
+	}
+
+	if c.Receivers.Type == "" {
+		c.Receivers.Type = "http"
+	}
+
+	if c.Senders.Count == 0 {
+		c.Senders.Count = 1
+	}
+
+	if c.Receivers.Count == 0 {
+		c.Receivers.Count = 1
+	}
+
+	// fill in any retry settings that weren't specified
+	c.Retries.setDefaults()
+
+	err := c.Throttle.validate()
+	if err != nil {
+		return err
+	}
+	c.Throttle.setDefaults()
+
+	// autoscaled workers start within their bounds
+	err = c.Autoscale.validate()
+	if err != nil {
+		return err
+	}
+	c.Autoscale.setDefaults()
+	c.Senders.Count = c.Autoscale.Senders.Clamp(c.Senders.Count)
+	c.Receivers.Count = c.Autoscale.Receivers.Clamp(c.Receivers.Count)
+
+	if c.IdempotencyWindow == 0 {
+		c.IdempotencyWindow = DEFAULT_IDEMPOTENCY_WINDOW
+	}
+
+	return nil
+}
@@ -0,0 +1,407 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in memory, nothing survives a restart so it is only really
+// useful for testing and for deployments where losing queued msgs is acceptable.
+//
+// Msgs and connections are stored gob encoded, just as in our bolt store, so that callers
+// can't change what we hold by changing what they saved or loaded.
+//
+// It is an implementation of Store
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	connections map[string][]byte
+	msgs        map[string]*memoryConnection
+}
+
+// the msgs and buckets of a single connection
+type memoryConnection struct {
+	sequence    uint64
+	msgs        map[uint64][]byte
+	external    map[string]uint64
+	idempotency map[string]uint64
+	cursors     map[string]string
+	blobs       map[string][]byte
+	buckets     map[string]map[uint64]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		connections: make(map[string][]byte),
+		msgs:        make(map[string]*memoryConnection)}
+}
+
+func (s *MemoryStore) getConnection(connUuid string) (*memoryConnection, error) {
+	conn, found := s.msgs[connUuid]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("Unable to get connection bucket \"%s\"", connUuid))
+	}
+	return conn, nil
+}
+
+func (s *MemoryStore) getBucket(connUuid string, bucket string) (map[uint64]time.Time, error) {
+	conn, err := s.getConnection(connUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	b, found := conn.buckets[bucket]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("Unable get bucket: \"%s\" for connection \"%s\"", bucket, connUuid))
+	}
+	return b, nil
+}
+
+// Saves the passed in connection, creating its buckets if needed
+func (s *MemoryStore) SaveConnection(connection *Connection) error {
+	connBuf := &bytes.Buffer{}
+	err := gob.NewEncoder(connBuf).Encode(connection)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.connections[connection.Uuid] = connBuf.Bytes()
+
+	conn, found := s.msgs[connection.Uuid]
+	if !found {
+		conn = &memoryConnection{
+			msgs:        make(map[uint64][]byte),
+			external:    make(map[string]uint64),
+			idempotency: make(map[string]uint64),
+			cursors:     make(map[string]string),
+			blobs:       make(map[string][]byte),
+			buckets:     make(map[string]map[uint64]time.Time)}
+		s.msgs[connection.Uuid] = conn
+	}
+
+	for _, bucket := range CONNECTION_BUCKETS {
+		if conn.buckets[bucket] == nil {
+			conn.buckets[bucket] = make(map[uint64]time.Time)
+		}
+	}
+
+	return nil
+}
+
+// Loads the connection with the passed in uuid
+func (s *MemoryStore) LoadConnection(uuid string) (*Connection, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	connBytes, found := s.connections[uuid]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("No connection with uuid \"%s\"", uuid))
+	}
+
+	var connection Connection
+	return &connection, gob.NewDecoder(bytes.NewReader(connBytes)).Decode(&connection)
+}
+
+// Loads all our connections, ordered by uuid like our bolt store
+func (s *MemoryStore) LoadAllConnections() (*[]Connection, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	uuids := make([]string, 0, len(s.connections))
+	for uuid := range s.connections {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	connections := make([]Connection, 0, len(uuids))
+	for _, uuid := range uuids {
+		var connection Connection
+		err := gob.NewDecoder(bytes.NewReader(s.connections[uuid])).Decode(&connection)
+		if err != nil {
+			return nil, err
+		}
+		connections = append(connections, connection)
+	}
+
+	return &connections, nil
+}
+
+// Deletes the passed in connection along with all its msgs
+func (s *MemoryStore) DeleteConnection(connection *Connection) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.connections, connection.Uuid)
+	delete(s.msgs, connection.Uuid)
+	return nil
+}
+
+// Saves our msg, adding it to addBucket with the passed in time and removing it from
+// all the deleteBuckets, either bucket can be empty
+func (s *MemoryStore) SaveMsg(msg *Msg, at time.Time, addBucket string, deleteBuckets ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	conn, err := s.getConnection(msg.ConnUuid)
+	if err != nil {
+		return err
+	}
+
+	// check all our buckets exist before we change anything
+	var add map[uint64]time.Time
+	if addBucket != "" {
+		add, err = s.getBucket(msg.ConnUuid, addBucket)
+		if err != nil {
+			return err
+		}
+	}
+
+	deletes := make([]map[uint64]time.Time, 0, len(deleteBuckets))
+	for _, deleteBucket := range deleteBuckets {
+		if deleteBucket == "" {
+			continue
+		}
+
+		b, err := s.getBucket(msg.ConnUuid, deleteBucket)
+		if err != nil {
+			return err
+		}
+		deletes = append(deletes, b)
+	}
+
+	// create an id if we don't have one
+	if msg.Id == 0 {
+		conn.sequence++
+		msg.Id = conn.sequence
+
+		// if we are low priority, use our bitmask to shift it behind all others
+		if msg.Priority == PRIORITY_LOW {
+			msg.Id |= LOW_PRIORITY_MASK
+		}
+	}
+
+	msgBuf := &bytes.Buffer{}
+	err = gob.NewEncoder(msgBuf).Encode(msg)
+	if err != nil {
+		return err
+	}
+	conn.msgs[msg.Id] = msgBuf.Bytes()
+
+	// if our transport gave us an id, index it so we can find ourselves by it later
+	if msg.ExternalId != "" {
+		conn.external[msg.ExternalId] = msg.Id
+	}
+	if msg.IdempotencyKey != "" {
+		conn.idempotency[msg.IdempotencyKey] = msg.Id
+	}
+
+	if add != nil {
+		add[msg.Id] = at
+	}
+	for _, b := range deletes {
+		delete(b, msg.Id)
+	}
+
+	return nil
+}
+
+// Loads the msg with the passed in id into msg
+func (s *MemoryStore) LoadMsg(connUuid string, id uint64, msg *Msg) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	conn, err := s.getConnection(connUuid)
+	if err != nil {
+		return err
+	}
+
+	msgBytes, found := conn.msgs[id]
+	if !found {
+		return errors.New(fmt.Sprintf("No msg with id %d", id))
+	}
+
+	return gob.NewDecoder(bytes.NewReader(msgBytes)).Decode(msg)
+}
+
+// Looks up the id of the msg our transport assigned the passed in external id
+func (s *MemoryStore) GetMsgIdByExternalId(connUuid string, externalId string) (uint64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	conn, err := s.getConnection(connUuid)
+	if err != nil {
+		return 0, err
+	}
+
+	id, found := conn.external[externalId]
+	if !found {
+		return 0, errors.New(fmt.Sprintf("No msg with external id \"%s\"", externalId))
+	}
+	return id, nil
+}
+
+// Looks up the id of the last msg saved with the passed in idempotency key
+func (s *MemoryStore) GetMsgIdByIdempotencyKey(connUuid string, key string) (uint64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	conn, err := s.getConnection(connUuid)
+	if err != nil {
+		return 0, err
+	}
+
+	id, found := conn.idempotency[key]
+	if !found {
+		return 0, errors.New(fmt.Sprintf("No msg with idempotency key \"%s\"", key))
+	}
+	return id, nil
+}
+
+// Removes the msg with the passed in id from the passed in bucket and deletes it entirely
+func (s *MemoryStore) DeleteMsg(connUuid string, bucket string, id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b, err := s.getBucket(connUuid, bucket)
+	if err != nil {
+		return err
+	}
+
+	if _, found := b[id]; !found {
+		return errors.New(fmt.Sprintf("No msg with id %d in bucket \"%s\"", id, bucket))
+	}
+
+	conn := s.msgs[connUuid]
+
+	// drop our idempotency key and external id from their indexes, so they don't point at a msg that's gone
+	var msg Msg
+	msgBytes, found := conn.msgs[id]
+	if found && gob.NewDecoder(bytes.NewReader(msgBytes)).Decode(&msg) == nil {
+		if key := msg.IdempotencyKey; key != "" && conn.idempotency[key] == id {
+			delete(conn.idempotency, key)
+		}
+		if externalId := msg.ExternalId; externalId != "" && conn.external[externalId] == id {
+			delete(conn.external, externalId)
+		}
+	}
+
+	delete(b, id)
+	delete(conn.msgs, id)
+	return nil
+}
+
+// Returns the ids of all the msgs in the passed in bucket
+func (s *MemoryStore) GetBucketMsgs(connUuid string, bucket string) (*[]uint64, error) {
+	return s.getBucketMsgs(connUuid, bucket, func(at time.Time) bool { return true })
+}
+
+// Returns the ids in the passed in bucket whose time is at or before the passed in time
+func (s *MemoryStore) GetBucketMsgsBefore(connUuid string, bucket string, before time.Time) (*[]uint64, error) {
+	return s.getBucketMsgs(connUuid, bucket, func(at time.Time) bool { return !at.After(before) })
+}
+
+func (s *MemoryStore) getBucketMsgs(connUuid string, bucket string, include func(time.Time) bool) (*[]uint64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, err := s.getBucket(connUuid, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(b))
+	for id, at := range b {
+		if include(at) {
+			ids = append(ids, id)
+		}
+	}
+
+	return &ids, nil
+}
+
+// Returns the number of msgs in the passed in bucket
+func (s *MemoryStore) GetBucketSize(connUuid string, bucket string) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	b, err := s.getBucket(connUuid, bucket)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Saves the value of the passed in named cursor for a connection
+func (s *MemoryStore) SaveCursor(connUuid string, name string, value string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	conn, err := s.getConnection(connUuid)
+	if err != nil {
+		return err
+	}
+	conn.cursors[name] = value
+	return nil
+}
+
+// Loads the value of the passed in named cursor, empty if it was never saved
+func (s *MemoryStore) LoadCursor(connUuid string, name string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// connections that aren't saved yet don't have any cursors
+	conn, err := s.getConnection(connUuid)
+	if err != nil {
+		return "", nil
+	}
+	return conn.cursors[name], nil
+}
+
+// Saves the passed in blob for a connection with the passed in id
+func (s *MemoryStore) SaveBlob(connUuid string, id string, blob *Blob) error {
+	blobBuf := &bytes.Buffer{}
+	err := gob.NewEncoder(blobBuf).Encode(blob)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	conn, err := s.getConnection(connUuid)
+	if err != nil {
+		return err
+	}
+	conn.blobs[id] = blobBuf.Bytes()
+	return nil
+}
+
+// Loads the blob with the passed in id
+func (s *MemoryStore) LoadBlob(connUuid string, id string) (*Blob, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	conn, err := s.getConnection(connUuid)
+	if err != nil {
+		return nil, err
+	}
+
+	blobBytes, found := conn.blobs[id]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("No blob with id \"%s\"", id))
+	}
+
+	var blob Blob
+	return &blob, gob.NewDecoder(bytes.NewReader(blobBytes)).Decode(&blob)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
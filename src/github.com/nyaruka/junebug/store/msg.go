@@ -0,0 +1,422 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nyaruka/junebug/codec"
+	"io"
+	"sync"
+	"time"
+)
+
+type Msg struct {
+	Id         uint64    `json:"id,string"` // javascript doesn't like 64 bit ints
+	ConnUuid   string    `json:"conn_uuid"`
+	Address    string    `json:"address"`
+	Text       string    `json:"text"`
+	Segments   int       `json:"segments"`
+	Priority   string    `json:"priority"`
+	Status     string    `json:"status"`
+	Attempts   uint      `json:"attempts"`
+	ExternalId string    `json:"external_id"`
+	Log        string    `json:"log"`
+	Created    time.Time `json:"created"`
+	Finished   time.Time `json:"finished"`
+	SendAt     time.Time `json:"send_at"`
+	ExpiresOn  time.Time `json:"expires_on"`
+
+	// set by clients so that retrying a send doesn't create a second msg
+	IdempotencyKey string `json:"idempotency_key"`
+
+	// the sender that has us in flight, and until when it holds us
+	Owner        string    `json:"owner"`
+	LeaseExpires time.Time `json:"lease_expires"`
+	History    []StatusChange `json:"history"`
+
+	// media sent along with our text, if any
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// our client's own data for this msg, we store it but never look at it
+	Metadata   map[string]string `json:"metadata,omitempty"`
+
+	// the store we were loaded from or will be saved to
+	store      Store
+}
+
+// A single transition of a Msg from one status to another
+type StatusChange struct {
+	Status     string    `json:"status"`
+	Time       time.Time `json:"time"`
+}
+
+// Outgoing messages move from queued, to wired once handed to a sender, then to sent once
+// the transport has accepted them. Transports that support delivery reports may later
+// move them to delivered or failed. Messages the sender could not send are errored and
+// wait in our retry bucket to be queued again, until they run out of attempts and fail.
+const STATUS_QUEUED = "Q"
+const STATUS_WIRED = "W"
+const STATUS_SENT = "S"
+const STATUS_DELIVERED = "D"
+const STATUS_FAILED = "F"
+const STATUS_ERRORED = "E"
+
+// Outgoing messages with a send_at in the future start as scheduled, they wait in our
+// scheduled bucket until they are released to the outbox as queued, or are cancelled.
+const STATUS_SCHEDULED = "P"
+const STATUS_CANCELLED = "C"
+
+// Outgoing messages with an expires_on that are still waiting to be sent at that time are
+// expired rather than sent.
+const STATUS_EXPIRED = "T"
+
+// Incoming messages are handled once our receiver has passed them on. If our receiver
+// errors they are errored and retried, until they run out of attempts or can't be
+// retried and are dead lettered.
+const STATUS_HANDLED = "H"
+const STATUS_DEAD_LETTERED = "X"
+
+const PRIORITY_HIGH = "H"
+const PRIORITY_LOW = "L"
+
+// ids of low priority msgs have this bit set, so they sort behind all high priority ones
+const LOW_PRIORITY_MASK = 1<<63
+
+//------------------------------------------------------------------------
+// Msg Pool (this saves us GC allocations as we build a LOT of msgs)
+// ------------------------------------------------------------------------
+var msgPool = sync.Pool{
+    New: func() interface{} {
+        return &Msg{}
+    },
+}
+
+//------------------------------------------------------------------------
+// Msg Operations
+//------------------------------------------------------------------------
+
+// Write ourselves to the outbox, or if we are scheduled to our scheduled bucket until our send_at
+func (m *Msg) WriteToOutbox() (err error) {
+	if m.Status == STATUS_SCHEDULED {
+		return m.store.SaveMsg(m, m.SendAt, SCHEDULED_BUCKET)
+	}
+	return m.store.SaveMsg(m, time.Now(), OUTBOX_BUCKET)
+}
+
+// Write ourselves to the inbox
+func (m *Msg) WriteToInbox() (err error) {
+	return m.store.SaveMsg(m, time.Now(), INBOX_BUCKET)
+}
+
+// Records our transition to the passed in status
+func (m *Msg) setStatus(status string) {
+	m.Status = status
+	m.History = append(m.History, StatusChange{Status: status, Time: time.Now()})
+}
+
+// Mark ourselves as wired, that is handed to our transport by owner. We move from the outbox
+// to the in flight bucket, where we stay until we are sent, errored or our lease expires and
+// we are reconciled. Every time we are wired counts as an attempt at sending us.
+func (m *Msg) MarkWired(owner string, leaseExpires time.Time) (err error) {
+	m.setStatus(STATUS_WIRED)
+	m.Attempts++
+	m.Owner = owner
+	m.LeaseExpires = leaseExpires
+	return m.store.SaveMsg(m, leaseExpires, IN_FLIGHT_BUCKET, OUTBOX_BUCKET)
+}
+
+// Mark ourselves as queued again after our lease expired while we were in flight
+func (m *Msg) MarkLeaseRequeued(msgLog string) (err error) {
+	m.setStatus(STATUS_QUEUED)
+	m.appendLog(msgLog)
+	return m.store.SaveMsg(m, time.Now(), OUTBOX_BUCKET, IN_FLIGHT_BUCKET)
+}
+
+// Mark ourselves as sent, externalId is the id our transport assigned us, if any, it is
+// used to match delivery reports back to us
+func (m *Msg) MarkSent(externalId string, msgLog string) (err error) {
+	m.setStatus(STATUS_SENT)
+	m.ExternalId = externalId
+	m.Finished = time.Now()
+	m.appendLog(msgLog)
+	return m.store.SaveMsg(m, time.Now(), SENT_BUCKET, OUTBOX_BUCKET, IN_FLIGHT_BUCKET)
+}
+
+// Mark ourselves as errored, that is our sender was unable to send us. We wait in the retry
+// bucket until retryOn, when we will be queued again.
+func (m *Msg) MarkErrored(msgLog string, retryOn time.Time) (err error) {
+	m.setStatus(STATUS_ERRORED)
+	m.appendLog(msgLog)
+	return m.store.SaveMsg(m, retryOn, RETRY_BUCKET, OUTBOX_BUCKET, IN_FLIGHT_BUCKET)
+}
+
+// Mark ourselves as errored because our transport rate limited us. We wait in the retry bucket
+// until retryOn like any other error, but this attempt doesn't count against our retries.
+func (m *Msg) MarkRateLimited(msgLog string, retryOn time.Time) (err error) {
+	if m.Attempts > 0 {
+		m.Attempts--
+	}
+	return m.MarkErrored(msgLog, retryOn)
+}
+
+// Mark ourselves as queued again after waiting in the retry bucket
+func (m *Msg) MarkRequeued() (err error) {
+	m.setStatus(STATUS_QUEUED)
+	return m.store.SaveMsg(m, time.Now(), OUTBOX_BUCKET, RETRY_BUCKET)
+}
+
+// Mark ourselves as queued in the outbox, our send_at has arrived
+func (m *Msg) MarkReleased() (err error) {
+	if m.Status != STATUS_SCHEDULED {
+		return errors.New(fmt.Sprintf("Msg %d is not scheduled", m.Id))
+	}
+
+	m.setStatus(STATUS_QUEUED)
+	return m.store.SaveMsg(m, time.Now(), OUTBOX_BUCKET, SCHEDULED_BUCKET)
+}
+
+// Mark ourselves as cancelled, we are removed from our scheduled bucket and will never be sent
+func (m *Msg) MarkCancelled() (err error) {
+	if m.Status != STATUS_SCHEDULED {
+		return errors.New(fmt.Sprintf("Msg %d is not scheduled", m.Id))
+	}
+
+	m.setStatus(STATUS_CANCELLED)
+	m.Finished = time.Now()
+	return m.store.SaveMsg(m, time.Now(), "", SCHEDULED_BUCKET)
+}
+
+// Whether we have passed our expires_on, msgs without one never expire
+func (m *Msg) IsExpired(now time.Time) bool {
+	return !m.ExpiresOn.IsZero() && !now.Before(m.ExpiresOn)
+}
+
+// Mark ourselves as expired, we will never be sent
+func (m *Msg) MarkExpired(msgLog string) (err error) {
+	m.setStatus(STATUS_EXPIRED)
+	m.Finished = time.Now()
+	m.appendLog(msgLog)
+	return m.store.SaveMsg(m, time.Now(), EXPIRED_BUCKET, OUTBOX_BUCKET, RETRY_BUCKET, SENT_BUCKET, SCHEDULED_BUCKET,
+		IN_FLIGHT_BUCKET)
+}
+
+// Mark ourselves as delivered, this is reported asynchronously by transports after we are sent
+func (m *Msg) MarkDelivered(msgLog string) (err error) {
+	m.setStatus(STATUS_DELIVERED)
+	m.appendLog(msgLog)
+	return m.store.SaveMsg(m, time.Now(), "")
+}
+
+// Mark ourselves as failed, either because transports reported it after we were sent or
+// because we ran out of attempts at sending us
+func (m *Msg) MarkFailed(msgLog string) (err error) {
+	m.setStatus(STATUS_FAILED)
+	m.Finished = time.Now()
+	m.appendLog(msgLog)
+	return m.store.SaveMsg(m, time.Now(), FAILED_BUCKET, OUTBOX_BUCKET, RETRY_BUCKET, SENT_BUCKET, IN_FLIGHT_BUCKET)
+}
+
+// Mark ourselves as handled, this just update our status and saves
+func (m *Msg) MarkHandled(msgLog string) (err error) {
+	m.setStatus(STATUS_HANDLED)
+	m.Finished = time.Now()
+	m.Log = msgLog
+	return m.store.SaveMsg(m, time.Now(), HANDLED_BUCKET, INBOX_BUCKET)
+}
+
+// Mark ourselves as errored by our receiver. We wait in the inbox retry bucket until
+// retryOn, when we will be queued again.
+func (m *Msg) MarkHandleErrored(msgLog string, retryOn time.Time) (err error) {
+	m.setStatus(STATUS_ERRORED)
+	m.appendLog(msgLog)
+	return m.store.SaveMsg(m, retryOn, INBOX_RETRY_BUCKET, INBOX_BUCKET)
+}
+
+// Mark ourselves as queued in the inbox again after waiting in the inbox retry bucket
+func (m *Msg) MarkInboxRequeued() (err error) {
+	m.setStatus(STATUS_QUEUED)
+	return m.store.SaveMsg(m, time.Now(), INBOX_BUCKET, INBOX_RETRY_BUCKET)
+}
+
+// Mark ourselves as dead lettered, our receiver gave up on us. We wait in the dead letter
+// bucket until we are replayed or dropped.
+func (m *Msg) MarkDeadLettered(msgLog string) (err error) {
+	m.setStatus(STATUS_DEAD_LETTERED)
+	m.Finished = time.Now()
+	m.appendLog(msgLog)
+	return m.store.SaveMsg(m, time.Now(), DEAD_LETTER_BUCKET, INBOX_BUCKET, INBOX_RETRY_BUCKET)
+}
+
+// Moves ourselves from the dead letter bucket back to the inbox, with a fresh set of attempts
+func (m *Msg) MarkReplayed() (err error) {
+	if m.Status != STATUS_DEAD_LETTERED {
+		return errors.New(fmt.Sprintf("Msg %d is not dead lettered", m.Id))
+	}
+
+	m.setStatus(STATUS_QUEUED)
+	m.Attempts = 0
+	m.Finished = time.Time{}
+	return m.store.SaveMsg(m, time.Now(), INBOX_BUCKET, DEAD_LETTER_BUCKET)
+}
+
+// Adds the passed in line to our log, keeping what was logged when we were sent
+func (m *Msg) appendLog(msgLog string) {
+	if m.Log == "" {
+		m.Log = msgLog
+	} else if msgLog != "" {
+		m.Log = m.Log + "\n" + msgLog
+	}
+}
+
+// Clears the values on this msg
+func (m *Msg) init() {
+	m.Id = 0
+	m.ConnUuid = ""
+	m.Address = ""
+	m.Text = ""
+	m.Segments = 0
+	m.Priority = ""
+	m.Status = ""
+	m.Attempts = 0
+	m.ExternalId = ""
+	m.Log = ""
+	m.Created = time.Time{}
+	m.Finished = time.Time{}
+	m.SendAt = time.Time{}
+	m.ExpiresOn = time.Time{}
+	m.IdempotencyKey = ""
+	m.Owner = ""
+	m.LeaseExpires = time.Time{}
+	m.History = nil
+	m.Attachments = nil
+	m.Metadata = nil
+	m.store = nil
+}
+
+// Releases this message back to our pool
+func (m *Msg) Release() {
+	msgPool.Put(m)
+}
+
+// Reads a Msg from the passed in store
+func MsgFromId(s Store, connUuid string, id uint64) (msg *Msg, err error) {
+	msg = msgPool.Get().(*Msg)
+	msg.init()
+	msg.store = s
+	return msg, s.LoadMsg(connUuid, id, msg)
+}
+
+// Reads the Msg our transport assigned the passed in id, this is how delivery reports
+// are matched back to the Msg they are for
+func MsgFromExternalId(s Store, connUuid string, externalId string) (msg *Msg, err error) {
+	id, err := s.GetMsgIdByExternalId(connUuid, externalId)
+	if err != nil {
+		return nil, err
+	}
+	return MsgFromId(s, connUuid, id)
+}
+
+// Reads the Msg a client sent with the passed in idempotency key
+func MsgFromIdempotencyKey(s Store, connUuid string, key string) (msg *Msg, err error) {
+	id, err := s.GetMsgIdByIdempotencyKey(connUuid, key)
+	if err != nil {
+		return nil, err
+	}
+	return MsgFromId(s, connUuid, id)
+}
+
+// Builds a Msg object from the passed in text and from
+func MsgFromText(s Store, connUuid string, from string, text string) *Msg {
+	msg := msgPool.Get().(*Msg)
+	msg.init()
+	msg.store = s
+
+	msg.ConnUuid = connUuid
+	msg.Address = from
+	msg.Text = text
+	msg.Segments = codec.CountSegments(text)
+	msg.Priority = PRIORITY_LOW
+	msg.setStatus(STATUS_QUEUED)
+	msg.Created = time.Now()
+
+	return msg
+}
+
+// Builds a Msg object from the passed in JSON
+func MsgFromJson(s Store, body io.Reader) (*Msg, error) {
+	msg := msgPool.Get().(*Msg)
+	msg.init()
+	msg.store = s
+
+	// Decode it from the passed in JSON, validity is an alternative to expires_on in seconds
+	envelope := struct {
+		*Msg
+		Validity   int       `json:"validity"`
+	}{Msg: msg}
+
+	decoder := json.NewDecoder(body)
+	err := decoder.Decode(&envelope)
+	if err != nil {
+		return msg, err
+	}
+
+	// address is required, along with text, attachments or both
+	if msg.Address == "" || (msg.Text == "" && len(msg.Attachments) == 0) {
+		return msg, errors.New("Must specify `address` and one of `text` or `attachments`")
+	}
+
+	for i := range msg.Attachments {
+		err = msg.Attachments[i].validate()
+		if err != nil {
+			return msg, err
+		}
+	}
+
+	if msg.Priority == "" {
+		msg.Priority = PRIORITY_LOW
+	}
+
+	// check that priority is set correctly
+	if msg.Priority != PRIORITY_HIGH && msg.Priority != PRIORITY_LOW {
+		return msg, errors.New("`priority` must be one of `H` (high) or `L` (low)")
+	}
+
+	// these are set by us, not our client
+	msg.Attempts = 0
+	msg.ExternalId = ""
+	msg.History = nil
+	msg.Owner = ""
+	msg.LeaseExpires = time.Time{}
+	msg.Segments = codec.CountSegments(msg.Text)
+
+	// all messages start as queued, unless they are to be sent later
+	msg.Created = time.Now()
+	if msg.SendAt.After(msg.Created) {
+		msg.setStatus(STATUS_SCHEDULED)
+	} else {
+		msg.SendAt = time.Time{}
+		msg.setStatus(STATUS_QUEUED)
+	}
+
+	// our validity counts from when we are to be sent
+	start := msg.Created
+	if !msg.SendAt.IsZero() {
+		start = msg.SendAt
+	}
+
+	if envelope.Validity < 0 {
+		return msg, errors.New("`validity` must be a positive number of seconds")
+	} else if envelope.Validity > 0 {
+		if !msg.ExpiresOn.IsZero() {
+			return msg, errors.New("Only one of `expires_on` and `validity` can be specified")
+		}
+		msg.ExpiresOn = start.Add(time.Duration(envelope.Validity) * time.Second)
+	}
+
+	if !msg.ExpiresOn.IsZero() && !msg.ExpiresOn.After(start) {
+		return msg, errors.New("`expires_on` must be after the msg is to be sent")
+	}
+
+	// return our msg
+	return msg, nil
+}
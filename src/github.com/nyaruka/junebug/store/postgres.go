@@ -0,0 +1,556 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"strconv"
+	"time"
+)
+
+// PostgresStore keeps everything in a PostgreSQL database, with msgs stored as regular rows
+// so that their history can be queried with SQL by whatever else shares the database.
+//
+// Msg ids are stored as numeric, as Postgres has no unsigned 64 bit type and our low
+// priority ids use the top bit (see LOW_PRIORITY_MASK). This keeps them identical to the
+// ids our API hands out and means ordering by id still puts high priority msgs first.
+//
+// It is an implementation of Store
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// Each migration is applied once, in order, and recorded in our schema_migrations table.
+// Never change a migration once it has been released, add a new one instead.
+var postgresMigrations = []string{
+	// 1: our initial schema
+	`CREATE TABLE connections (
+		uuid         varchar(36) PRIMARY KEY,
+		config       jsonb NOT NULL,
+		msg_sequence bigint NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE msgs (
+		conn_uuid    varchar(36) NOT NULL REFERENCES connections(uuid) ON DELETE CASCADE,
+		id           numeric(20) NOT NULL,
+		address      text NOT NULL,
+		text         text NOT NULL,
+		priority     varchar(1) NOT NULL,
+		status       varchar(1) NOT NULL,
+		attempts     integer NOT NULL,
+		external_id  text,
+		log          text NOT NULL,
+		created      timestamp with time zone NOT NULL,
+		finished     timestamp with time zone,
+		history      jsonb NOT NULL,
+		PRIMARY KEY (conn_uuid, id)
+	);
+
+	CREATE INDEX msgs_external_id ON msgs(conn_uuid, external_id) WHERE external_id IS NOT NULL;
+
+	CREATE TABLE msg_buckets (
+		conn_uuid    varchar(36) NOT NULL,
+		bucket       varchar(32) NOT NULL,
+		msg_id       numeric(20) NOT NULL,
+		at           timestamp with time zone NOT NULL,
+		PRIMARY KEY (conn_uuid, bucket, msg_id),
+		FOREIGN KEY (conn_uuid, msg_id) REFERENCES msgs(conn_uuid, id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX msg_buckets_at ON msg_buckets(conn_uuid, bucket, at);`,
+
+	// 2: scheduled msgs
+	`ALTER TABLE msgs ADD COLUMN send_at timestamp with time zone;`,
+
+	// 3: msg expiry
+	`ALTER TABLE msgs ADD COLUMN expires_on timestamp with time zone;`,
+
+	// 4: idempotency keys
+	`ALTER TABLE msgs ADD COLUMN idempotency_key text;
+
+	CREATE INDEX msgs_idempotency_key ON msgs(conn_uuid, idempotency_key) WHERE idempotency_key IS NOT NULL;`,
+
+	// 5: sms segment counts
+	`ALTER TABLE msgs ADD COLUMN segments integer NOT NULL DEFAULT 0;`,
+
+	// 6: in flight leases
+	`ALTER TABLE msgs ADD COLUMN owner text, ADD COLUMN lease_expires timestamp with time zone;`,
+
+	// 7: transport cursors
+	`CREATE TABLE connection_cursors (
+		conn_uuid    varchar(36) NOT NULL REFERENCES connections(uuid) ON DELETE CASCADE,
+		name         varchar(64) NOT NULL,
+		value        text NOT NULL,
+		PRIMARY KEY (conn_uuid, name)
+	);`,
+
+	// 8: attachments
+	`ALTER TABLE msgs ADD COLUMN attachments jsonb;
+
+	CREATE TABLE blobs (
+		conn_uuid    varchar(36) NOT NULL REFERENCES connections(uuid) ON DELETE CASCADE,
+		id           varchar(36) NOT NULL,
+		content_type text NOT NULL,
+		data         bytea NOT NULL,
+		PRIMARY KEY (conn_uuid, id)
+	);`,
+
+	// 9: metadata
+	`ALTER TABLE msgs ADD COLUMN metadata jsonb;`,
+}
+
+// Connects to the Postgres database at the passed in URL, bringing its schema up to date
+func OpenPostgresStore(url string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+
+	err = migratePostgres(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+// applies any of our migrations the database doesn't have yet. This happens in a single
+// transaction holding a lock on our migrations table, so concurrent starts are safe.
+func migratePostgres(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		applied timestamp with time zone NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("LOCK TABLE schema_migrations IN EXCLUSIVE MODE")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version > len(postgresMigrations) {
+		return errors.New(fmt.Sprintf("Database schema version %d is newer than this version of Junebug supports (%d)",
+			version, len(postgresMigrations)))
+	}
+
+	for i := version; i < len(postgresMigrations); i++ {
+		_, err = tx.Exec(postgresMigrations[i])
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error applying migration %d: %s", i+1, err.Error()))
+		}
+
+		_, err = tx.Exec("INSERT INTO schema_migrations(version, applied) VALUES($1, NOW())", i+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// our ids are passed to and from Postgres as strings, as database/sql can't take uint64s
+// with the top bit set
+func formatId(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+func scanIds(rows *sql.Rows) (*[]uint64, error) {
+	defer rows.Close()
+
+	ids := make([]uint64, 0, 100)
+	for rows.Next() {
+		var idStr string
+		err := rows.Scan(&idStr)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return &ids, rows.Err()
+}
+
+// Saves the passed in connection
+func (s *PostgresStore) SaveConnection(connection *Connection) error {
+	config, err := json.Marshal(connection)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO connections(uuid, config) VALUES($1, $2)
+		ON CONFLICT (uuid) DO UPDATE SET config = EXCLUDED.config`, connection.Uuid, string(config))
+	return err
+}
+
+// Loads the connection with the passed in uuid
+func (s *PostgresStore) LoadConnection(uuid string) (*Connection, error) {
+	var config []byte
+	err := s.db.QueryRow("SELECT config FROM connections WHERE uuid = $1", uuid).Scan(&config)
+	if err == sql.ErrNoRows {
+		return nil, errors.New(fmt.Sprintf("No connection with uuid \"%s\"", uuid))
+	} else if err != nil {
+		return nil, err
+	}
+
+	var connection Connection
+	return &connection, json.Unmarshal(config, &connection)
+}
+
+// Loads all our connections
+func (s *PostgresStore) LoadAllConnections() (*[]Connection, error) {
+	rows, err := s.db.Query("SELECT config FROM connections ORDER BY uuid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	connections := make([]Connection, 0, 10)
+	for rows.Next() {
+		var config []byte
+		err = rows.Scan(&config)
+		if err != nil {
+			return nil, err
+		}
+
+		var connection Connection
+		err = json.Unmarshal(config, &connection)
+		if err != nil {
+			return nil, err
+		}
+		connections = append(connections, connection)
+	}
+
+	return &connections, rows.Err()
+}
+
+// Deletes the passed in connection, our foreign keys take care of its msgs
+func (s *PostgresStore) DeleteConnection(connection *Connection) error {
+	_, err := s.db.Exec("DELETE FROM connections WHERE uuid = $1", connection.Uuid)
+	return err
+}
+
+// Saves our msg, adding it to addBucket with the passed in time and removing it from
+// all the deleteBuckets, either bucket can be empty
+func (s *PostgresStore) SaveMsg(msg *Msg, at time.Time, addBucket string, deleteBuckets ...string) error {
+	history, err := json.Marshal(msg.History)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// create an id if we don't have one, our sequence lives on our connection
+	id := msg.Id
+	if id == 0 {
+		var sequence int64
+		err = tx.QueryRow("UPDATE connections SET msg_sequence = msg_sequence + 1 WHERE uuid = $1 RETURNING msg_sequence",
+			msg.ConnUuid).Scan(&sequence)
+		if err == sql.ErrNoRows {
+			return errors.New(fmt.Sprintf("Unable to get connection \"%s\"", msg.ConnUuid))
+		} else if err != nil {
+			return err
+		}
+
+		id = uint64(sequence)
+
+		// if we are low priority, use our bitmask to shift it behind all others
+		if msg.Priority == PRIORITY_LOW {
+			id |= LOW_PRIORITY_MASK
+		}
+	}
+
+	err = s.saveMsg(tx, msg, id, string(history), at, addBucket, deleteBuckets)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// only take our new id once we know we've been written
+	msg.Id = id
+	return nil
+}
+
+func (s *PostgresStore) saveMsg(tx *sql.Tx, msg *Msg, id uint64, history string, at time.Time, addBucket string, deleteBuckets []string) error {
+	var externalId, finished, sendAt, expiresOn, idempotencyKey, owner, leaseExpires interface{}
+	if msg.ExternalId != "" {
+		externalId = msg.ExternalId
+	}
+	if msg.IdempotencyKey != "" {
+		idempotencyKey = msg.IdempotencyKey
+	}
+	if !msg.Finished.IsZero() {
+		finished = msg.Finished
+	}
+	if !msg.SendAt.IsZero() {
+		sendAt = msg.SendAt
+	}
+	if !msg.ExpiresOn.IsZero() {
+		expiresOn = msg.ExpiresOn
+	}
+	if msg.Owner != "" {
+		owner = msg.Owner
+	}
+	if !msg.LeaseExpires.IsZero() {
+		leaseExpires = msg.LeaseExpires
+	}
+
+	var attachments interface{}
+	if len(msg.Attachments) > 0 {
+		js, err := json.Marshal(msg.Attachments)
+		if err != nil {
+			return err
+		}
+		attachments = string(js)
+	}
+
+	var metadata interface{}
+	if len(msg.Metadata) > 0 {
+		js, err := json.Marshal(msg.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = string(js)
+	}
+
+	_, err := tx.Exec(`INSERT INTO msgs(conn_uuid, id, address, text, priority, status, attempts, external_id, log, created, finished, history, send_at, expires_on, idempotency_key, segments, owner, lease_expires, attachments, metadata)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+		ON CONFLICT (conn_uuid, id) DO UPDATE SET address = EXCLUDED.address, text = EXCLUDED.text,
+			priority = EXCLUDED.priority, status = EXCLUDED.status, attempts = EXCLUDED.attempts,
+			external_id = EXCLUDED.external_id, log = EXCLUDED.log, created = EXCLUDED.created,
+			finished = EXCLUDED.finished, history = EXCLUDED.history, send_at = EXCLUDED.send_at,
+			expires_on = EXCLUDED.expires_on, idempotency_key = EXCLUDED.idempotency_key, segments = EXCLUDED.segments,
+			owner = EXCLUDED.owner, lease_expires = EXCLUDED.lease_expires, attachments = EXCLUDED.attachments,
+			metadata = EXCLUDED.metadata`,
+		msg.ConnUuid, formatId(id), msg.Address, msg.Text, msg.Priority, msg.Status, msg.Attempts,
+		externalId, msg.Log, msg.Created, finished, history, sendAt, expiresOn, idempotencyKey, msg.Segments, owner, leaseExpires,
+		attachments, metadata)
+	if err != nil {
+		return err
+	}
+
+	// if we have bucket to add to, insert there
+	if addBucket != "" {
+		_, err = tx.Exec(`INSERT INTO msg_buckets(conn_uuid, bucket, msg_id, at) VALUES($1, $2, $3, $4)
+			ON CONFLICT (conn_uuid, bucket, msg_id) DO UPDATE SET at = EXCLUDED.at`,
+			msg.ConnUuid, addBucket, formatId(id), at)
+		if err != nil {
+			return err
+		}
+	}
+
+	// remove from any buckets we are leaving
+	for _, deleteBucket := range deleteBuckets {
+		if deleteBucket == "" {
+			continue
+		}
+
+		_, err = tx.Exec("DELETE FROM msg_buckets WHERE conn_uuid = $1 AND bucket = $2 AND msg_id = $3",
+			msg.ConnUuid, deleteBucket, formatId(id))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Loads the msg with the passed in id into msg
+func (s *PostgresStore) LoadMsg(connUuid string, id uint64, msg *Msg) error {
+	var idStr string
+	var externalId, idempotencyKey, owner sql.NullString
+	var finished, sendAt, expiresOn, leaseExpires *time.Time
+	var history, attachments, metadata []byte
+
+	err := s.db.QueryRow(`SELECT conn_uuid, id, address, text, priority, status, attempts, external_id, log, created, finished, history, send_at, expires_on, idempotency_key, segments, owner, lease_expires, attachments, metadata
+		FROM msgs WHERE conn_uuid = $1 AND id = $2`, connUuid, formatId(id)).Scan(
+		&msg.ConnUuid, &idStr, &msg.Address, &msg.Text, &msg.Priority, &msg.Status, &msg.Attempts,
+		&externalId, &msg.Log, &msg.Created, &finished, &history, &sendAt, &expiresOn, &idempotencyKey, &msg.Segments, &owner, &leaseExpires,
+		&attachments, &metadata)
+	if err == sql.ErrNoRows {
+		return errors.New(fmt.Sprintf("No msg with id %d", id))
+	} else if err != nil {
+		return err
+	}
+
+	msg.Id = id
+	msg.ExternalId = externalId.String
+	msg.IdempotencyKey = idempotencyKey.String
+	msg.Owner = owner.String
+	if finished != nil {
+		msg.Finished = *finished
+	}
+	if sendAt != nil {
+		msg.SendAt = *sendAt
+	}
+	if expiresOn != nil {
+		msg.ExpiresOn = *expiresOn
+	}
+	if leaseExpires != nil {
+		msg.LeaseExpires = *leaseExpires
+	}
+	if attachments != nil {
+		err = json.Unmarshal(attachments, &msg.Attachments)
+		if err != nil {
+			return err
+		}
+	}
+	if metadata != nil {
+		err = json.Unmarshal(metadata, &msg.Metadata)
+		if err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(history, &msg.History)
+}
+
+// Looks up the id of the msg our transport assigned the passed in external id
+func (s *PostgresStore) GetMsgIdByExternalId(connUuid string, externalId string) (uint64, error) {
+	var idStr string
+	err := s.db.QueryRow("SELECT id FROM msgs WHERE conn_uuid = $1 AND external_id = $2 ORDER BY id DESC LIMIT 1",
+		connUuid, externalId).Scan(&idStr)
+	if err == sql.ErrNoRows {
+		return 0, errors.New(fmt.Sprintf("No msg with external id \"%s\"", externalId))
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(idStr, 10, 64)
+}
+
+// Looks up the id of the last msg saved with the passed in idempotency key
+func (s *PostgresStore) GetMsgIdByIdempotencyKey(connUuid string, key string) (uint64, error) {
+	var idStr string
+	err := s.db.QueryRow("SELECT id FROM msgs WHERE conn_uuid = $1 AND idempotency_key = $2 ORDER BY created DESC LIMIT 1",
+		connUuid, key).Scan(&idStr)
+	if err == sql.ErrNoRows {
+		return 0, errors.New(fmt.Sprintf("No msg with idempotency key \"%s\"", key))
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(idStr, 10, 64)
+}
+
+// Removes the msg with the passed in id from the passed in bucket and deletes it entirely
+func (s *PostgresStore) DeleteMsg(connUuid string, bucket string, id uint64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM msg_buckets WHERE conn_uuid = $1 AND bucket = $2 AND msg_id = $3",
+		connUuid, bucket, formatId(id))
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return errors.New(fmt.Sprintf("No msg with id %d in bucket \"%s\"", id, bucket))
+	}
+
+	_, err = tx.Exec("DELETE FROM msgs WHERE conn_uuid = $1 AND id = $2", connUuid, formatId(id))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Returns the ids of all the msgs in the passed in bucket
+func (s *PostgresStore) GetBucketMsgs(connUuid string, bucket string) (*[]uint64, error) {
+	rows, err := s.db.Query("SELECT msg_id FROM msg_buckets WHERE conn_uuid = $1 AND bucket = $2 ORDER BY msg_id",
+		connUuid, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return scanIds(rows)
+}
+
+// Returns the ids in the passed in bucket whose time is at or before the passed in time
+func (s *PostgresStore) GetBucketMsgsBefore(connUuid string, bucket string, before time.Time) (*[]uint64, error) {
+	rows, err := s.db.Query(`SELECT msg_id FROM msg_buckets WHERE conn_uuid = $1 AND bucket = $2 AND at <= $3
+		ORDER BY msg_id`, connUuid, bucket, before)
+	if err != nil {
+		return nil, err
+	}
+	return scanIds(rows)
+}
+
+// Returns the number of msgs in the passed in bucket
+func (s *PostgresStore) GetBucketSize(connUuid string, bucket string) (size int, err error) {
+	err = s.db.QueryRow("SELECT COUNT(*) FROM msg_buckets WHERE conn_uuid = $1 AND bucket = $2",
+		connUuid, bucket).Scan(&size)
+	return size, err
+}
+
+// Saves the value of the passed in named cursor for a connection
+func (s *PostgresStore) SaveCursor(connUuid string, name string, value string) error {
+	_, err := s.db.Exec(`INSERT INTO connection_cursors(conn_uuid, name, value) VALUES($1, $2, $3)
+		ON CONFLICT (conn_uuid, name) DO UPDATE SET value = EXCLUDED.value`, connUuid, name, value)
+	return err
+}
+
+// Loads the value of the passed in named cursor, empty if it was never saved
+func (s *PostgresStore) LoadCursor(connUuid string, name string) (value string, err error) {
+	err = s.db.QueryRow("SELECT value FROM connection_cursors WHERE conn_uuid = $1 AND name = $2",
+		connUuid, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// Saves the passed in blob for a connection with the passed in id
+func (s *PostgresStore) SaveBlob(connUuid string, id string, blob *Blob) error {
+	_, err := s.db.Exec(`INSERT INTO blobs(conn_uuid, id, content_type, data) VALUES($1, $2, $3, $4)
+		ON CONFLICT (conn_uuid, id) DO UPDATE SET content_type = EXCLUDED.content_type, data = EXCLUDED.data`,
+		connUuid, id, blob.ContentType, blob.Data)
+	return err
+}
+
+// Loads the blob with the passed in id
+func (s *PostgresStore) LoadBlob(connUuid string, id string) (*Blob, error) {
+	var blob Blob
+	err := s.db.QueryRow("SELECT content_type, data FROM blobs WHERE conn_uuid = $1 AND id = $2",
+		connUuid, id).Scan(&blob.ContentType, &blob.Data)
+	if err == sql.ErrNoRows {
+		return nil, errors.New(fmt.Sprintf("No blob with id \"%s\"", id))
+	}
+	return &blob, err
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
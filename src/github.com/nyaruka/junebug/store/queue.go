@@ -30,6 +30,11 @@ func (*PriorityQueue) insertInSlice(ids []uint64, id uint64) []uint64 {
 		i = sort.Search(len(ids), func(i int) bool { return (ids)[i] >= id })
 	}
 
+	// ids are only ever queued once, so the same msg can't be dispatched twice
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+
 	// special case inserting at the end, which is a simple append
 	if i == len(ids) {
 		ids = append(ids, id)
@@ -54,6 +59,14 @@ func (q *PriorityQueue) Len() int {
 	return len(q.low) + len(q.high)
 }
 
+// Returns the id Pop would return, without removing it
+func (q *PriorityQueue) Peek() (id uint64) {
+	if len(q.high) > 0 {
+		return q.high[0]
+	}
+	return q.low[0]
+}
+
 func (q *PriorityQueue) Pop() (id uint64) {
 	if len(q.high) > 0 {
 		id = q.high[0]
@@ -1,4 +1,4 @@
-package store
+package store_test
 
 import (
 	"testing"
@@ -55,4 +55,18 @@ func TestInsertSorted(t *testing.T){
 			t.Errorf("[%d] %d should be %d", i, id, test)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestInsertDuplicate(t *testing.T) {
+	pq := store.PriorityQueue{}
+
+	pq.Insert(5)
+	pq.Insert(3)
+	pq.Insert(5)
+	pq.Insert(store.LOW_PRIORITY_MASK|3)
+	pq.Insert(store.LOW_PRIORITY_MASK|3)
+
+	if pq.Len() != 3 {
+		t.Errorf("Expected duplicate ids to be ignored, got length %d", pq.Len())
+	}
+}
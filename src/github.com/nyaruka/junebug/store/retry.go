@@ -0,0 +1,59 @@
+package store
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Our defaults for connections that don't specify their retry settings
+const DEFAULT_MAX_ATTEMPTS = 3
+const DEFAULT_BACKOFF = 30
+const DEFAULT_MAX_BACKOFF = 3600
+
+// How a connection retries msgs its sender errored on, times are in seconds
+type RetryConfig struct {
+	MaxAttempts uint `json:"max_attempts"`
+	Backoff     uint `json:"backoff"`
+	MaxBackoff  uint `json:"max_backoff"`
+}
+
+func (r *RetryConfig) setDefaults() {
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if r.Backoff == 0 {
+		r.Backoff = DEFAULT_BACKOFF
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	if r.MaxBackoff < r.Backoff {
+		r.MaxBackoff = r.Backoff
+	}
+}
+
+// Returns when a msg which has been attempted the passed in number of times should next
+// be retried, and whether it should be retried at all.
+//
+// Our delay doubles with each attempt up to our max backoff, we then pick a random point
+// in the later half of that so that msgs which errored together don't retry together.
+func (r RetryConfig) NextRetry(attempts uint) (time.Time, bool) {
+	// connections saved before we had retries won't have any settings
+	r.setDefaults()
+
+	if attempts >= r.MaxAttempts {
+		return time.Time{}, false
+	}
+
+	delay := time.Duration(r.Backoff) * time.Second
+	max := time.Duration(r.MaxBackoff) * time.Second
+	for i := uint(1); i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	return time.Now().Add(delay), true
+}
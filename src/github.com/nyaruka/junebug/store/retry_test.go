@@ -0,0 +1,42 @@
+package store_test
+
+import (
+	"github.com/nyaruka/junebug/store"
+	"testing"
+	"time"
+)
+
+func TestNextRetry(t *testing.T) {
+	config := store.RetryConfig{MaxAttempts: 5, Backoff: 10, MaxBackoff: 60}
+
+	// our delay doubles each attempt, jittered into the later half, until it hits our max
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 60 * time.Second}
+	for i, max := range expected {
+		now := time.Now()
+		retryOn, retry := config.NextRetry(uint(i + 1))
+		if !retry {
+			t.Fatalf("[%d] Expected retry", i+1)
+		}
+
+		delay := retryOn.Sub(now)
+		if delay < max/2 || delay > max+time.Second {
+			t.Errorf("[%d] Delay %s should be between %s and %s", i+1, delay, max/2, max)
+		}
+	}
+
+	// out of attempts
+	_, retry := config.NextRetry(5)
+	if retry {
+		t.Error("Expected no retry after max attempts")
+	}
+
+	// connections without settings get our defaults
+	_, retry = store.RetryConfig{}.NextRetry(store.DEFAULT_MAX_ATTEMPTS - 1)
+	if !retry {
+		t.Error("Expected default config to retry")
+	}
+	_, retry = store.RetryConfig{}.NextRetry(store.DEFAULT_MAX_ATTEMPTS)
+	if retry {
+		t.Error("Expected default config to stop retrying")
+	}
+}
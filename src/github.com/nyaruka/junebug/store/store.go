@@ -0,0 +1,94 @@
+package store
+
+import (
+	"time"
+)
+
+// Store is the interface our persistence backends implement. It deals only in connections,
+// msgs, the queue buckets msgs move between, the blobs attached to msgs and the cursors
+// transports keep per connection, all the logic of what moves where lives in Msg and
+// Connection, which carry a reference to the Store they were loaded from.
+//
+// Every connection has its own set of buckets (see CONNECTION_BUCKETS), each bucket holds
+// msg ids along with a time, usually when the msg was added but for our retry and scheduled
+// buckets when the msg is next due, and for our in flight bucket when its lease expires.
+type Store interface {
+	// Saves the passed in connection, creating all its buckets if they don't exist
+	SaveConnection(connection *Connection) error
+
+	// Loads the connection with the passed in uuid
+	LoadConnection(uuid string) (*Connection, error)
+
+	// Loads every connection
+	LoadAllConnections() (*[]Connection, error)
+
+	// Deletes the passed in connection and all its msgs
+	DeleteConnection(connection *Connection) error
+
+	// Saves the passed in msg, assigning it an id if it doesn't have one, adding it to
+	// addBucket with the passed in time and removing it from all deleteBuckets
+	SaveMsg(msg *Msg, at time.Time, addBucket string, deleteBuckets ...string) error
+
+	// Loads the msg with the passed in id into msg
+	LoadMsg(connUuid string, id uint64, msg *Msg) error
+
+	// Looks up the id of the msg our transport assigned the passed in external id
+	GetMsgIdByExternalId(connUuid string, externalId string) (uint64, error)
+
+	// Looks up the id of the last msg saved with the passed in idempotency key
+	GetMsgIdByIdempotencyKey(connUuid string, key string) (uint64, error)
+
+	// Removes the msg with the passed in id from the passed in bucket and deletes it,
+	// erroring if it isn't in that bucket
+	DeleteMsg(connUuid string, bucket string, id uint64) error
+
+	// Returns the ids of all the msgs in the passed in bucket, in no particular order
+	GetBucketMsgs(connUuid string, bucket string) (*[]uint64, error)
+
+	// Returns the ids of the msgs in the passed in bucket whose time is at or before the passed in time
+	GetBucketMsgsBefore(connUuid string, bucket string, before time.Time) (*[]uint64, error)
+
+	// Returns how many msgs are in the passed in bucket
+	GetBucketSize(connUuid string, bucket string) (int, error)
+
+	// Saves the value of the passed in named cursor for a connection, such as the id of the
+	// last msg a transport has seen, these are deleted along with their connection
+	SaveCursor(connUuid string, name string, value string) error
+
+	// Loads the value of the passed in named cursor, which is empty if it was never saved, including
+	// for connections that aren't saved yet
+	LoadCursor(connUuid string, name string) (string, error)
+
+	// Saves the passed in blob for a connection with the passed in id, these are deleted along
+	// with their connection
+	SaveBlob(connUuid string, id string, blob *Blob) error
+
+	// Loads the blob with the passed in id, erroring if there isn't one
+	LoadBlob(connUuid string, id string) (*Blob, error)
+
+	// Closes our store, releasing any resources
+	Close() error
+}
+
+const OUTBOX_BUCKET = "outbox"
+const SENT_BUCKET = "sent"
+const INBOX_BUCKET = "inbox"
+const HANDLED_BUCKET = "handled"
+const FAILED_BUCKET = "failed"
+const RETRY_BUCKET = "retry"
+const INBOX_RETRY_BUCKET = "inbox_retry"
+const DEAD_LETTER_BUCKET = "dead_letter"
+const SCHEDULED_BUCKET = "scheduled"
+const EXPIRED_BUCKET = "expired"
+const IN_FLIGHT_BUCKET = "in_flight"
+
+// all the queue buckets every connection has
+var CONNECTION_BUCKETS = []string{OUTBOX_BUCKET, SENT_BUCKET, INBOX_BUCKET, HANDLED_BUCKET, FAILED_BUCKET,
+	RETRY_BUCKET, INBOX_RETRY_BUCKET, DEAD_LETTER_BUCKET, SCHEDULED_BUCKET, EXPIRED_BUCKET, IN_FLIGHT_BUCKET}
+
+// the buckets holding msgs we haven't finished with, these are what we export
+var PENDING_BUCKETS = []string{OUTBOX_BUCKET, RETRY_BUCKET, IN_FLIGHT_BUCKET, SCHEDULED_BUCKET, INBOX_BUCKET,
+	INBOX_RETRY_BUCKET}
+
+// the pending buckets we wait on when draining, scheduled msgs aren't due so draining won't send them
+var DRAINABLE_BUCKETS = []string{OUTBOX_BUCKET, RETRY_BUCKET, IN_FLIGHT_BUCKET, INBOX_BUCKET, INBOX_RETRY_BUCKET}
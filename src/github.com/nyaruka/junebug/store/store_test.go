@@ -0,0 +1,677 @@
+package store_test
+
+import (
+	"database/sql"
+	"github.com/nyaruka/junebug/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runs the passed in test against each of our store backends
+func testStores(t *testing.T, test func(t *testing.T, s store.Store)) {
+	t.Run("memory", func(t *testing.T) {
+		s := store.NewMemoryStore()
+		defer s.Close()
+		test(t, s)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "junebug")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		s, err := store.OpenBoltStore(filepath.Join(dir, "junebug.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		test(t, s)
+	})
+
+	// postgres needs a database to test against, it must be a scratch one as we drop everything in it
+	url := os.Getenv("JUNEBUG_TEST_POSTGRES_URL")
+	t.Run("postgres", func(t *testing.T) {
+		if url == "" {
+			t.Skip("JUNEBUG_TEST_POSTGRES_URL not set")
+		}
+
+		db, err := sql.Open("postgres", url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("DROP TABLE IF EXISTS blobs, connection_cursors, msg_buckets, msgs, connections, schema_migrations")
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := store.OpenPostgresStore(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		test(t, s)
+	})
+}
+
+func createConnection(t *testing.T, s store.Store) *store.Connection {
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "echo"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func createMsg(t *testing.T, s store.Store, conn *store.Connection, json string) *store.Msg {
+	msg, err := store.MsgFromJson(s, strings.NewReader(json))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.ConnUuid = conn.Uuid
+
+	err = msg.WriteToOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func assertIds(t *testing.T, desc string, ids *[]uint64, err error, expected ...uint64) {
+	if err != nil {
+		t.Fatalf("%s: %s", desc, err)
+	}
+	// stores don't promise any order, our queues take care of that
+	sort.Slice(*ids, func(i, j int) bool { return (*ids)[i] < (*ids)[j] })
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+
+	if len(*ids) != len(expected) {
+		t.Fatalf("%s: expected %v, got %v", desc, expected, *ids)
+	}
+	for i := range expected {
+		if (*ids)[i] != expected[i] {
+			t.Fatalf("%s: expected %v, got %v", desc, expected, *ids)
+		}
+	}
+}
+
+func TestConnections(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+
+		loaded, err := store.ConnectionFromUuid(s, conn.Uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Senders.Type != "echo" || loaded.Receivers.Type != "http" || loaded.Senders.Count != 1 {
+			t.Errorf("Loaded connection doesn't match: %+v", loaded)
+		}
+
+		// loaded connections should be usable straight away
+		status, err := loaded.GetStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.OutgoingQueued != 0 {
+			t.Errorf("Expected empty outbox, got %d", status.OutgoingQueued)
+		}
+
+		connections, err := store.LoadAllConnections(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*connections) != 1 || (*connections)[0].Uuid != conn.Uuid {
+			t.Errorf("Expected our connection, got: %+v", *connections)
+		}
+
+		err = loaded.Delete()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.ConnectionFromUuid(s, conn.Uuid)
+		if err == nil {
+			t.Error("Expected error loading deleted connection")
+		}
+		connections, _ = store.LoadAllConnections(s)
+		if len(*connections) != 0 {
+			t.Errorf("Expected no connections, got %d", len(*connections))
+		}
+	})
+}
+
+func TestConnectionPatch(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+
+	conn, err := store.ConnectionFromJson(s, strings.NewReader(`{"senders": {"type": "echo", "config": {"pause": "5"}},
+		"receivers": {"config": {"url": "http://old/receive"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patched, err := conn.Patch(strings.NewReader(`{"uuid": "other", "senders": {"count": 3},
+		"receivers": {"config": {"url": "http://new/receive"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Uuid != conn.Uuid || patched.Senders.Type != "echo" || patched.Senders.Count != 3 {
+		t.Errorf("Patched connection doesn't match: %+v", patched)
+	}
+	if patched.Senders.Config["pause"] != "5" || patched.Receivers.Config["url"] != "http://new/receive" {
+		t.Errorf("Expected patched config to be merged, got %v and %v", patched.Senders.Config, patched.Receivers.Config)
+	}
+
+	// our original is left as it was
+	if conn.Senders.Count != 1 || conn.Receivers.Config["url"] != "http://old/receive" {
+		t.Errorf("Expected original connection to be unchanged: %+v", conn)
+	}
+
+	_, err = conn.Patch(strings.NewReader(`{"throttle": {"rate": -1}}`))
+	if err == nil {
+		t.Error("Expected error patching connection with invalid throttle")
+	}
+
+	// rates too fast or too slow to have an interval we can tick at are rejected too
+	for _, rate := range []string{"2e9", "1001", "1e-10"} {
+		_, err = conn.Patch(strings.NewReader(`{"throttle": {"rate": ` + rate + `}}`))
+		if err == nil {
+			t.Errorf("Expected error patching connection with throttle rate %s", rate)
+		}
+	}
+	for _, rate := range []string{"1000", "1e-6"} {
+		patched, err := conn.Patch(strings.NewReader(`{"throttle": {"rate": ` + rate + `}}`))
+		if err != nil {
+			t.Errorf("Expected throttle rate %s to be allowed: %s", rate, err)
+		} else if patched.Throttle.Interval() <= 0 {
+			t.Errorf("Expected throttle rate %s to have a positive interval, got %s", rate, patched.Throttle.Interval())
+		}
+	}
+}
+
+func TestMsgLifecycle(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+
+		low := createMsg(t, s, conn, `{"address": "+250788383383", "text": "low"}`)
+		high := createMsg(t, s, conn, `{"address": "+250788383383", "text": "high", "priority": "H"}`)
+
+		// high priority msgs get ids that sort ahead of low priority ones
+		if low.Id&store.LOW_PRIORITY_MASK == 0 || high.Id&store.LOW_PRIORITY_MASK != 0 {
+			t.Fatalf("Unexpected ids, low: %d high: %d", low.Id, high.Id)
+		}
+		ids, err := conn.GetOutboxMsgs()
+		assertIds(t, "outbox", ids, err, high.Id, low.Id)
+
+		// send our high priority msg
+		msg, err := store.MsgFromId(s, conn.Uuid, high.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.MarkWired("test", time.Now().Add(time.Minute))
+		err = msg.MarkSent("ext1", "submitted")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err = conn.GetOutboxMsgs()
+		assertIds(t, "outbox", ids, err, low.Id)
+
+		// we can find it by the id our transport gave it
+		msg, err = store.MsgFromExternalId(s, conn.Uuid, "ext1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Id != high.Id || msg.Status != store.STATUS_SENT || msg.Attempts != 1 || msg.Log != "submitted" {
+			t.Errorf("Loaded msg doesn't match: %+v", msg)
+		}
+		msg.MarkDelivered("delivered")
+
+		// changing a msg we loaded doesn't change what is stored until we save it
+		msg.Text = "changed"
+		msg, _ = store.MsgFromId(s, conn.Uuid, high.Id)
+		if msg.Text != "high" || msg.Status != store.STATUS_DELIVERED {
+			t.Errorf("Loaded msg doesn't match: %+v", msg)
+		}
+
+		// error our low priority msg, it waits in our retry bucket until it is due
+		msg, _ = store.MsgFromId(s, conn.Uuid, low.Id)
+		msg.MarkWired("test", time.Now().Add(time.Minute))
+		retryOn := time.Now().Add(time.Minute)
+		err = msg.MarkErrored("timeout", retryOn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err = conn.GetDueRetryMsgs(time.Now())
+		assertIds(t, "due now", ids, err)
+		ids, err = conn.GetDueRetryMsgs(retryOn)
+		assertIds(t, "due later", ids, err, low.Id)
+
+		status, err := conn.GetStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.OutgoingQueued != 0 || status.RetryQueued != 1 || status.SentResults != 1 {
+			t.Errorf("Unexpected status: %+v", status)
+		}
+
+		// being rate limited waits in our retry bucket too, but doesn't use up an attempt
+		msg.MarkRequeued()
+		msg.MarkWired("test", time.Now().Add(time.Minute))
+		err = msg.MarkRateLimited("rate limited", retryOn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _ = store.MsgFromId(s, conn.Uuid, low.Id)
+		if msg.Status != store.STATUS_ERRORED || msg.Attempts != 1 {
+			t.Errorf("Expected errored msg with one attempt, got %+v", msg)
+		}
+		ids, err = conn.GetDueRetryMsgs(retryOn)
+		assertIds(t, "due later", ids, err, low.Id)
+
+		_, err = store.MsgFromExternalId(s, conn.Uuid, "missing")
+		if err == nil {
+			t.Error("Expected error for unknown external id")
+		}
+	})
+}
+
+func TestDeadLetters(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+
+		msg := store.MsgFromText(s, conn.Uuid, "+250788383383", "hello")
+		msg.ExternalId = "ext1"
+		err := msg.WriteToInbox()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := msg.Id
+
+		ids, err := conn.GetInboxMsgs()
+		assertIds(t, "inbox", ids, err, id)
+
+		err = msg.MarkDeadLettered("gave up")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err = conn.GetDeadLetterMsgs()
+		assertIds(t, "dead letters", ids, err, id)
+
+		// can only drop msgs that are actually dead lettered
+		err = conn.DropDeadLetterMsg(id + 1)
+		if err == nil {
+			t.Error("Expected error dropping unknown msg")
+		}
+
+		err = conn.DropDeadLetterMsg(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err = conn.GetDeadLetterMsgs()
+		assertIds(t, "dead letters", ids, err)
+
+		_, err = store.MsgFromId(s, conn.Uuid, id)
+		if err == nil {
+			t.Error("Expected error loading dropped msg")
+		}
+
+		// nor is it found by its external id
+		_, err = s.GetMsgIdByExternalId(conn.Uuid, "ext1")
+		if err == nil {
+			t.Error("Expected external id to be dropped with its msg")
+		}
+	})
+}
+
+func TestScheduledMsgs(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+
+		// msgs with a send_at in the past are sent straight away
+		now := createMsg(t, s, conn, `{"address": "+250788383383", "text": "now", "send_at": "2015-07-19T16:35:25Z"}`)
+		if now.Status != store.STATUS_QUEUED || !now.SendAt.IsZero() {
+			t.Errorf("Expected queued msg, got: %+v", now)
+		}
+
+		sendAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		later := createMsg(t, s, conn, `{"address": "+250788383383", "text": "later", "send_at": "`+sendAt+`"}`)
+		cancelled := createMsg(t, s, conn, `{"address": "+250788383383", "text": "never", "send_at": "`+sendAt+`"}`)
+		if later.Status != store.STATUS_SCHEDULED {
+			t.Errorf("Expected scheduled msg, got: %+v", later)
+		}
+
+		ids, err := conn.GetOutboxMsgs()
+		assertIds(t, "outbox", ids, err, now.Id)
+		ids, err = conn.GetScheduledMsgs()
+		assertIds(t, "scheduled", ids, err, later.Id, cancelled.Id)
+		ids, err = conn.GetDueScheduledMsgs(time.Now())
+		assertIds(t, "due now", ids, err)
+
+		// cancel one of them, it can't be released after that
+		msg, _ := store.MsgFromId(s, conn.Uuid, cancelled.Id)
+		err = msg.MarkCancelled()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.MarkReleased() == nil || msg.MarkCancelled() == nil {
+			t.Error("Expected error releasing or cancelling cancelled msg")
+		}
+
+		// release the other once it is due
+		ids, err = conn.GetDueScheduledMsgs(time.Now().Add(2 * time.Hour))
+		assertIds(t, "due later", ids, err, later.Id)
+
+		msg, _ = store.MsgFromId(s, conn.Uuid, later.Id)
+		err = msg.MarkReleased()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err = conn.GetOutboxMsgs()
+		assertIds(t, "outbox", ids, err, now.Id, later.Id)
+		ids, err = conn.GetScheduledMsgs()
+		assertIds(t, "scheduled", ids, err)
+	})
+}
+
+func TestMsgExpiry(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+
+		// validity is counted from when we are to be sent
+		sendAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		msg := createMsg(t, s, conn, `{"address": "+250788383383", "text": "code", "validity": 60, "send_at": "`+
+			sendAt.Format(time.RFC3339)+`"}`)
+		if !msg.ExpiresOn.Equal(sendAt.Add(time.Minute)) {
+			t.Errorf("Expected expires on %s, got %s", sendAt.Add(time.Minute), msg.ExpiresOn)
+		}
+		if msg.IsExpired(sendAt) || !msg.IsExpired(sendAt.Add(time.Minute)) {
+			t.Errorf("Msg expiring at the wrong time: %s", msg.ExpiresOn)
+		}
+
+		// bad combinations are rejected
+		invalid := []string{
+			`{"address": "+250788383383", "text": "code", "validity": -1}`,
+			`{"address": "+250788383383", "text": "code", "validity": 60, "expires_on": "2030-01-01T00:00:00Z"}`,
+			`{"address": "+250788383383", "text": "code", "expires_on": "2015-01-01T00:00:00Z"}`,
+		}
+		for _, json := range invalid {
+			_, err := store.MsgFromJson(s, strings.NewReader(json))
+			if err == nil {
+				t.Errorf("Expected error for %s", json)
+			}
+		}
+
+		// expire a msg in our outbox
+		msg = createMsg(t, s, conn, `{"address": "+250788383383", "text": "code", "expires_on": "2030-01-01T00:00:00Z"}`)
+		err := msg.MarkExpired("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err := conn.GetOutboxMsgs()
+		assertIds(t, "outbox", ids, err)
+
+		status, err := conn.GetStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.ExpiredResults != 1 || status.Scheduled != 1 {
+			t.Errorf("Unexpected status: %+v", status)
+		}
+
+		msg, _ = store.MsgFromId(s, conn.Uuid, msg.Id)
+		if msg.Status != store.STATUS_EXPIRED || msg.Finished.IsZero() {
+			t.Errorf("Expected expired msg, got: %+v", msg)
+		}
+	})
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+		if conn.GetIdempotencyWindow() != store.DEFAULT_IDEMPOTENCY_WINDOW*time.Second {
+			t.Errorf("Expected default window, got %s", conn.GetIdempotencyWindow())
+		}
+
+		first := createMsg(t, s, conn, `{"address": "+250788383383", "text": "hi", "idempotency_key": "abc"}`)
+		createMsg(t, s, conn, `{"address": "+250788383383", "text": "other", "idempotency_key": "def"}`)
+
+		msg, err := store.MsgFromIdempotencyKey(s, conn.Uuid, "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Id != first.Id || msg.IdempotencyKey != "abc" {
+			t.Errorf("Expected first msg, got: %+v", msg)
+		}
+
+		_, err = store.MsgFromIdempotencyKey(s, conn.Uuid, "xyz")
+		if err == nil {
+			t.Error("Expected error for unknown idempotency key")
+		}
+
+		// dropping a msg removes its key, rather than leaving it pointing at a msg that's gone
+		err = msg.MarkDeadLettered("gave up")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = conn.DropDeadLetterMsg(first.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetMsgIdByIdempotencyKey(conn.Uuid, "abc")
+		if err == nil {
+			t.Error("Expected idempotency key to be dropped with its msg")
+		}
+		_, err = s.GetMsgIdByIdempotencyKey(conn.Uuid, "def")
+		if err != nil {
+			t.Errorf("Expected other idempotency key to remain, got: %s", err)
+		}
+	})
+}
+
+func TestInFlightLeases(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+		msg := createMsg(t, s, conn, `{"address": "+250788383383", "text": "hi"}`)
+
+		leaseExpires := time.Now().Add(time.Minute)
+		err := msg.MarkWired("host:1/abc/0", leaseExpires)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// wired msgs leave our outbox for our in flight bucket
+		ids, err := conn.GetOutboxMsgs()
+		assertIds(t, "outbox", ids, err)
+
+		status, err := conn.GetStatus()
+		if err != nil || status.InFlight != 1 || status.OutgoingQueued != 0 {
+			t.Errorf("Expected one msg in flight, got %+v %v", status, err)
+		}
+
+		loaded, err := store.MsgFromId(s, conn.Uuid, msg.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Owner != "host:1/abc/0" || loaded.LeaseExpires.Sub(leaseExpires) > time.Millisecond || loaded.Status != store.STATUS_WIRED {
+			t.Errorf("Unexpected in flight msg: %+v", loaded)
+		}
+
+		ids, err = conn.GetExpiredLeaseMsgs(time.Now())
+		assertIds(t, "expired now", ids, err)
+
+		ids, err = conn.GetExpiredLeaseMsgs(leaseExpires.Add(time.Second))
+		assertIds(t, "expired later", ids, err, msg.Id)
+
+		// requeuing puts it back in our outbox
+		err = loaded.MarkLeaseRequeued("lease expired")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids, err = conn.GetOutboxMsgs()
+		assertIds(t, "outbox", ids, err, msg.Id)
+		ids, err = conn.GetExpiredLeaseMsgs(leaseExpires.Add(time.Second))
+		assertIds(t, "expired later", ids, err)
+
+		// and sending it takes it out of flight
+		loaded.MarkWired("host:1/abc/1", leaseExpires)
+		err = loaded.MarkSent("ext1", "sent")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status, err = conn.GetStatus()
+		if err != nil || status.InFlight != 0 || status.SentResults != 1 {
+			t.Errorf("Expected msg to be sent, got %+v %v", status, err)
+		}
+	})
+}
+
+func TestCursors(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+
+		value, err := conn.LoadCursor("last_dm")
+		if err != nil || value != "" {
+			t.Fatalf("Expected empty cursor, got \"%s\" %v", value, err)
+		}
+
+		conn.SaveCursor("last_dm", "1234")
+		err = conn.SaveCursor("last_dm", "5678")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// cursors are kept per connection
+		other := createConnection(t, s)
+		other.SaveCursor("last_dm", "9999")
+
+		value, err = conn.LoadCursor("last_dm")
+		if err != nil || value != "5678" {
+			t.Errorf("Expected cursor 5678, got \"%s\" %v", value, err)
+		}
+
+		// and are deleted with it
+		conn.Delete()
+		value, err = conn.LoadCursor("last_dm")
+		if err != nil || value != "" {
+			t.Errorf("Expected no cursor for deleted connection, got \"%s\" %v", value, err)
+		}
+
+		conn.Save()
+		value, err = conn.LoadCursor("last_dm")
+		if err != nil || value != "" {
+			t.Errorf("Expected cursor to be deleted with its connection, got \"%s\" %v", value, err)
+		}
+	})
+}
+
+func TestAttachments(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+
+		attachment, err := conn.SaveBlob("image/png", []byte("png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attachment.Blob == "" || attachment.ContentType != "image/png" || attachment.Size != 3 {
+			t.Errorf("Unexpected attachment: %+v", attachment)
+		}
+
+		blob, err := conn.LoadBlob(attachment.Blob)
+		if err != nil || blob.ContentType != "image/png" || string(blob.Data) != "png" {
+			t.Errorf("Loaded blob doesn't match: %+v %v", blob, err)
+		}
+
+		_, err = conn.SaveBlob("image/png", make([]byte, store.MAX_BLOB_SIZE+1))
+		if err == nil {
+			t.Error("Expected error saving blob over our size limit")
+		}
+		_, err = conn.LoadBlob("missing")
+		if err == nil {
+			t.Error("Expected error loading missing blob")
+		}
+
+		// msgs can have attachments instead of text
+		msg := createMsg(t, s, conn, `{"address": "+250788383383", "attachments": [
+			{"content_type": "image/png", "blob": "`+attachment.Blob+`"},
+			{"content_type": "image/jpeg", "url": "http://example.com/cat.jpg"}]}`)
+		loaded, err := store.MsgFromId(s, conn.Uuid, msg.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded.Attachments) != 2 || loaded.Attachments[0].Blob != attachment.Blob ||
+			loaded.Attachments[1].Url != "http://example.com/cat.jpg" {
+			t.Errorf("Loaded attachments don't match: %+v", loaded.Attachments)
+		}
+
+		for _, invalid := range []string{
+			`{"address": "+250788383383"}`,
+			`{"address": "+250788383383", "attachments": [{"url": "http://example.com/cat.jpg"}]}`,
+			`{"address": "+250788383383", "attachments": [{"content_type": "image/jpeg"}]}`,
+			`{"address": "+250788383383", "attachments": [{"content_type": "image/jpeg", "url": "http://example.com/cat.jpg", "blob": "abc"}]}`,
+		} {
+			_, err = store.MsgFromJson(s, strings.NewReader(invalid))
+			if err == nil {
+				t.Errorf("Expected error for invalid msg: %s", invalid)
+			}
+		}
+
+		// blobs are deleted with their connection
+		conn.Delete()
+		conn.Save()
+		_, err = conn.LoadBlob(attachment.Blob)
+		if err == nil {
+			t.Error("Expected blob to be deleted with its connection")
+		}
+	})
+}
+
+func TestMetadata(t *testing.T) {
+	testStores(t, func(t *testing.T, s store.Store) {
+		conn := createConnection(t, s)
+
+		msg := createMsg(t, s, conn, `{"address": "+250788383383", "text": "hi", "metadata": {"order": "1234", "campaign": "spring"}}`)
+		err := msg.MarkSent("ext1", "sent")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// our metadata survives being saved and is there when we look the msg up by its external id
+		loaded, err := store.MsgFromExternalId(s, conn.Uuid, "ext1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loaded.Metadata) != 2 || loaded.Metadata["order"] != "1234" || loaded.Metadata["campaign"] != "spring" {
+			t.Errorf("Loaded metadata doesn't match: %+v", loaded.Metadata)
+		}
+		loaded.Release()
+
+		// msgs without metadata don't get any
+		msg = createMsg(t, s, conn, `{"address": "+250788383383", "text": "hi"}`)
+		loaded, err = store.MsgFromId(s, conn.Uuid, msg.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Metadata != nil {
+			t.Errorf("Expected no metadata, got %+v", loaded.Metadata)
+		}
+	})
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// The fastest we'll throttle a connection to, beyond this there is no point throttling it at all
+const MAX_THROTTLE_RATE = 1000
+
+// How fast a connection may send msgs, a rate of zero means as fast as our senders can go.
+// Burst is how many msgs can be sent back to back after a quiet spell, it defaults to one.
+type ThrottleConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst uint    `json:"burst"`
+}
+
+func (t *ThrottleConfig) setDefaults() {
+	if t.Rate > 0 && t.Burst == 0 {
+		t.Burst = 1
+	}
+}
+
+func (t *ThrottleConfig) validate() error {
+	if t.Rate < 0 || t.Rate > MAX_THROTTLE_RATE {
+		return errors.New(fmt.Sprintf("`throttle.rate` must be between 0 and %d msgs per second", MAX_THROTTLE_RATE))
+	}
+
+	// rates so slow their interval doesn't fit in a duration can't be throttled to either
+	if t.Rate > 0 && (float64(time.Second)/t.Rate >= math.MaxInt64 || t.Interval() <= 0) {
+		return errors.New("`throttle.rate` is too slow, it must allow at least one msg every few hundred years")
+	}
+	return nil
+}
+
+// Whether we limit how fast msgs are sent at all
+func (t ThrottleConfig) IsThrottled() bool {
+	return t.Rate > 0
+}
+
+// Returns how often we are allowed to send a msg
+func (t ThrottleConfig) Interval() time.Duration {
+	return time.Duration(float64(time.Second) / t.Rate)
+}